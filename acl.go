@@ -0,0 +1,314 @@
+package sipgox
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// Access control of incoming requests. Public listeners get constant scanning so requests
+// can be filtered by source address and rate limited per source before reaching handlers
+
+// ACL filters incoming requests by source IP. Lists are CIDRs or plain IPs per method,
+// where method "*" applies to all methods. Deny has precedence over Allow. If Allow list
+// exists for method, source must match it.
+type ACL struct {
+	Allow map[string][]string
+	Deny  map[string][]string
+	// Rate is allowed requests per second of each source IP. Zero disables rate limit.
+	// Requests within established dialogs, like BYE and ACK, are not limited
+	Rate float64
+	// Burst is size of token bucket. Default is Rate but at least 1
+	Burst int
+	// Reject responds with 403 to blocked requests. Default is to drop them silently
+	Reject bool
+}
+
+// ACLStats are counters of requests passed through ACL
+type ACLStats struct {
+	Allowed     uint64
+	Denied      uint64
+	RateLimited uint64
+}
+
+// WithPhoneACL filters requests received by phone servers. Invalid CIDR fails Answer, Dial and Register
+func WithPhoneACL(acl ACL) PhoneOption {
+	return func(p *Phone) {
+		f, err := newRequestFilter(acl)
+		if err != nil {
+			p.optionError(fmt.Errorf("bad ACL: %w", err))
+			return
+		}
+		p.acl = f
+	}
+}
+
+// ACLStats returns counters of ACL. Zero if ACL is not set
+func (p *Phone) ACLStats() ACLStats {
+	if p.acl == nil {
+		return ACLStats{}
+	}
+	return p.acl.stats()
+}
+
+type requestFilter struct {
+	allow  map[string][]*net.IPNet
+	deny   map[string][]*net.IPNet
+	rate   float64
+	burst  float64
+	reject bool
+	// now is clock of rate limit, time.Now if not replaced by tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	// dialogs are established dialogs. Their requests are not rate limited
+	dialogs map[string]aclDialog
+
+	allowed atomic.Uint64
+	denied  atomic.Uint64
+	limited atomic.Uint64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type aclDialog struct {
+	dialog  *sipgo.Dialog
+	created time.Time
+}
+
+func newRequestFilter(acl ACL) (*requestFilter, error) {
+	allow, err := parseACLNets(acl.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseACLNets(acl.Deny)
+	if err != nil {
+		return nil, err
+	}
+	f := &requestFilter{
+		allow:   allow,
+		deny:    deny,
+		rate:    acl.Rate,
+		burst:   float64(acl.Burst),
+		reject:  acl.Reject,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+		dialogs: make(map[string]aclDialog),
+	}
+	if f.burst <= 0 {
+		f.burst = max(1, f.rate)
+	}
+	return f, nil
+}
+
+// parseACLNets parses CIDR lists by method. Plain IP is host network
+func parseACLNets(lists map[string][]string) (map[string][]*net.IPNet, error) {
+	nets := make(map[string][]*net.IPNet, len(lists))
+	for method, cidrs := range lists {
+		method = strings.ToUpper(method)
+		for _, c := range cidrs {
+			if !strings.Contains(c, "/") {
+				if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+					c += "/32"
+				} else {
+					c += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, fmt.Errorf("%s entry: %w", method, err)
+			}
+			nets[method] = append(nets[method], n)
+		}
+	}
+	return nets, nil
+}
+
+func aclMatch(nets map[string][]*net.IPNet, method string, ip net.IP) (listed bool, match bool) {
+	for _, m := range []string{method, "*"} {
+		list, exists := nets[m]
+		if !exists {
+			continue
+		}
+		listed = true
+		for _, n := range list {
+			if n.Contains(ip) {
+				return true, true
+			}
+		}
+	}
+	return listed, false
+}
+
+// permitted checks ACL of source IP for method
+func (f *requestFilter) permitted(method string, ip net.IP) bool {
+	if _, deny := aclMatch(f.deny, method, ip); deny {
+		return false
+	}
+	listed, allow := aclMatch(f.allow, method, ip)
+	return !listed || allow
+}
+
+// take consumes token from bucket of source. Buckets which are full again are removed
+// from time to time to not keep every scanner address in memory
+func (f *requestFilter) take(source string, now time.Time) bool {
+	if f.rate <= 0 {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if now.Sub(f.lastSweep) > time.Minute {
+		for s, b := range f.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*f.rate >= f.burst {
+				delete(f.buckets, s)
+			}
+		}
+		// Dialog which never got ACK is not confirmed
+		for id, d := range f.dialogs {
+			state := d.dialog.LoadState()
+			if state == sip.DialogStateEnded || (state < sip.DialogStateConfirmed && now.Sub(d.created) > sip.Timer_H) {
+				delete(f.dialogs, id)
+			}
+		}
+		f.lastSweep = now
+	}
+
+	b, exists := f.buckets[source]
+	if !exists {
+		b = &tokenBucket{tokens: f.burst, last: now}
+		f.buckets[source] = b
+	}
+	b.tokens = min(f.burst, b.tokens+now.Sub(b.last).Seconds()*f.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// addDialog exempts requests of dialog from rate limit until it ends or is removed
+func (f *requestFilter) addDialog(d *sipgo.Dialog) {
+	if f == nil || f.rate <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dialogs[d.ID] = aclDialog{dialog: d, created: f.now()}
+}
+
+func (f *requestFilter) removeDialog(d *sipgo.Dialog) {
+	if f == nil || f.rate <= 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.dialogs, d.ID)
+}
+
+// inDialog checks does request belong to dialog which is not ended. We can be UAC or UAS
+// of dialog, so both tag orders are tried
+func (f *requestFilter) inDialog(req *sip.Request) bool {
+	uasID, err := sip.UASReadRequestDialogID(req)
+	if err != nil {
+		return false
+	}
+	uacID, _ := sip.UACReadRequestDialogID(req)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range []string{uasID, uacID} {
+		if d, exists := f.dialogs[id]; exists && d.dialog.LoadState() != sip.DialogStateEnded {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns false if request must be blocked
+func (f *requestFilter) check(req *sip.Request) bool {
+	host, _, err := net.SplitHostPort(req.Source())
+	if err != nil {
+		host = req.Source()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !f.permitted(req.Method.String(), ip) {
+		f.denied.Add(1)
+		return false
+	}
+	if f.rate > 0 && !f.inDialog(req) && !f.take(ip.String(), f.now()) {
+		f.limited.Add(1)
+		return false
+	}
+	f.allowed.Add(1)
+	return true
+}
+
+func (f *requestFilter) stats() ACLStats {
+	return ACLStats{
+		Allowed:     f.allowed.Load(),
+		Denied:      f.denied.Load(),
+		RateLimited: f.limited.Load(),
+	}
+}
+
+// filterRequest wraps handler with ACL. Blocked request is dropped or answered with 403.
+// ACK is never answered
+func (p *Phone) filterRequest(handler sipgo.RequestHandler) sipgo.RequestHandler {
+	f := p.acl
+	if f == nil {
+		return handler
+	}
+	return func(req *sip.Request, tx sip.ServerTransaction) {
+		if f.check(req) {
+			handler(req, tx)
+			return
+		}
+
+		p.log.Debug().Str("method", req.Method.String()).Str("source", req.Source()).Msg("Request blocked by ACL")
+		if !f.reject || req.IsAck() || tx == nil {
+			return
+		}
+		res := sip.NewResponseFromRequest(req, sip.StatusForbidden, "Forbidden", nil)
+		if err := tx.Respond(res); err != nil {
+			p.log.Error().Err(err).Msg("Failed to respond 403")
+		}
+	}
+}
+
+// newServer creates server on phone UA. With ACL requests without handler are filtered
+// as well before responding 405
+func (p *Phone) newServer() (*sipgo.Server, error) {
+	server, err := sipgo.NewServer(p.UA)
+	if err != nil {
+		return nil, err
+	}
+	if p.acl == nil {
+		return server, nil
+	}
+
+	server.OnNoRoute(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
+		if req.IsAck() || tx == nil {
+			return
+		}
+		res := sip.NewResponseFromRequest(req, sip.StatusMethodNotAllowed, "Method Not Allowed", nil)
+		if err := tx.Respond(res); err != nil {
+			p.log.Error().Err(err).Msg("Failed to respond 405")
+		}
+	}))
+	return server, nil
+}
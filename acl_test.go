@@ -0,0 +1,245 @@
+package sipgox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/rs/zerolog"
+)
+
+// testServerTx records responses. Done is closed when transaction is finished
+type testServerTx struct {
+	sip.ServerTransaction
+	responses []*sip.Response
+	done      chan struct{}
+	err       error
+}
+
+func (tx *testServerTx) Done() <-chan struct{} {
+	return tx.done
+}
+
+func (tx *testServerTx) Err() error {
+	return tx.err
+}
+
+func (tx *testServerTx) Respond(res *sip.Response) error {
+	tx.responses = append(tx.responses, res)
+	return nil
+}
+
+func aclTestRequest(method sip.RequestMethod, source string, toTag string) *sip.Request {
+	req := sip.NewRequest(method, sip.Uri{Scheme: "sip", User: "alice", Host: "example.test"})
+	req.AppendHeader(sip.NewHeader("Via", "SIP/2.0/UDP "+source+";branch=z9hG4bK.acl"))
+	req.AppendHeader(sip.NewHeader("From", "<sip:bob@example.test>;tag=from"))
+	to := "<sip:alice@example.test>"
+	if toTag != "" {
+		to += ";tag=" + toTag
+	}
+	req.AppendHeader(sip.NewHeader("To", to))
+	req.AppendHeader(sip.NewHeader("Call-ID", "acl-test"))
+	req.AppendHeader(sip.NewHeader("CSeq", "1 "+method.String()))
+	req.SetSource(source)
+	return req
+}
+
+func aclTestDialog(id string, state sip.DialogState) *sipgo.Dialog {
+	d := &sipgo.Dialog{ID: id, InviteRequest: aclTestRequest(sip.INVITE, "10.0.0.1:5060", "")}
+	d.InitWithState(state)
+	return d
+}
+
+// aclTestFilter is phone with ACL on fixed clock. Handled requests are counted
+type aclTestFilter struct {
+	p       *Phone
+	now     time.Time
+	handled int
+	handler sipgo.RequestHandler
+}
+
+func newACLTestFilter(t *testing.T, acl ACL) *aclTestFilter {
+	t.Helper()
+	f, err := newRequestFilter(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &aclTestFilter{
+		p:   &Phone{acl: f, log: zerolog.Nop()},
+		now: time.Unix(1000, 0),
+	}
+	f.now = func() time.Time { return a.now }
+	a.handler = a.p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
+		a.handled++
+	})
+	return a
+}
+
+// passes returns true if request reached handler
+func (a *aclTestFilter) passes(req *sip.Request) bool {
+	handled := a.handled
+	a.handler(req, &testServerTx{})
+	return a.handled > handled
+}
+
+func TestFilterRequestACL(t *testing.T) {
+	a := newACLTestFilter(t, ACL{
+		Allow: map[string][]string{
+			"*":        {"10.0.0.0/8"},
+			"register": {"192.168.1.10"},
+		},
+		Deny: map[string][]string{
+			"*":      {"10.0.0.66"},
+			"INVITE": {"10.1.0.0/16"},
+		},
+	})
+
+	tests := []struct {
+		method sip.RequestMethod
+		source string
+		pass   bool
+	}{
+		{sip.INVITE, "10.0.0.1:5060", true},
+		// Deny has precedence over allow
+		{sip.INVITE, "10.0.0.66:5060", false},
+		{sip.OPTIONS, "10.0.0.66:5060", false},
+		{sip.INVITE, "10.1.2.3:5060", false},
+		{sip.OPTIONS, "10.1.2.3:5060", true},
+		// Not in allow list of method or "*"
+		{sip.INVITE, "192.168.1.10:5060", false},
+		{sip.REGISTER, "192.168.1.10:5060", true},
+		{sip.REGISTER, "192.168.1.11:5060", false},
+		{sip.INVITE, "[2001:db8::1]:5060", false},
+		{sip.INVITE, "bad", false},
+	}
+	for _, tc := range tests {
+		if pass := a.passes(aclTestRequest(tc.method, tc.source, "")); pass != tc.pass {
+			t.Errorf("%s from %s: expected pass %v", tc.method, tc.source, tc.pass)
+		}
+	}
+	if s := a.p.ACLStats(); s.Allowed != 3 || s.Denied != 7 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestFilterRequestReject(t *testing.T) {
+	a := newACLTestFilter(t, ACL{Deny: map[string][]string{"*": {"10.0.0.0/8"}}, Reject: true})
+
+	tx := &testServerTx{}
+	a.handler(aclTestRequest(sip.INVITE, "10.0.0.1:5060", ""), tx)
+	if len(tx.responses) != 1 || tx.responses[0].StatusCode != sip.StatusForbidden {
+		t.Fatalf("expected 403, got %v", tx.responses)
+	}
+
+	// ACK is never answered
+	tx = &testServerTx{}
+	a.handler(aclTestRequest(sip.ACK, "10.0.0.1:5060", "to"), tx)
+	if len(tx.responses) != 0 {
+		t.Errorf("unexpected response to ACK %v", tx.responses)
+	}
+}
+
+func TestFilterRequestRateLimit(t *testing.T) {
+	a := newACLTestFilter(t, ACL{Rate: 2, Burst: 3})
+	src, other := "10.0.0.1:5060", "10.0.0.2:5060"
+
+	// Burst passes and then bucket is empty
+	for i := 0; i < 3; i++ {
+		if !a.passes(aclTestRequest(sip.OPTIONS, src, "")) {
+			t.Fatalf("request %d of burst blocked", i)
+		}
+	}
+	if a.passes(aclTestRequest(sip.OPTIONS, src, "")) {
+		t.Fatal("expected rate limit after burst")
+	}
+	// Other source has own bucket
+	if !a.passes(aclTestRequest(sip.OPTIONS, other, "")) {
+		t.Fatal("expected other source to pass")
+	}
+
+	// Rate 2/s refills token every 500ms
+	a.now = a.now.Add(400 * time.Millisecond)
+	if a.passes(aclTestRequest(sip.OPTIONS, src, "")) {
+		t.Fatal("expected rate limit before token is refilled")
+	}
+	a.now = a.now.Add(100 * time.Millisecond)
+	if !a.passes(aclTestRequest(sip.OPTIONS, src, "")) {
+		t.Fatal("expected refilled token")
+	}
+	if s := a.p.ACLStats(); s.RateLimited != 2 || s.Allowed != 5 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestFilterRequestInDialog(t *testing.T) {
+	a := newACLTestFilter(t, ACL{Rate: 1})
+	src := "10.0.0.1:5060"
+
+	bye := aclTestRequest(sip.BYE, src, "to")
+	id, err := sip.UASReadRequestDialogID(bye)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := aclTestDialog(id, sip.DialogStateConfirmed)
+	a.p.acl.addDialog(d)
+
+	// Bucket is empty, but requests in dialog pass
+	if !a.passes(aclTestRequest(sip.OPTIONS, src, "")) || a.passes(aclTestRequest(sip.OPTIONS, src, "")) {
+		t.Fatal("expected rate limit of requests out of dialog")
+	}
+	for i := 0; i < 3; i++ {
+		if !a.passes(bye) {
+			t.Fatal("expected request in dialog to pass")
+		}
+	}
+
+	// We can be UAC of dialog, so tags of request are in other order
+	uacID, _ := sip.UACReadRequestDialogID(bye)
+	a.p.acl.removeDialog(d)
+	d = aclTestDialog(uacID, sip.DialogStateConfirmed)
+	a.p.acl.addDialog(d)
+	if !a.passes(bye) {
+		t.Fatal("expected request in dialog as UAC to pass")
+	}
+
+	// Ended dialog is not exempted
+	d.InitWithState(sip.DialogStateEnded)
+	if a.passes(bye) {
+		t.Fatal("expected request of ended dialog to be rate limited")
+	}
+}
+
+func TestFilterRequestSweep(t *testing.T) {
+	// Token is refilled every 100s
+	a := newACLTestFilter(t, ACL{Rate: 0.01, Burst: 2})
+	f := a.p.acl
+
+	a.passes(aclTestRequest(sip.OPTIONS, "10.0.0.1:5060", ""))
+	a.passes(aclTestRequest(sip.OPTIONS, "10.0.0.1:5060", ""))
+	a.passes(aclTestRequest(sip.OPTIONS, "10.0.0.2:5060", ""))
+	for _, d := range []*sipgo.Dialog{
+		aclTestDialog("ended", sip.DialogStateEnded),
+		aclTestDialog("early", sip.DialogStateEstablished),
+		aclTestDialog("confirmed", sip.DialogStateConfirmed),
+	} {
+		f.addDialog(d)
+	}
+
+	// Sweep is done once a minute by next request
+	a.now = a.now.Add(101 * time.Second)
+	a.passes(aclTestRequest(sip.OPTIONS, "10.0.0.3:5060", ""))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.buckets["10.0.0.2"]; exists {
+		t.Error("expected full bucket to be swept")
+	}
+	if _, exists := f.buckets["10.0.0.1"]; !exists || len(f.buckets) != 2 {
+		t.Errorf("expected bucket which is not full to be kept, got %d buckets", len(f.buckets))
+	}
+	// Dialog which never got ACK is swept after Timer H
+	if _, exists := f.dialogs["confirmed"]; !exists || len(f.dialogs) != 1 {
+		t.Errorf("expected only confirmed dialog to be kept, got %d", len(f.dialogs))
+	}
+}
@@ -0,0 +1,472 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Media anchoring bridge of inbound and outbound call, as B2BUA does. RTP is relayed with
+// payload types of other leg and our own SSRC and sequence numbers, so that stream changes
+// on one leg are not seen on other. RTCP is not relayed, each leg reports on its own.
+// BYE of one leg hangs up other and hold is passed with re-INVITE to other leg.
+
+// BridgeStats are statistics of ended bridge
+type BridgeStats struct {
+	// AToB is media relayed from a to b and BToA from b to a
+	AToB BridgeStreamStats
+	BToA BridgeStreamStats
+	// ReInvites is number of re-INVITEs received on legs
+	ReInvites int
+	// HangupBy is leg which hung up first, "a" or "b". Empty when bridge ended with ctx
+	HangupBy string
+	Duration time.Duration
+}
+
+// BridgeStreamStats are statistics of one relay direction
+type BridgeStreamStats struct {
+	Packets uint64
+	// Bytes is relayed payload size
+	Bytes uint64
+	// Dropped are packets failed to read or with payload type not negotiated on other leg
+	Dropped uint64
+	// SSRCChanges counts new streams on receiving leg which are hidden with rewriting
+	SSRCChanges uint64
+}
+
+// Bridge relays media between answered dialog a and dialed dialog b until one of them
+// hangs up or ctx is done. Other leg is then hung up as well and both legs are closed.
+// Re-INVITEs of legs are handled by bridge while it runs.
+// Legs must come from phones with different user agents, as UA passes requests only to
+// server created last, ex use one phone for Answer and other for Dial.
+//
+// returns ctx error in case ctx ended bridge
+func Bridge(ctx context.Context, a *DialogServerSession, b *DialogClientSession) (BridgeStats, error) {
+	if a.dmedia == nil || b.dmedia == nil {
+		return BridgeStats{}, fmt.Errorf("bridged dialogs must have media session")
+	}
+	if a.ua != nil && a.ua == b.ua {
+		return BridgeStats{}, fmt.Errorf("bridged dialogs must be of phones with different user agents")
+	}
+
+	br := newBridge(a, b, log.With().Str("caller", "Bridge").Str("call_id", a.InviteRequest.CallID().Value()).Logger())
+	a.reinvite.set(br.onReInvite(br.a, br.b))
+	defer a.reinvite.set(nil)
+	b.reinvite.set(br.onReInvite(br.b, br.a))
+	defer b.reinvite.set(nil)
+
+	start := time.Now()
+	var stats BridgeStats
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		stats.AToB = br.relay(br.a, br.b, &br.ptAToB)
+	}()
+	go func() {
+		defer wg.Done()
+		stats.BToA = br.relay(br.b, br.a, &br.ptBToA)
+	}()
+	br.log.Info().Msg("Bridge started")
+
+	select {
+	case <-br.a.ctx.Done():
+		stats.HangupBy = br.a.name
+	case <-br.b.ctx.Done():
+		stats.HangupBy = br.b.name
+	case <-ctx.Done():
+	}
+
+	hctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	var err error
+	for _, l := range []*bridgeLeg{br.a, br.b} {
+		if l.ctx.Err() != nil {
+			continue
+		}
+		if herr := l.hangup(hctx); herr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to hang up leg %s: %w", l.name, herr))
+		}
+	}
+	cancel()
+
+	close(br.done)
+	a.Close()
+	b.Close()
+	wg.Wait()
+
+	stats.ReInvites = int(br.reInvites.Load())
+	stats.Duration = time.Since(start)
+	br.log.Info().Str("hangup_by", stats.HangupBy).Str("duration", stats.Duration.String()).Msg("Bridge ended")
+	if stats.HangupBy == "" {
+		err = errors.Join(ctx.Err(), err)
+	}
+	return stats, err
+}
+
+// reInviteHook lets bridge take over re-INVITEs of dialog
+type reInviteHook struct {
+	mu      sync.Mutex
+	handler func(req *sip.Request, tx sip.ServerTransaction)
+}
+
+func (h *reInviteHook) get() func(req *sip.Request, tx sip.ServerTransaction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.handler
+}
+
+func (h *reInviteHook) set(handler func(req *sip.Request, tx sip.ServerTransaction)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handler = handler
+}
+
+// bridgeLeg hides differences of server and client dialog
+type bridgeLeg struct {
+	name  string
+	ctx   context.Context
+	msess *media.MediaSession
+
+	readRTP      func(buf []byte, pkt *rtp.Packet) error
+	writeRTP     func(pkt *rtp.Packet) error
+	do           func(ctx context.Context, req *sip.Request) (*sip.Response, error)
+	writeRequest func(req *sip.Request) error
+	hangup       func(ctx context.Context) error
+	setRemote    func(raddr *net.UDPAddr)
+
+	// target is remote target and contact is ours for re-INVITE
+	target    sip.Uri
+	transport string
+	contact   *sip.ContactHeader
+
+	// Last SDP of leg. Changed only with re-INVITE
+	localSDP  []byte
+	remoteSDP []byte
+}
+
+type bridge struct {
+	a, b *bridgeLeg
+	log  zerolog.Logger
+	done chan struct{}
+
+	// mu guards remote media of legs and payload type maps while relaying
+	mu     sync.RWMutex
+	ptAToB map[uint8]bridgePayload
+	ptBToA map[uint8]bridgePayload
+
+	// reinviteMu serializes re-INVITEs as they are passed between legs
+	reinviteMu sync.Mutex
+	reInvites  atomic.Int32
+}
+
+func newBridge(a *DialogServerSession, b *DialogClientSession, log zerolog.Logger) *bridge {
+	legA := &bridgeLeg{
+		name:         "a",
+		ctx:          a.Context(),
+		msess:        a.dmedia.sess,
+		readRTP:      a.ReadRTP,
+		writeRTP:     a.WriteRTP,
+		do:           a.Do,
+		writeRequest: a.DialogServerSession.WriteRequest,
+		hangup:       a.Hangup,
+		setRemote:    a.dmedia.setRemote,
+		transport:    a.InviteRequest.Transport(),
+		contact:      a.InviteResponse.Contact(),
+		localSDP:     a.InviteResponse.Body(),
+		remoteSDP:    a.InviteRequest.Body(),
+	}
+	if c := a.InviteRequest.Contact(); c != nil {
+		legA.target = c.Address
+	}
+
+	legB := &bridgeLeg{
+		name:         "b",
+		ctx:          b.Context(),
+		msess:        b.dmedia.sess,
+		readRTP:      b.ReadRTP,
+		writeRTP:     b.WriteRTP,
+		do:           b.Do,
+		writeRequest: b.DialogClientSession.WriteRequest,
+		hangup:       b.Hangup,
+		setRemote:    b.dmedia.setRemote,
+		transport:    b.InviteRequest.Transport(),
+		contact:      b.InviteRequest.Contact(),
+		localSDP:     b.InviteRequest.Body(),
+		remoteSDP:    b.InviteResponse.Body(),
+	}
+	if c := b.InviteResponse.Contact(); c != nil {
+		legB.target = c.Address
+	}
+
+	br := &bridge{a: legA, b: legB, log: log, done: make(chan struct{})}
+	br.updatePayloadTypes()
+	return br
+}
+
+// updatePayloadTypes maps payload types we receive on leg to payload types with same
+// encoding which other leg receives. Must be called with mu locked
+func (br *bridge) updatePayloadTypes() {
+	br.ptAToB = bridgePayloadTypes(br.a.localSDP, br.b.remoteSDP)
+	br.ptBToA = bridgePayloadTypes(br.b.localSDP, br.a.remoteSDP)
+}
+
+// bridgePayload is payload type of other leg and timestamp increment of one packet
+// of received stream, which is clock rate of format times packet time
+type bridgePayload struct {
+	pt    uint8
+	frame uint32
+}
+
+func bridgePayloadTypes(recvSDP []byte, sendSDP []byte) map[uint8]bridgePayload {
+	send := make(map[string]uint8)
+	for pt, enc := range sdpPayloadTypes(sendSDP) {
+		if cur, exists := send[enc]; !exists || pt < cur {
+			send[enc] = pt
+		}
+	}
+
+	// Stream is sent to us with packet time of our SDP
+	ptime := sdpPacketTime(recvSDP)
+	m := make(map[uint8]bridgePayload)
+	for pt, enc := range sdpPayloadTypes(recvSDP) {
+		out, exists := send[enc]
+		if !exists {
+			continue
+		}
+		_, rate, _ := strings.Cut(enc, "/")
+		clockRate, err := strconv.ParseUint(rate, 10, 32)
+		if err != nil || clockRate == 0 {
+			clockRate = 8000
+		}
+		m[pt] = bridgePayload{pt: out, frame: uint32(clockRate * uint64(ptime) / uint64(time.Second))}
+	}
+	return m
+}
+
+// relay reads RTP on src and writes it on dst until bridge is done
+func (br *bridge) relay(src *bridgeLeg, dst *bridgeLeg, pts *map[uint8]bridgePayload) BridgeStreamStats {
+	var stats BridgeStreamStats
+	rw := newRTPRewriter()
+	buf := make([]byte, media.RTPBufSize)
+	pkt := rtp.Packet{}
+	for {
+		err := src.readRTP(buf, &pkt)
+		select {
+		case <-br.done:
+			return stats
+		default:
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+				return stats
+			}
+			stats.Dropped++
+			continue
+		}
+
+		br.mu.RLock()
+		pt, exists := (*pts)[pkt.PayloadType]
+		if !exists {
+			br.mu.RUnlock()
+			stats.Dropped++
+			continue
+		}
+		pkt.PayloadType = pt.pt
+		if rw.rewrite(&pkt, pt.frame) {
+			stats.SSRCChanges++
+		}
+		err = dst.writeRTP(&pkt)
+		br.mu.RUnlock()
+
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return stats
+			}
+			br.log.Debug().Err(err).Str("leg", dst.name).Msg("Failed to relay RTP")
+			stats.Dropped++
+			continue
+		}
+		stats.Packets++
+		stats.Bytes += uint64(len(pkt.Payload))
+	}
+}
+
+// rtpRewriter sends relayed stream with own SSRC, sequence numbers and timestamps.
+// Received stream can change, ex after transfer, and output continues without gap
+type rtpRewriter struct {
+	ssrc      uint32
+	started   bool
+	inSSRC    uint32
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+}
+
+func newRTPRewriter() *rtpRewriter {
+	return &rtpRewriter{ssrc: rand.Uint32()}
+}
+
+// rewrite changes packet header and returns true when received SSRC changed.
+// Frame is timestamp increment of packet, used as gap to new stream
+func (r *rtpRewriter) rewrite(pkt *rtp.Packet, frame uint32) bool {
+	changed := false
+	if !r.started {
+		r.seqOffset = uint16(rand.Uint32()) - pkt.SequenceNumber
+		r.tsOffset = rand.Uint32() - pkt.Timestamp
+		r.lastSeq = pkt.SequenceNumber + r.seqOffset - 1
+		r.started = true
+		r.inSSRC = pkt.SSRC
+	} else if pkt.SSRC != r.inSSRC {
+		// Continue after last sent packet with one packet time as gap
+		r.seqOffset = r.lastSeq + 1 - pkt.SequenceNumber
+		r.tsOffset = r.lastTS + frame - pkt.Timestamp
+		r.inSSRC = pkt.SSRC
+		changed = true
+	}
+
+	pkt.SSRC = r.ssrc
+	pkt.SequenceNumber += r.seqOffset
+	pkt.Timestamp += r.tsOffset
+	// Keep highest sent in case of reordering
+	if int16(pkt.SequenceNumber-r.lastSeq) > 0 {
+		r.lastSeq = pkt.SequenceNumber
+		r.lastTS = pkt.Timestamp
+	}
+	return changed
+}
+
+// onReInvite handles re-INVITE received on leg x. Media change is applied on x only, as
+// media is anchored, while direction change (hold) is offered to leg y
+func (br *bridge) onReInvite(x *bridgeLeg, y *bridgeLeg) func(req *sip.Request, tx sip.ServerTransaction) {
+	return func(req *sip.Request, tx sip.ServerTransaction) {
+		br.reInvites.Add(1)
+		log := br.log.With().Str("leg", x.name).Logger()
+
+		// Re-INVITE of other leg is in progress
+		// https://datatracker.ietf.org/doc/html/rfc3261#section-14.2
+		if !br.reinviteMu.TryLock() {
+			res := sip.NewResponseFromRequest(req, sip.StatusCode(491), "Request Pending", nil)
+			if err := tx.Respond(res); err != nil {
+				log.Error().Err(err).Msg("Failed to send 491")
+			}
+			return
+		}
+		defer br.reinviteMu.Unlock()
+
+		body := req.Body()
+		if len(body) == 0 {
+			// Offer is expected in our answer. Media is not changed so current SDP is fine
+			br.respondReInvite(x, req, tx, sdpDirection(x.localSDP), log)
+			return
+		}
+
+		dir := sdpDirection(body)
+		prevDir := sdpDirection(x.remoteSDP)
+		if err := br.applyRemoteSDP(x, body); err != nil {
+			log.Error().Err(err).Msg("Failed to apply re-INVITE SDP")
+			res := sip.NewResponseFromRequest(req, sip.StatusNotAcceptableHere, "Not Acceptable Here", nil)
+			if err := tx.Respond(res); err != nil {
+				log.Error().Err(err).Msg("Failed to send 488")
+			}
+			return
+		}
+
+		answerDir := sdpReverseDirection(dir)
+		if dir != prevDir {
+			log.Info().Str("direction", dir).Msg("Media direction changed. Updating other leg")
+			ydir, err := br.sendReInvite(y, dir)
+			if err != nil {
+				log.Error().Err(err).Str("other", y.name).Msg("Failed to update other leg")
+			} else if ydir == "inactive" {
+				answerDir = ydir
+			}
+		}
+		br.respondReInvite(x, req, tx, answerDir, log)
+	}
+}
+
+func (br *bridge) applyRemoteSDP(l *bridgeLeg, body []byte) error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	// Old style hold has no address to send to. Keep current one
+	if !sdpHasLine(body, "c=IN IP4 0.0.0.0") {
+		if err := l.msess.RemoteSDP(body); err != nil {
+			return err
+		}
+		l.setRemote(l.msess.Raddr)
+	}
+	l.remoteSDP = body
+	br.updatePayloadTypes()
+	return nil
+}
+
+func sdpHasLine(body []byte, line string) bool {
+	for _, l := range sdpLines(body) {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func (br *bridge) respondReInvite(l *bridgeLeg, req *sip.Request, tx sip.ServerTransaction, dir string, log zerolog.Logger) {
+	l.localSDP = sdpNextVersion(sdpSetDirection(l.localSDP, dir))
+	res := sip.NewSDPResponseFromRequest(req, l.localSDP)
+	if l.contact != nil {
+		res.AppendHeader(sip.HeaderClone(l.contact))
+	}
+	if err := tx.Respond(res); err != nil {
+		log.Error().Err(err).Msg("Failed to respond re-INVITE")
+	}
+}
+
+// sendReInvite offers direction to leg and returns answered direction
+func (br *bridge) sendReInvite(l *bridgeLeg, dir string) (string, error) {
+	offer := sdpNextVersion(sdpSetDirection(l.localSDP, dir))
+	req := sip.NewRequest(sip.INVITE, l.target)
+	req.SetTransport(l.transport)
+	if l.contact != nil {
+		req.AppendHeader(sip.HeaderClone(l.contact))
+	}
+	req.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+	req.SetBody(offer)
+
+	res, err := l.do(l.ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if !res.IsSuccess() {
+		return "", sipgo.ErrDialogResponse{Res: res}
+	}
+
+	ack := sip.NewAckRequest(req, res, nil)
+	if err := l.writeRequest(ack); err != nil {
+		return "", fmt.Errorf("failed to send ACK: %w", err)
+	}
+	l.localSDP = offer
+
+	if len(res.Body()) == 0 {
+		return sdpReverseDirection(dir), nil
+	}
+	if err := br.applyRemoteSDP(l, res.Body()); err != nil {
+		return "", err
+	}
+	return sdpDirection(res.Body()), nil
+}
@@ -0,0 +1,131 @@
+package sipgox
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+)
+
+func testBridgeSDP(ip string, media string, attrs ...string) []byte {
+	body := "v=0\r\n" +
+		"o=- 1 1 IN IP4 " + ip + "\r\n" +
+		"s=-\r\n" +
+		"c=IN IP4 " + ip + "\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 40000 RTP/AVP " + media + "\r\n"
+	for _, a := range attrs {
+		body += "a=" + a + "\r\n"
+	}
+	return []byte(body)
+}
+
+func TestBridgePayloadTypes(t *testing.T) {
+	// Leg a sends us what we answered, with ptime of 30ms
+	recv := testBridgeSDP("127.0.0.1", "0 101 96 9", "rtpmap:101 telephone-event/8000", "rtpmap:96 opus/48000/2", "ptime:30")
+	// Leg b receives same encodings with other payload types. Lowest of duplicates is used
+	send := testBridgeSDP("127.0.0.1", "8 0 102 100 111", "rtpmap:102 telephone-event/8000", "rtpmap:100 TELEPHONE-EVENT/8000", "rtpmap:111 opus/48000/2")
+
+	pts := bridgePayloadTypes(recv, send)
+	expected := map[uint8]bridgePayload{
+		0:   {pt: 0, frame: 240},
+		101: {pt: 100, frame: 240},
+		96:  {pt: 111, frame: 1440},
+	}
+	if len(pts) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, pts)
+	}
+	for pt, p := range expected {
+		if pts[pt] != p {
+			t.Errorf("payload type %d: expected %+v, got %+v", pt, p, pts[pt])
+		}
+	}
+}
+
+func TestBridgeRelay(t *testing.T) {
+	in := []rtp.Packet{
+		{Header: rtp.Header{Version: 2, PayloadType: 0, SSRC: 1, SequenceNumber: 10, Timestamp: 1000}, Payload: make([]byte, 160)},
+		{Header: rtp.Header{Version: 2, PayloadType: 101, SSRC: 1, SequenceNumber: 11, Timestamp: 1160}, Payload: make([]byte, 4)},
+		// Not negotiated on other leg
+		{Header: rtp.Header{Version: 2, PayloadType: 9, SSRC: 1, SequenceNumber: 12, Timestamp: 1320}, Payload: make([]byte, 160)},
+		// New stream, ex after transfer
+		{Header: rtp.Header{Version: 2, PayloadType: 0, SSRC: 2, SequenceNumber: 500, Timestamp: 90000}, Payload: make([]byte, 160)},
+	}
+	src := &bridgeLeg{name: "a", readRTP: func(buf []byte, pkt *rtp.Packet) error {
+		if len(in) == 0 {
+			return net.ErrClosed
+		}
+		*pkt = in[0]
+		in = in[1:]
+		return nil
+	}}
+	var out []rtp.Packet
+	dst := &bridgeLeg{name: "b", writeRTP: func(pkt *rtp.Packet) error {
+		out = append(out, *pkt)
+		return nil
+	}}
+
+	br := &bridge{log: zerolog.Nop(), done: make(chan struct{})}
+	pts := map[uint8]bridgePayload{
+		0:   {pt: 8, frame: 160},
+		101: {pt: 100, frame: 160},
+	}
+	stats := br.relay(src, dst, &pts)
+
+	if stats.Packets != 3 || stats.Dropped != 1 || stats.SSRCChanges != 1 || stats.Bytes != 324 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(out) != 3 {
+		t.Fatalf("expected 3 relayed packets, got %d", len(out))
+	}
+	for i, pt := range []uint8{8, 100, 8} {
+		if out[i].PayloadType != pt {
+			t.Errorf("packet %d: expected payload type %d, got %d", i, pt, out[i].PayloadType)
+		}
+		if out[i].SSRC != out[0].SSRC {
+			t.Errorf("packet %d: SSRC changed", i)
+		}
+	}
+	// New stream continues after last packet with one frame gap
+	if out[1].SequenceNumber != out[0].SequenceNumber+1 || out[2].SequenceNumber != out[1].SequenceNumber+1 {
+		t.Errorf("sequence not continuous %d %d %d", out[0].SequenceNumber, out[1].SequenceNumber, out[2].SequenceNumber)
+	}
+	if out[1].Timestamp != out[0].Timestamp+160 || out[2].Timestamp != out[1].Timestamp+160 {
+		t.Errorf("unexpected timestamps %d %d %d", out[0].Timestamp, out[1].Timestamp, out[2].Timestamp)
+	}
+}
+
+func TestBridgeReInvitePayloadTypes(t *testing.T) {
+	br := &bridge{
+		a: &bridgeLeg{
+			name:      "a",
+			localSDP:  testBridgeSDP("127.0.0.1", "0 101", "rtpmap:101 telephone-event/8000"),
+			remoteSDP: testBridgeSDP("127.0.0.2", "0 101", "rtpmap:101 telephone-event/8000"),
+		},
+		b: &bridgeLeg{
+			name:      "b",
+			localSDP:  testBridgeSDP("127.0.0.1", "0 101", "rtpmap:101 telephone-event/8000"),
+			remoteSDP: testBridgeSDP("127.0.0.3", "0 101", "rtpmap:101 telephone-event/8000"),
+		},
+		log:  zerolog.Nop(),
+		done: make(chan struct{}),
+	}
+	br.updatePayloadTypes()
+	if br.ptAToB[101].pt != 101 {
+		t.Fatalf("unexpected payload types %v", br.ptAToB)
+	}
+
+	// Hold of b without address changes its payload types. Media address is kept
+	hold := testBridgeSDP("0.0.0.0", "0 96", "rtpmap:96 telephone-event/8000", "sendonly")
+	if err := br.applyRemoteSDP(br.b, hold); err != nil {
+		t.Fatal(err)
+	}
+	if br.ptAToB[101].pt != 96 || br.ptAToB[0].pt != 0 {
+		t.Errorf("payload types not updated after re-INVITE %v", br.ptAToB)
+	}
+	// Other direction is not changed
+	if br.ptBToA[101].pt != 101 {
+		t.Errorf("unexpected payload types %v", br.ptBToA)
+	}
+}
@@ -0,0 +1,103 @@
+package sipgox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+var errCallRejected = fmt.Errorf("call rejected")
+
+// CallDecision is decision of OnCallDecision about incoming call
+type CallDecision struct {
+	// Code 3xx-6xx rejects or redirects call. 1xx like 180 or 183 is sent as provisional
+	// response before call is answered. Otherwise call is answered
+	Code   sip.StatusCode
+	Reason string
+	// Headers are added to response, also to 200 when call is answered
+	Headers []sip.Header
+	// Delay postpones response or answering
+	Delay time.Duration
+	// Contacts are targets of 3xx redirect
+	Contacts []sip.Uri
+}
+
+// CallReject rejects call with code and reason
+func CallReject(code sip.StatusCode, reason string) CallDecision {
+	return CallDecision{Code: code, Reason: reason}
+}
+
+// CallRedirect redirects call with 302 to contacts
+func CallRedirect(contacts ...sip.Uri) CallDecision {
+	return CallDecision{Code: sip.StatusMovedTemporarily, Reason: "Moved Temporarily", Contacts: contacts}
+}
+
+func (d CallDecision) rejects() bool {
+	return d.Code >= 300
+}
+
+func (d CallDecision) provisional() bool {
+	return d.Code > 100 && d.Code < 200
+}
+
+// response creates provisional, reject or redirect response of decision
+func (d CallDecision) response(req *sip.Request) *sip.Response {
+	res := sip.NewResponseFromRequest(req, d.Code, d.Reason, nil)
+	if d.Code < 400 {
+		for _, c := range d.Contacts {
+			res.AppendHeader(&sip.ContactHeader{Address: *c.Clone()})
+		}
+	}
+	for _, h := range d.Headers {
+		res.AppendHeader(h)
+	}
+	return res
+}
+
+// decideCall gets decision of OnCallDecision or OnCall. OnCallDecision runs in own goroutine
+// so that lookup can take time while we wait for transaction. Its context is canceled when
+// call is canceled or decision is no longer needed
+func decideCall(ctx context.Context, tx sip.ServerTransaction, req *sip.Request, opts AnswerOptions) (CallDecision, error) {
+	var decision CallDecision
+	switch {
+	case opts.OnCallDecision != nil:
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ch := make(chan CallDecision, 1)
+		go func() {
+			ch <- opts.OnCallDecision(ctx, req)
+		}()
+
+		select {
+		case decision = <-ch:
+		case <-tx.Done():
+			return decision, fmt.Errorf("invite transaction finished while deciding: %w", tx.Err())
+		case <-ctx.Done():
+			return decision, ctx.Err()
+		}
+
+	case opts.OnCall != nil:
+		res := opts.OnCall(req)
+		switch {
+		case res < 0:
+			decision = CallReject(sip.StatusBusyHere, "Busy")
+		case res > 0:
+			// Provisional code is sent and call continues
+			decision = CallDecision{Code: sip.StatusCode(res)}
+		}
+	}
+
+	if decision.Delay > 0 {
+		select {
+		case <-time.After(decision.Delay):
+		case <-tx.Done():
+			return decision, fmt.Errorf("invite transaction finished while delaying: %w", tx.Err())
+		case <-ctx.Done():
+			return decision, ctx.Err()
+		}
+	}
+	return decision, nil
+}
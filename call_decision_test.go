@@ -0,0 +1,133 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestDecideCall(t *testing.T) {
+	req := aclTestRequest(sip.INVITE, "10.0.0.1:5060", "")
+	tests := []struct {
+		name string
+		opts AnswerOptions
+		code sip.StatusCode
+	}{
+		{name: "no callback"},
+		{name: "decision", opts: AnswerOptions{OnCallDecision: func(ctx context.Context, req *sip.Request) CallDecision {
+			return CallReject(sip.StatusForbidden, "Forbidden")
+		}}, code: sip.StatusForbidden},
+		{name: "on call busy", opts: AnswerOptions{OnCall: func(req *sip.Request) int { return -1 }}, code: sip.StatusBusyHere},
+		{name: "on call ringing", opts: AnswerOptions{OnCall: func(req *sip.Request) int { return 180 }}, code: sip.StatusRinging},
+		{name: "on call answer", opts: AnswerOptions{OnCall: func(req *sip.Request) int { return 0 }}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, err := decideCall(context.Background(), &testServerTx{}, req, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision.Code != tc.code {
+				t.Errorf("expected code %d, got %d", tc.code, decision.Code)
+			}
+		})
+	}
+}
+
+func TestDecideCallDelay(t *testing.T) {
+	req := aclTestRequest(sip.INVITE, "10.0.0.1:5060", "")
+	delayed := AnswerOptions{OnCallDecision: func(ctx context.Context, req *sip.Request) CallDecision {
+		return CallDecision{Code: sip.StatusRinging, Delay: 50 * time.Millisecond}
+	}}
+
+	start := time.Now()
+	decision, err := decideCall(context.Background(), &testServerTx{}, req, delayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Code != sip.StatusRinging || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected delayed ringing, got %d after %s", decision.Code, time.Since(start))
+	}
+
+	// Caller cancels during delay
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	delayed = AnswerOptions{OnCallDecision: func(_ context.Context, req *sip.Request) CallDecision {
+		return CallDecision{Delay: time.Hour}
+	}}
+	if _, err := decideCall(ctx, &testServerTx{}, req, delayed); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context error, got %v", err)
+	}
+
+	// CANCEL finishes transaction during delay
+	tx := &testServerTx{done: make(chan struct{}), err: sip.ErrTransactionCanceled}
+	time.AfterFunc(10*time.Millisecond, func() { close(tx.done) })
+	if _, err := decideCall(context.Background(), tx, req, AnswerOptions{OnCallDecision: func(ctx context.Context, req *sip.Request) CallDecision {
+		return CallDecision{Delay: time.Hour}
+	}}); !errors.Is(err, sip.ErrTransactionCanceled) {
+		t.Errorf("expected transaction error, got %v", err)
+	}
+}
+
+func TestDecideCallCanceled(t *testing.T) {
+	req := aclTestRequest(sip.INVITE, "10.0.0.1:5060", "")
+	// Decision waits until its context is canceled and reports it
+	canceled := make(chan struct{})
+	waiting := AnswerOptions{OnCallDecision: func(ctx context.Context, req *sip.Request) CallDecision {
+		<-ctx.Done()
+		close(canceled)
+		return CallDecision{}
+	}}
+
+	tx := &testServerTx{done: make(chan struct{}), err: sip.ErrTransactionCanceled}
+	time.AfterFunc(10*time.Millisecond, func() { close(tx.done) })
+	if _, err := decideCall(context.Background(), tx, req, waiting); !errors.Is(err, sip.ErrTransactionCanceled) {
+		t.Errorf("expected transaction error, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("decision context is not canceled after transaction finished")
+	}
+
+	canceled = make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := decideCall(ctx, &testServerTx{}, req, waiting); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context error, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("decision context is not canceled")
+	}
+}
+
+func TestCallDecisionResponse(t *testing.T) {
+	req := aclTestRequest(sip.INVITE, "10.0.0.1:5060", "")
+	target := sip.Uri{Scheme: "sip", User: "bob", Host: "example.test"}
+	header := sip.NewHeader("X-Reason", "test")
+
+	redirect := CallRedirect(target)
+	redirect.Headers = []sip.Header{header}
+	res := redirect.response(req)
+	if res.StatusCode != sip.StatusMovedTemporarily || res.Contact() == nil || res.Contact().Address.User != "bob" {
+		t.Errorf("expected redirect to contact, got %s", res.StartLine())
+	}
+	if h := res.GetHeader("X-Reason"); h == nil || h.Value() != "test" {
+		t.Error("expected decision header in response")
+	}
+
+	// Contacts are not sent with reject
+	reject := CallReject(sip.StatusBusyHere, "Busy")
+	reject.Contacts = []sip.Uri{target}
+	if res := reject.response(req); res.Contact() != nil {
+		t.Error("unexpected contact in reject")
+	}
+	if !reject.rejects() || reject.provisional() || !(CallDecision{Code: sip.StatusSessionInProgress}).provisional() {
+		t.Error("unexpected decision kind")
+	}
+}
@@ -0,0 +1,398 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Conference mixing of small rooms. Audio of participants is decoded to PCM and every
+// participant receives mix of all others each 20ms. Only G.711 (PCMU/PCMA) is supported
+// as it is only codec negotiated by media sessions
+
+var (
+	ErrConferenceFull   = fmt.Errorf("conference is full")
+	ErrConferenceClosed = fmt.Errorf("conference is closed")
+)
+
+const (
+	conferenceFrameSamples = 160 // 20ms at 8kHz
+	conferenceFrameTime    = 20 * time.Millisecond
+	// conferenceMaxBuffered limits decoded audio waiting for mix, 100ms
+	conferenceMaxBuffered = 5 * conferenceFrameSamples
+)
+
+// ConferenceSession is media of participant. Dialog sessions, their MediaSession and media.MediaSession
+// implement it and only they can join, as negotiated format is needed for sending mix.
+// If session has Context, participant leaves when context is done
+type ConferenceSession interface {
+	RTPReader
+	WriteRTP(pkt *rtp.Packet) error
+}
+
+type ConferenceOptions struct {
+	// MaxParticipants default is 10
+	MaxParticipants int
+	// OnEvent is called when participant joins or leaves. It must not block
+	OnEvent func(ev ConferenceEvent)
+	// JitterBuffer options of received audio
+	JitterBuffer JitterBufferOptions
+}
+
+type ConferenceEventType string
+
+const (
+	ConferenceJoin  ConferenceEventType = "join"
+	ConferenceLeave ConferenceEventType = "leave"
+)
+
+type ConferenceEvent struct {
+	Type ConferenceEventType
+	ID   string
+	// Err is reason of leave, ex session ended. Nil when participant was removed
+	Err error
+}
+
+// Conference mixes audio of participants. Create it with NewConference
+type Conference struct {
+	opts ConferenceOptions
+	log  zerolog.Logger
+
+	mu           sync.Mutex
+	participants []*ConferenceParticipant
+	closed       bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// ConferenceParticipant is session joined to conference
+type ConferenceParticipant struct {
+	ID string
+
+	sess  ConferenceSession
+	jb    *JitterBuffer
+	muted atomic.Bool
+	deaf  atomic.Bool
+	done  chan struct{}
+
+	// pcm is decoded audio waiting for mix
+	mu  sync.Mutex
+	pcm []int16
+
+	// Sending side is used only by mixer
+	pt      uint8
+	ssrc    uint32
+	seq     uint16
+	ts      uint32
+	started bool
+}
+
+// NewConference creates conference and starts mixing
+func NewConference(opts ConferenceOptions) *Conference {
+	if opts.MaxParticipants <= 0 {
+		opts.MaxParticipants = 10
+	}
+	c := &Conference{
+		opts: opts,
+		log:  log.With().Str("caller", "Conference").Logger(),
+		done: make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.mixLoop()
+	return c
+}
+
+// Join adds session to conference. Conference becomes only reader of session RTP until
+// participant leaves
+func (c *Conference) Join(id string, sess ConferenceSession) (*ConferenceParticipant, error) {
+	pt, err := conferencePayloadType(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ConferenceParticipant{
+		ID:   id,
+		sess: sess,
+		done: make(chan struct{}),
+		pt:   pt,
+		ssrc: rand.Uint32(),
+		seq:  uint16(rand.Uint32()),
+		ts:   rand.Uint32(),
+	}
+
+	c.mu.Lock()
+	switch {
+	case c.closed:
+		c.mu.Unlock()
+		return nil, ErrConferenceClosed
+	case len(c.participants) >= c.opts.MaxParticipants:
+		c.mu.Unlock()
+		return nil, ErrConferenceFull
+	case c.find(id) >= 0:
+		c.mu.Unlock()
+		return nil, fmt.Errorf("participant %q already joined", id)
+	}
+	p.jb = NewJitterBuffer(sess, c.opts.JitterBuffer)
+	c.participants = append(c.participants, p)
+	c.mu.Unlock()
+
+	go c.readLoop(p)
+	if s, ok := sess.(interface{ Context() context.Context }); ok {
+		go func() {
+			select {
+			case <-s.Context().Done():
+				c.remove(p, context.Cause(s.Context()))
+			case <-p.done:
+			}
+		}()
+	}
+
+	c.log.Info().Str("id", id).Msg("Participant joined")
+	c.event(ConferenceEvent{Type: ConferenceJoin, ID: id})
+	return p, nil
+}
+
+// conferencePayloadType is first negotiated format of session, which participant receives
+func conferencePayloadType(sess ConferenceSession) (uint8, error) {
+	var msess *media.MediaSession
+	switch s := sess.(type) {
+	case *DialogServerSession:
+		if s.dmedia != nil {
+			msess = s.dmedia.sess
+		}
+	case *DialogClientSession:
+		if s.dmedia != nil {
+			msess = s.dmedia.sess
+		}
+	case *MediaSession:
+		msess = s.dm.sess
+	case *media.MediaSession:
+		msess = s
+	default:
+		return 0, fmt.Errorf("conference does not support session %T", sess)
+	}
+	if msess == nil || len(msess.Formats) == 0 {
+		return 0, fmt.Errorf("conference session has no negotiated format")
+	}
+
+	pt, err := strconv.Atoi(msess.Formats[0])
+	if err != nil || (pt != 0 && pt != 8) {
+		return 0, fmt.Errorf("conference does not support format %s", msess.Formats[0])
+	}
+	return uint8(pt), nil
+}
+
+// Leave removes participant. Session is not closed or hung up. Read of session which is in
+// progress returns only with next packet, which is dropped, or when session is closed.
+// Until then session should not be read by other reader
+func (c *Conference) Leave(id string) {
+	c.mu.Lock()
+	i := c.find(id)
+	if i < 0 {
+		c.mu.Unlock()
+		return
+	}
+	p := c.participants[i]
+	c.mu.Unlock()
+	c.remove(p, nil)
+}
+
+// Participant returns joined participant or nil
+func (c *Conference) Participant(id string) *ConferenceParticipant {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i := c.find(id); i >= 0 {
+		return c.participants[i]
+	}
+	return nil
+}
+
+// Participants returns participants in order of joining
+func (c *Conference) Participants() []*ConferenceParticipant {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*ConferenceParticipant(nil), c.participants...)
+}
+
+// Close removes all participants and stops mixing
+func (c *Conference) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	participants := append([]*ConferenceParticipant(nil), c.participants...)
+	c.mu.Unlock()
+
+	for _, p := range participants {
+		c.remove(p, ErrConferenceClosed)
+	}
+	close(c.done)
+	c.wg.Wait()
+}
+
+// find must be called with mu locked
+func (c *Conference) find(id string) int {
+	for i, p := range c.participants {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *Conference) remove(p *ConferenceParticipant, err error) {
+	c.mu.Lock()
+	i := c.find(p.ID)
+	if i < 0 || c.participants[i] != p {
+		c.mu.Unlock()
+		return
+	}
+	c.participants = append(c.participants[:i], c.participants[i+1:]...)
+	c.mu.Unlock()
+
+	close(p.done)
+	p.jb.Close()
+	c.log.Info().Str("id", p.ID).Err(err).Msg("Participant left")
+	c.event(ConferenceEvent{Type: ConferenceLeave, ID: p.ID, Err: err})
+}
+
+func (c *Conference) event(ev ConferenceEvent) {
+	if c.opts.OnEvent != nil {
+		c.opts.OnEvent(ev)
+	}
+}
+
+// readLoop decodes audio of participant. Missing packets are left for mixer as silence
+func (c *Conference) readLoop(p *ConferenceParticipant) {
+	buf := make([]byte, media.RTPBufSize)
+	pkt := rtp.Packet{}
+	for {
+		err := p.jb.ReadRTP(buf, &pkt)
+		if errors.Is(err, ErrJitterBufferGap) {
+			continue
+		}
+		if err != nil {
+			c.remove(p, err)
+			return
+		}
+
+		p.mu.Lock()
+		// Other payload types, ex DTMF, are not mixed
+		p.pcm, _ = g711Decode(p.pcm, pkt.PayloadType, pkt.Payload)
+		if over := len(p.pcm) - conferenceMaxBuffered; over > 0 {
+			p.pcm = p.pcm[over:]
+		}
+		p.mu.Unlock()
+	}
+}
+
+// frame takes next 20ms of decoded audio. Nil means silence
+func (p *ConferenceParticipant) frame() []int16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pcm) < conferenceFrameSamples {
+		return nil
+	}
+	f := make([]int16, conferenceFrameSamples)
+	copy(f, p.pcm)
+	p.pcm = append(p.pcm[:0], p.pcm[conferenceFrameSamples:]...)
+	return f
+}
+
+// SetMute stops sending participant audio to others
+func (p *ConferenceParticipant) SetMute(mute bool) {
+	p.muted.Store(mute)
+}
+
+func (p *ConferenceParticipant) Muted() bool {
+	return p.muted.Load()
+}
+
+// SetDeaf stops sending mix to participant
+func (p *ConferenceParticipant) SetDeaf(deaf bool) {
+	p.deaf.Store(deaf)
+}
+
+func (p *ConferenceParticipant) Deaf() bool {
+	return p.deaf.Load()
+}
+
+func (c *Conference) mixLoop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(conferenceFrameTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mix()
+	}
+}
+
+// mix sends to each participant sum of all unmuted participants minus own audio
+func (c *Conference) mix() {
+	participants := c.Participants()
+	frames := make([][]int16, len(participants))
+	var sum [conferenceFrameSamples]int32
+	for i, p := range participants {
+		f := p.frame()
+		if f == nil || p.Muted() {
+			continue
+		}
+		frames[i] = f
+		for k, s := range f {
+			sum[k] += int32(s)
+		}
+	}
+
+	out := make([]int16, conferenceFrameSamples)
+	payload := make([]byte, 0, conferenceFrameSamples)
+	for i, p := range participants {
+		if p.Deaf() {
+			// Timestamp keeps running with clock
+			p.ts += conferenceFrameSamples
+			continue
+		}
+		own := frames[i]
+		for k := range out {
+			s := sum[k]
+			if own != nil {
+				s -= int32(own[k])
+			}
+			out[k] = int16(min(max(s, -32768), 32767))
+		}
+
+		pkt := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         !p.started,
+				PayloadType:    p.pt,
+				SequenceNumber: p.seq,
+				Timestamp:      p.ts,
+				SSRC:           p.ssrc,
+			},
+			Payload: g711Encode(payload[:0], p.pt, out),
+		}
+		p.started = true
+		p.seq++
+		p.ts += conferenceFrameSamples
+		if err := p.sess.WriteRTP(&pkt); err != nil {
+			c.log.Debug().Err(err).Str("id", p.ID).Msg("Failed to write mix")
+		}
+	}
+}
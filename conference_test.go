@@ -0,0 +1,174 @@
+package sipgox
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/pion/rtp"
+)
+
+// conferenceTestLeg is participant session joined to conference and remote session
+// which talks to it over loopback
+type conferenceTestLeg struct {
+	sess   *media.MediaSession
+	remote *media.MediaSession
+}
+
+func newConferenceTestLeg(t *testing.T) *conferenceTestLeg {
+	sess, err := media.NewMediaSession(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := media.NewMediaSession(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		sess.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		sess.Close()
+		remote.Close()
+	})
+	sess.SetRemoteAddr(remote.Laddr)
+	remote.SetRemoteAddr(sess.Laddr)
+	return &conferenceTestLeg{sess: sess, remote: remote}
+}
+
+// talk sends PCMU frames of constant sample until done
+func (l *conferenceTestLeg) talk(sample int16, done <-chan struct{}) {
+	pcm := make([]int16, conferenceFrameSamples)
+	for i := range pcm {
+		pcm[i] = sample
+	}
+	pkt := rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 0, SSRC: uint32(sample)},
+		Payload: g711Encode(nil, 0, pcm),
+	}
+	ticker := time.NewTicker(conferenceFrameTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		l.remote.WriteRTP(&pkt)
+		pkt.SequenceNumber++
+		pkt.Timestamp += conferenceFrameSamples
+	}
+}
+
+// listen returns most common sample of mix received during duration. Received is false
+// if no mix arrived
+func (l *conferenceTestLeg) listen(t *testing.T, duration time.Duration) (sample int16, received bool) {
+	counts := make(map[int16]int)
+	buf := make([]byte, media.RTPBufSize)
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		n, err := l.remote.ReadRTPRawDeadline(buf, deadline)
+		if err != nil {
+			break
+		}
+		pkt := rtp.Packet{}
+		if err := pkt.Unmarshal(buf[:n]); err != nil {
+			t.Error(err)
+			continue
+		}
+		if pcm, ok := g711Decode(nil, pkt.PayloadType, pkt.Payload); ok && len(pcm) > 0 {
+			counts[pcm[0]]++
+		}
+	}
+
+	best := 0
+	for s, c := range counts {
+		if c > best {
+			sample, best = s, c
+		}
+	}
+	return sample, best > 0
+}
+
+func conferenceSampleNear(got int16, exp int16) bool {
+	// u-law quantization error is below 4%
+	diff := int(got) - int(exp)
+	return diff*diff*625 <= int(exp)*int(exp)
+}
+
+func TestConferenceMix(t *testing.T) {
+	conf := NewConference(ConferenceOptions{})
+	defer conf.Close()
+
+	samples := []int16{1000, 2000, 4000}
+	legs := make([]*conferenceTestLeg, len(samples))
+	for i := range legs {
+		legs[i] = newConferenceTestLeg(t)
+		if _, err := conf.Join(string(rune('a'+i)), legs[i].sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, l := range legs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.talk(samples[i], done)
+		}()
+	}
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	// listenAll checks mix of each leg. Zero expects no mix. Mix sent before
+	// change is drained first
+	listenAll := func(name string, exp []int16) {
+		t.Helper()
+		for _, l := range legs {
+			l.listen(t, 100*time.Millisecond)
+		}
+		var wg sync.WaitGroup
+		for i, l := range legs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				got, received := l.listen(t, 500*time.Millisecond)
+				switch {
+				case exp[i] == 0 && received:
+					t.Errorf("%s: leg %d expected no mix, got %d", name, i, got)
+				case exp[i] != 0 && (!received || !conferenceSampleNear(got, exp[i])):
+					t.Errorf("%s: leg %d expected mix %d, got %d", name, i, exp[i], got)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	// Let jitter buffers fill
+	time.Sleep(200 * time.Millisecond)
+	// Each leg hears others but not itself
+	listenAll("mix-minus", []int16{6000, 5000, 3000})
+
+	conf.Participant("c").SetMute(true)
+	listenAll("mute", []int16{2000, 1000, 3000})
+	conf.Participant("c").SetMute(false)
+
+	conf.Participant("a").SetDeaf(true)
+	listenAll("deaf", []int16{0, 5000, 3000})
+}
+
+func TestConferenceUnknownSession(t *testing.T) {
+	conf := NewConference(ConferenceOptions{})
+	defer conf.Close()
+
+	var sess struct{ ConferenceSession }
+	if _, err := conf.Join("a", sess); err == nil {
+		t.Fatal("expected error for unknown session")
+	}
+	if len(conf.Participants()) != 0 {
+		t.Error("participant joined")
+	}
+}
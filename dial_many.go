@@ -0,0 +1,136 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// Forking dial for ring groups. Targets are rung all at once or one after another and first
+// answered call wins. All INVITEs are sent with same client and dialog client cache
+
+type DialManyOptions struct {
+	DialOptions
+
+	// Sequential rings targets in order instead of all at once
+	Sequential bool
+	// TargetTimeout limits ringing of each target. Zero rings until ctx is done
+	TargetTimeout time.Duration
+}
+
+// DialMany dials recipients and returns first answered dialog. Ringing of other recipients is
+// canceled and in case they answer meanwhile they are hung up.
+// Recipients must be reachable with same transport.
+//
+// return DialResponseError of last recipient in case none answered
+func (p *Phone) DialMany(ctx context.Context, recipients []sip.Uri, o DialManyOptions) (*DialogClientSession, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to dial")
+	}
+
+	dl, err := p.newDialer(ctx, recipients[0], o.DialOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Sequential {
+		return p.dialSequential(ctx, dl, recipients, o)
+	}
+	return p.dialParallel(ctx, dl, recipients, o)
+}
+
+func (p *Phone) dialTargetCtx(ctx context.Context, o DialManyOptions) (context.Context, context.CancelFunc) {
+	if o.TargetTimeout > 0 {
+		return context.WithTimeout(ctx, o.TargetTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (p *Phone) dialSequential(ctx context.Context, dl *dialer, recipients []sip.Uri, o DialManyOptions) (*DialogClientSession, error) {
+	log := p.getLoggerCtx(ctx, "DialMany")
+	var err error
+	for _, recipient := range recipients {
+		tctx, cancel := p.dialTargetCtx(ctx, o)
+		var dialog *DialogClientSession
+		dialog, err = dl.dial(tctx, recipient)
+		cancel()
+		if err == nil {
+			dl.answered(dialog)
+			return dialog, nil
+		}
+		closeFailedDial(dialog)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Info().Err(err).Str("recipient", recipient.String()).Msg("Recipient did not answer. Dialing next one")
+	}
+	return nil, err
+}
+
+func (p *Phone) dialParallel(ctx context.Context, dl *dialer, recipients []sip.Uri, o DialManyOptions) (*DialogClientSession, error) {
+	log := p.getLoggerCtx(ctx, "DialMany")
+	type dialResult struct {
+		recipient sip.Uri
+		dialog    *DialogClientSession
+		err       error
+	}
+
+	ringCtx, cancelRing := context.WithCancel(ctx)
+	results := make(chan dialResult, len(recipients))
+	for _, recipient := range recipients {
+		go func(recipient sip.Uri) {
+			tctx, cancel := p.dialTargetCtx(ringCtx, o)
+			defer cancel()
+			dialog, err := dl.dial(tctx, recipient)
+			results <- dialResult{recipient, dialog, err}
+		}(recipient)
+	}
+
+	var err error
+	for i := range recipients {
+		res := <-results
+		if res.err != nil {
+			closeFailedDial(res.dialog)
+			// Error of canceled ring is not interesting
+			if err == nil || !errors.Is(res.err, context.Canceled) {
+				err = res.err
+			}
+			continue
+		}
+
+		// Winner. Cancel others and hang up late answers
+		cancelRing()
+		dl.answered(res.dialog)
+		log.Info().Str("recipient", res.recipient.String()).Msg("Recipient answered. Canceling others")
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				res := <-results
+				if res.err != nil {
+					closeFailedDial(res.dialog)
+					continue
+				}
+				log.Info().Str("recipient", res.recipient.String()).Msg("Recipient answered late. Hanging up")
+				hctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				if err := res.dialog.Hangup(hctx); err != nil {
+					log.Error().Err(err).Msg("Failed to hang up late answer")
+				}
+				cancel()
+				// Media and dialog in cache are released only with close
+				res.dialog.Close()
+			}
+		}(len(recipients) - i - 1)
+		return res.dialog, nil
+	}
+	cancelRing()
+	return nil, err
+}
+
+// closeFailedDial releases dialog returned together with dial error
+func closeFailedDial(dialog *DialogClientSession) {
+	if dialog != nil {
+		dialog.Close()
+	}
+}
@@ -0,0 +1,316 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/rs/zerolog"
+)
+
+const testUASSDP = "v=0\r\n" +
+	"o=- 1 1 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 40000 RTP/AVP 0\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n"
+
+// testUAS answers INVITEs on UDP socket. Answer of INVITE is chosen by user of Request-URI.
+// It is written on socket, so that UAS can do things sipgo server does not allow, ex answer
+// after CANCEL
+type testUAS struct {
+	t       *testing.T
+	conn    *net.UDPConn
+	answers map[string]func(inv *testInvite)
+
+	mu       sync.Mutex
+	invites  map[string]*testInvite
+	received []testUASRequest
+}
+
+type testUASRequest struct {
+	user   string
+	method sip.RequestMethod
+	toTag  string
+}
+
+// testInvite is received INVITE. Canceled is closed when CANCEL is received
+type testInvite struct {
+	uas      *testUAS
+	req      *sip.Request
+	src      net.Addr
+	canceled chan struct{}
+}
+
+func newTestUAS(t *testing.T, answers map[string]func(inv *testInvite)) *testUAS {
+	u := &testUAS{
+		t:       t,
+		conn:    newTestPeer(t),
+		answers: answers,
+		invites: make(map[string]*testInvite),
+	}
+	go u.serve()
+	return u
+}
+
+func (u *testUAS) uri(user string) sip.Uri {
+	addr := u.conn.LocalAddr().(*net.UDPAddr)
+	return sip.Uri{Scheme: "sip", User: user, Host: addr.IP.String(), Port: addr.Port}
+}
+
+func (u *testUAS) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg, err := sip.ParseMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue
+		}
+		req, ok := msg.(*sip.Request)
+		if !ok {
+			continue
+		}
+		u.handle(req, src)
+	}
+}
+
+func (u *testUAS) handle(req *sip.Request, src net.Addr) {
+	toTag, _ := req.To().Params.Get("tag")
+	key := req.CallID().Value() + ";" + req.Via().Params["branch"]
+
+	u.mu.Lock()
+	inv, retransmission := u.invites[key]
+	if !(req.IsInvite() && retransmission) {
+		u.received = append(u.received, testUASRequest{req.Recipient.User, req.Method, toTag})
+	}
+	u.mu.Unlock()
+
+	switch req.Method {
+	case sip.INVITE:
+		if retransmission {
+			return
+		}
+		inv = &testInvite{uas: u, req: req, src: src, canceled: make(chan struct{})}
+		u.mu.Lock()
+		u.invites[key] = inv
+		u.mu.Unlock()
+		go u.answers[req.Recipient.User](inv)
+	case sip.CANCEL:
+		u.write(sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil), src)
+		if inv != nil {
+			close(inv.canceled)
+		}
+	case sip.BYE:
+		u.write(sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil), src)
+	}
+}
+
+func (u *testUAS) write(res *sip.Response, dst net.Addr) {
+	if _, err := u.conn.WriteTo([]byte(res.String()), dst); err != nil {
+		u.t.Log("test UAS failed to write response", err)
+	}
+}
+
+// waitRequest waits request with method received by user. Empty toTag matches any
+func (u *testUAS) waitRequest(t *testing.T, user string, method sip.RequestMethod, toTag string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if u.hasRequest(user, method, toTag) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s did not receive %s", user, method)
+}
+
+func (u *testUAS) hasRequest(user string, method sip.RequestMethod, toTag string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, r := range u.received {
+		if r.user == user && r.method == method && (toTag == "" || r.toTag == toTag) {
+			return true
+		}
+	}
+	return false
+}
+
+// respond sends response to INVITE. Tag is To tag of UAS, which makes answers of forks
+func (inv *testInvite) respond(code sip.StatusCode, tag string) {
+	var body []byte
+	if code == sip.StatusOK {
+		body = []byte(testUASSDP)
+	}
+	res := sip.NewResponseFromRequest(inv.req, code, "", body)
+	res.To().Params.Add("tag", tag)
+	if code == sip.StatusOK {
+		res.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+		res.AppendHeader(&sip.ContactHeader{Address: inv.uas.uri(inv.req.Recipient.User)})
+	}
+	inv.uas.write(res, inv.src)
+}
+
+// testAnswerAfter rings and answers after delay, unless canceled
+func testAnswerAfter(delay time.Duration) func(inv *testInvite) {
+	return func(inv *testInvite) {
+		inv.respond(sip.StatusRinging, "uas")
+		select {
+		case <-time.After(delay):
+			inv.respond(sip.StatusOK, "uas")
+		case <-inv.canceled:
+			inv.respond(sip.StatusRequestTerminated, "uas")
+		}
+	}
+}
+
+// testRing rings until canceled
+func testRing(inv *testInvite) {
+	inv.respond(sip.StatusRinging, "uas")
+	<-inv.canceled
+	inv.respond(sip.StatusRequestTerminated, "uas")
+}
+
+// testAnswerOnCancel rings and answers when CANCEL is received, so 2xx crosses CANCEL
+func testAnswerOnCancel(inv *testInvite) {
+	inv.respond(sip.StatusRinging, "uas")
+	<-inv.canceled
+	inv.respond(sip.StatusOK, "uas")
+}
+
+func testBusy(inv *testInvite) {
+	inv.respond(sip.StatusBusyHere, "uas")
+}
+
+func newTestPhone(t *testing.T) *Phone {
+	ua, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ua.Close() })
+	return NewPhone(ua, WithPhoneLogger(zerolog.Nop()), WithPhoneMediaIP(net.IPv4(127, 0, 0, 1)))
+}
+
+func TestDialManyParallel(t *testing.T) {
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		"ring":   testRing,
+		"answer": testAnswerAfter(50 * time.Millisecond),
+		"late":   testAnswerOnCancel,
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialog, err := p.DialMany(ctx, []sip.Uri{uas.uri("ring"), uas.uri("answer"), uas.uri("late")}, DialManyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialog.Close()
+	if dialog.InviteRequest.Recipient.User != "answer" {
+		t.Fatalf("expected answer to win, got %s", dialog.InviteRequest.Recipient.User)
+	}
+
+	uas.waitRequest(t, "answer", sip.ACK, "")
+	uas.waitRequest(t, "ring", sip.CANCEL, "")
+	uas.waitRequest(t, "late", sip.CANCEL, "")
+	// 2xx crossed CANCEL, so it is ACKed and hung up
+	uas.waitRequest(t, "late", sip.ACK, "")
+	uas.waitRequest(t, "late", sip.BYE, "")
+	if uas.hasRequest("answer", sip.BYE, "") {
+		t.Error("winner must not be hung up")
+	}
+}
+
+func TestDialManyParallelLateAnswer(t *testing.T) {
+	// Both answer at once, so one of them is answered before ringing is canceled
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		"a": testAnswerAfter(0),
+		"b": testAnswerAfter(0),
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialog, err := p.DialMany(ctx, []sip.Uri{uas.uri("a"), uas.uri("b")}, DialManyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialog.Close()
+
+	loser := "a"
+	if dialog.InviteRequest.Recipient.User == "a" {
+		loser = "b"
+	}
+	uas.waitRequest(t, loser, sip.ACK, "")
+	uas.waitRequest(t, loser, sip.BYE, "")
+}
+
+func TestDialManySequential(t *testing.T) {
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		"busy":   testBusy,
+		"ring":   testRing,
+		"answer": testAnswerAfter(0),
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialog, err := p.DialMany(ctx, []sip.Uri{uas.uri("busy"), uas.uri("ring"), uas.uri("answer")}, DialManyOptions{
+		Sequential:    true,
+		TargetTimeout: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialog.Close()
+	if dialog.InviteRequest.Recipient.User != "answer" {
+		t.Fatalf("expected answer to win, got %s", dialog.InviteRequest.Recipient.User)
+	}
+	// Ringing target is canceled on target timeout
+	uas.waitRequest(t, "ring", sip.CANCEL, "")
+	uas.waitRequest(t, "answer", sip.ACK, "")
+}
+
+func TestDialManySequentialNoAnswer(t *testing.T) {
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		"busy": testBusy,
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := p.DialMany(ctx, []sip.Uri{uas.uri("busy"), uas.uri("busy")}, DialManyOptions{Sequential: true})
+	var rerr *DialResponseError
+	if !errors.As(err, &rerr) || rerr.InviteResp.StatusCode != sip.StatusBusyHere {
+		t.Fatalf("expected busy response error, got %v", err)
+	}
+}
+
+func TestDialBadSDPAnswer(t *testing.T) {
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		"bad": func(inv *testInvite) {
+			res := sip.NewResponseFromRequest(inv.req, sip.StatusOK, "OK", []byte("not sdp"))
+			res.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+			res.AppendHeader(&sip.ContactHeader{Address: inv.uas.uri("bad")})
+			inv.uas.write(res, inv.src)
+		},
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := p.Dial(ctx, uas.uri("bad"), DialOptions{}); err == nil {
+		t.Fatal("expected error of bad SDP")
+	}
+	// Call is established on UAS, so it must be ACKed and hung up
+	uas.waitRequest(t, "bad", sip.ACK, "")
+	uas.waitRequest(t, "bad", sip.BYE, "")
+}
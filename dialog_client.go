@@ -2,15 +2,17 @@ package sipgox
 
 import (
 	"context"
+	"net"
 	"sync"
 
-	"github.com/emiago/media"
 	"github.com/emiago/sipgo"
 	"github.com/emiago/sipgo/sip"
 )
 
 type DialogClientSession struct {
-	*media.MediaSession
+	// MediaSession holds negotiated media. Reads and writes go through RTP and RTCP
+	// sockets owned by dialog
+	*MediaSession
 
 	*sipgo.DialogClientSession
 
@@ -18,6 +20,22 @@ type DialogClientSession struct {
 
 	// onClose used to cleanup internal logic
 	onClose func()
+
+	dmedia *dialogMedia
+
+	// auth answers digest challenges of requests sent in dialog
+	auth digestCredentials
+	// target is uri which answered call
+	target sip.Uri
+	// reinvite takes over re-INVITEs when dialog is bridged
+	reinvite reInviteHook
+	// ua is user agent of phone which dialed
+	ua *sipgo.UserAgent
+}
+
+// Target returns uri which answered call. It differs from dialed uri if call was redirected
+func (d *DialogClientSession) Target() sip.Uri {
+	return d.target
 }
 
 func (d *DialogClientSession) Close() error {
@@ -30,6 +48,33 @@ func (d *DialogClientSession) Close() error {
 	return d.DialogClientSession.Close()
 }
 
+// RemoteMediaAddr returns address where RTP is sent. With MediaLatch option
+// it is address latched from received RTP
+func (d *DialogClientSession) RemoteMediaAddr() *net.UDPAddr {
+	if d.dmedia == nil {
+		return d.Raddr
+	}
+	return d.dmedia.RemoteAddr()
+}
+
+// ICESelectedPair returns candidate pair nominated by remote ICE agent.
+// It is nil if ICE is not used or nomination did not happen yet
+func (d *DialogClientSession) ICESelectedPair() *ICEPair {
+	if d.dmedia == nil || d.dmedia.ice == nil {
+		return nil
+	}
+	return d.dmedia.ice.selectedPair()
+}
+
+// Stats returns media quality stats. Loss, jitter of remote side and RTT
+// are only available with RTCPInterval option set
+func (d *DialogClientSession) Stats() CallStats {
+	if d.dmedia == nil {
+		return CallStats{}
+	}
+	return d.dmedia.Stats()
+}
+
 // Hangup is alias for Bye
 func (d *DialogClientSession) Hangup(ctx context.Context) error {
 	return d.Bye(ctx)
@@ -38,35 +83,48 @@ func (d *DialogClientSession) Bye(ctx context.Context) error {
 	// defer close(d.done)
 	// Let caller close media as it may delay
 	// defer d.MediaSession.Close()
-	return d.DialogClientSession.Bye(ctx)
+	return dialogBye(ctx, d.DialogClientSession, newByeRequestUAC(d.InviteRequest, d.InviteResponse), d.DialogClientSession.WriteBye, d.auth)
+}
+
+// newByeRequestUAC creates BYE to remote target with pre-loaded routes of INVITE. Dialog
+// transaction adds dialog headers and route set
+// https://datatracker.ietf.org/doc/html/rfc3261#section-15.1.1
+func newByeRequestUAC(invite *sip.Request, res *sip.Response) *sip.Request {
+	recipient := invite.Recipient
+	if cont := res.Contact(); cont != nil {
+		recipient = cont.Address
+	}
+	bye := sip.NewRequest(sip.BYE, *recipient.Clone())
+	sip.CopyHeaders("Route", invite, bye)
+	bye.SetTransport(invite.Transport())
+	return bye
+}
+
+// Do sends request within dialog and returns final response. Digest challenge is answered
+// with dialog credentials. Use it for INFO, MESSAGE, re-INVITE and other in dialog requests
+func (d *DialogClientSession) Do(ctx context.Context, req *sip.Request) (*sip.Response, error) {
+	return dialogDo(ctx, d.DialogClientSession, req, d.auth)
 }
 
 // Refer tries todo refer (blind transfer) on call
 func (d *DialogClientSession) Refer(ctx context.Context, referTo sip.Uri) error {
 	// TODO check state of call
 
+	// Dialog transaction adds dialog headers and route set
 	req := sip.NewRequest(sip.REFER, d.InviteRequest.Recipient)
-	UACRequestBuild(req, d.InviteRequest, d.InviteResponse)
-
+	if cont := d.InviteRequest.Contact(); cont != nil {
+		req.AppendHeader(sip.HeaderClone(cont))
+	}
 	req.AppendHeader(sip.NewHeader("Refer-to", referTo.String()))
 
-	tx, err := d.TransactionRequest(ctx, req)
+	res, err := d.Do(ctx, req)
 	if err != nil {
 		return err
 	}
-
-	select {
-	case <-tx.Done():
-		return tx.Err()
-	case res := <-tx.Responses():
-		if res.StatusCode != sip.StatusAccepted {
-			return sipgo.ErrDialogResponse{
-				Res: res,
-			}
+	if res.StatusCode != sip.StatusAccepted {
+		return sipgo.ErrDialogResponse{
+			Res: res,
 		}
-
-	case <-ctx.Done():
-		return tx.Err()
 	}
 
 	// There is now implicit subscription
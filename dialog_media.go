@@ -0,0 +1,473 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/stun/v3"
+	"github.com/rs/zerolog"
+)
+
+// dialogMedia sits between dialog session and media session.
+// All RTP read/write on dialog goes through here so that we can keep stats and reports.
+// It owns RTP and RTCP sockets, as we need source address of received packets
+// for latching and ICE. Media session is used only for SDP negotiation
+type dialogMedia struct {
+	sess  *media.MediaSession
+	stats *rtpStats
+	cname string
+	// srtp is set when SRTP is negotiated
+	srtp *srtpSession
+
+	// ice is set when ICE-lite is used. Connectivity checks are answered on RTP/RTCP sockets
+	ice *iceLite
+	// stun is discovery of public address of sockets, if STUN is used
+	stun *stunResult
+
+	latch     MediaLatchPolicy
+	rtpConn   net.PacketConn
+	rtcpConn  net.PacketConn
+	latchMu   sync.Mutex
+	rtpLatch  mediaLatch
+	rtcpLatch mediaLatch
+	// sdpAddr is remote address of last applied SDP
+	sdpAddr *net.UDPAddr
+
+	// rtcpReads are RTCP datagrams read by RTCP monitor for caller. Monitor is then only
+	// reader of RTCP socket, so reports are kept in stats while caller also reads RTCP.
+	// It is nil without monitor
+	rtcpReads chan rtcpRead
+
+	log       zerolog.Logger
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// rtcpRead is RTCP datagram as received and its packets. Err is error of decrypting or
+// unmarshaling packets
+type rtcpRead struct {
+	raw  []byte
+	pkts []rtcp.Packet
+	err  error
+}
+
+func newDialogMedia(sess *media.MediaSession, rtpConn net.PacketConn, rtcpConn net.PacketConn, cname string, log zerolog.Logger) *dialogMedia {
+	return &dialogMedia{
+		sess:     sess,
+		stats:    newRTPStats(),
+		cname:    cname,
+		rtpConn:  rtpConn,
+		rtcpConn: rtcpConn,
+		log:      log,
+		done:     make(chan struct{}),
+	}
+}
+
+// setRemote sets remote address of applied SDP. If address changed, latching starts again
+func (m *dialogMedia) setRemote(raddr *net.UDPAddr) {
+	if raddr == nil {
+		return
+	}
+	m.latchMu.Lock()
+	defer m.latchMu.Unlock()
+	if m.sdpAddr != nil && m.sdpAddr.IP.Equal(raddr.IP) && m.sdpAddr.Port == raddr.Port {
+		return
+	}
+	addr := *raddr
+	m.sdpAddr = &addr
+	m.rtpLatch = mediaLatch{raddr: &addr}
+	m.rtcpLatch = mediaLatch{raddr: &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1}}
+}
+
+// setLatch enables symmetric RTP with policy. Must be called before reading
+func (m *dialogMedia) setLatch(policy MediaLatchPolicy) {
+	m.latch = policy
+}
+
+// setICE enables answering ICE connectivity checks. Must be called before reading
+func (m *dialogMedia) setICE(ice *iceLite) {
+	m.ice = ice
+}
+
+// RemoteAddr returns current remote RTP address. With latching or ICE it is latched/nominated address
+func (m *dialogMedia) RemoteAddr() *net.UDPAddr {
+	m.latchMu.Lock()
+	defer m.latchMu.Unlock()
+	return m.rtpLatch.raddr
+}
+
+// Close closes media sockets
+func (m *dialogMedia) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.rtcpConn.Close()
+		m.rtpConn.Close()
+	})
+}
+
+func (m *dialogMedia) ReadRTP(buf []byte, pkt *rtp.Packet) error {
+	if err := m.readRTP(buf, pkt); err != nil {
+		return err
+	}
+	m.stats.onRecv(pkt, time.Now())
+	return nil
+}
+
+func (m *dialogMedia) readRTP(buf []byte, pkt *rtp.Packet) error {
+	n, err := m.readRTPRaw(buf)
+	if err != nil {
+		return err
+	}
+	if m.srtp == nil {
+		return pkt.Unmarshal(buf[:n])
+	}
+	// Decrypt in place so that pkt payload references caller buffer
+	return m.srtp.decryptRTP(buf[:n], pkt)
+}
+
+func (m *dialogMedia) readRTPRaw(buf []byte) (int, error) {
+	for {
+		n, addr, err := m.rtpConn.ReadFrom(buf)
+		if err != nil {
+			return n, err
+		}
+		if stun.IsMessage(buf[:n]) {
+			// Without ICE these are late STUN binding responses
+			if m.ice != nil {
+				m.handleICE(m.rtpConn, buf[:n], addr, iceComponentRTP)
+			}
+			continue
+		}
+		if m.latchSource(&m.rtpLatch, addr, "RTP") {
+			return n, nil
+		}
+	}
+}
+
+func (m *dialogMedia) readRTCPRaw(buf []byte) (int, error) {
+	if m.rtcpReads == nil {
+		return m.readRTCPConn(buf)
+	}
+	r, err := m.nextRTCPRead(time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, r.raw), nil
+}
+
+func (m *dialogMedia) readRTCPRawDeadline(buf []byte, t time.Time) (int, error) {
+	if m.rtcpReads == nil {
+		m.rtcpConn.SetReadDeadline(t)
+		return m.readRTCPConn(buf)
+	}
+	r, err := m.nextRTCPRead(t)
+	if err != nil {
+		return 0, err
+	}
+	return copy(buf, r.raw), nil
+}
+
+// nextRTCPRead waits datagram read by RTCP monitor. Zero deadline waits until media is closed
+func (m *dialogMedia) nextRTCPRead(deadline time.Time) (rtcpRead, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-m.rtcpReads:
+		return r, nil
+	case <-m.done:
+		return rtcpRead{}, net.ErrClosed
+	case <-timeout:
+		return rtcpRead{}, os.ErrDeadlineExceeded
+	}
+}
+
+// readRTCPConn reads RTCP datagram from socket
+func (m *dialogMedia) readRTCPConn(buf []byte) (int, error) {
+	for {
+		n, addr, err := m.rtcpConn.ReadFrom(buf)
+		if err != nil {
+			return n, err
+		}
+		if stun.IsMessage(buf[:n]) {
+			// Without ICE these are late STUN binding responses
+			if m.ice != nil {
+				m.handleICE(m.rtcpConn, buf[:n], addr, iceComponentRTCP)
+			}
+			continue
+		}
+		if m.latchSource(&m.rtcpLatch, addr, "RTCP") {
+			return n, nil
+		}
+	}
+}
+
+func (m *dialogMedia) handleICE(conn net.PacketConn, data []byte, addr net.Addr, component int) {
+	src, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	nominated, err := m.ice.handleSTUN(conn, data, src, component)
+	if err != nil {
+		m.log.Debug().Err(err).Str("source", src.String()).Msg("ICE connectivity check failed")
+		return
+	}
+	if !nominated {
+		return
+	}
+
+	l := &m.rtpLatch
+	if component == iceComponentRTCP {
+		l = &m.rtcpLatch
+	}
+
+	m.latchMu.Lock()
+	changed := l.raddr == nil || !l.raddr.IP.Equal(src.IP) || l.raddr.Port != src.Port
+	l.raddr, l.latched = src, true
+	m.latchMu.Unlock()
+
+	if changed {
+		m.log.Info().Int("component", component).Str("remote", src.String()).Msg("ICE candidate pair nominated")
+	}
+}
+
+func (m *dialogMedia) latchSource(l *mediaLatch, addr net.Addr, stream string) bool {
+	src, ok := addr.(*net.UDPAddr)
+	if !ok || m.latch == MediaLatchDisabled {
+		return true
+	}
+
+	m.latchMu.Lock()
+	old := l.raddr
+	accept, changed := l.update(m.latch, src)
+	m.latchMu.Unlock()
+
+	if changed {
+		m.log.Info().
+			Str("stream", stream).
+			Str("policy", m.latch.String()).
+			Str("from", old.String()).
+			Str("to", src.String()).
+			Msg("Media remote address changed")
+	}
+	if !accept {
+		m.log.Debug().Str("stream", stream).Str("source", src.String()).Msg("Media packet dropped from unknown source")
+	}
+	return accept
+}
+
+func (m *dialogMedia) WriteRTP(pkt *rtp.Packet) error {
+	if err := m.writeRTP(pkt); err != nil {
+		return err
+	}
+	m.stats.onSend(pkt, time.Now())
+	return nil
+}
+
+func (m *dialogMedia) writeRTP(pkt *rtp.Packet) error {
+	var data []byte
+	var err error
+	if m.srtp != nil {
+		data, err = m.srtp.encryptRTP(pkt)
+	} else {
+		data, err = pkt.Marshal()
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := m.writeRTPRaw(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+func (m *dialogMedia) writeRTPRaw(data []byte) (int, error) {
+	m.latchMu.Lock()
+	raddr := m.rtpLatch.raddr
+	m.latchMu.Unlock()
+	return m.rtpConn.WriteTo(data, raddr)
+}
+
+func (m *dialogMedia) writeRTCPRaw(data []byte) error {
+	m.latchMu.Lock()
+	raddr := m.rtcpLatch.raddr
+	if !m.rtcpLatch.latched && m.rtpLatch.raddr != nil {
+		// Until we receive RTCP assume it is next to latched RTP
+		raddr = &net.UDPAddr{IP: m.rtpLatch.raddr.IP, Port: m.rtpLatch.raddr.Port + 1}
+	}
+	m.latchMu.Unlock()
+
+	n, err := m.rtcpConn.WriteTo(data, raddr)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// ReadRTCP reads RTCP packets. Remote reports are kept in stats
+func (m *dialogMedia) ReadRTCP(pkts []rtcp.Packet) (int, error) {
+	if m.rtcpReads != nil {
+		r, err := m.nextRTCPRead(time.Time{})
+		if err != nil {
+			return 0, err
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		return copy(pkts, r.pkts), nil
+	}
+
+	raw, ps, err := m.readRTCP(make([]byte, 1600))
+	if raw == nil || err != nil {
+		return 0, err
+	}
+	return copy(pkts, ps), nil
+}
+
+// readRTCP reads RTCP datagram from socket, decrypts it and keeps remote reports in stats.
+// Raw is nil in case of socket error
+func (m *dialogMedia) readRTCP(buf []byte) (raw []byte, pkts []rtcp.Packet, err error) {
+	n, err := m.readRTCPConn(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw = buf[:n]
+	data := raw
+	if m.srtp != nil {
+		data, err = m.srtp.decryptRTCP(data)
+		if err != nil {
+			return raw, nil, err
+		}
+	}
+	pkts, err = rtcp.Unmarshal(data)
+	if err != nil {
+		return raw, nil, err
+	}
+
+	now := time.Now()
+	for _, p := range pkts {
+		m.stats.onRTCP(p, now)
+	}
+	return raw, pkts, nil
+}
+
+func (m *dialogMedia) WriteRTCPs(pkts []rtcp.Packet) error {
+	data, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return err
+	}
+	if m.srtp != nil {
+		data, err = m.srtp.encryptRTCP(data)
+		if err != nil {
+			return err
+		}
+	}
+	return m.writeRTCPRaw(data)
+}
+
+func (m *dialogMedia) Stats() CallStats {
+	return m.stats.stats()
+}
+
+// monitorRTCP sends SR/RR on every interval and reads remote reports until dialog ends.
+// It must be called before RTCP is read, as monitor becomes only reader of RTCP socket
+// and passes read datagrams to ReadRTCP and ReadRTCPRaw
+// https://datatracker.ietf.org/doc/html/rfc3550#section-6
+func (m *dialogMedia) monitorRTCP(ctx context.Context, interval time.Duration) {
+	m.rtcpReads = make(chan rtcpRead, 16)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				m.sendBye()
+				return
+			case <-m.done:
+				return
+			case now := <-ticker.C:
+				if err := m.sendReport(now); err != nil {
+					m.log.Debug().Err(err).Msg("Failed to send RTCP report")
+				}
+			}
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 1600)
+		for {
+			raw, pkts, err := m.readRTCP(buf)
+			if raw == nil {
+				if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+					return
+				}
+				select {
+				case <-m.done:
+					return
+				default:
+				}
+				m.log.Debug().Err(err).Msg("Failed to read RTCP")
+				continue
+			}
+			if err != nil {
+				m.log.Debug().Err(err).Msg("Failed to decode RTCP")
+			}
+
+			select {
+			case m.rtcpReads <- rtcpRead{raw: append([]byte(nil), raw...), pkts: pkts, err: err}:
+			default:
+				// Caller is not reading RTCP. Reports are still kept in stats
+			}
+		}
+	}()
+}
+
+func (m *dialogMedia) sendReport(now time.Time) error {
+	report := m.stats.report(now)
+	// Every compound packet must contain CNAME
+	sdes := &rtcp.SourceDescription{
+		Chunks: []rtcp.SourceDescriptionChunk{{
+			Source: reportSSRC(report),
+			Items:  []rtcp.SourceDescriptionItem{{Type: rtcp.SDESCNAME, Text: m.cname}},
+		}},
+	}
+	return m.WriteRTCPs([]rtcp.Packet{report, sdes})
+}
+
+func (m *dialogMedia) sendBye() {
+	report := m.stats.report(time.Now())
+	bye := &rtcp.Goodbye{Sources: []uint32{reportSSRC(report)}}
+	if err := m.WriteRTCPs([]rtcp.Packet{report, bye}); err != nil {
+		m.log.Debug().Err(err).Msg("Failed to send RTCP BYE")
+	}
+}
+
+func reportSSRC(p rtcp.Packet) uint32 {
+	switch r := p.(type) {
+	case *rtcp.SenderReport:
+		return r.SSRC
+	case *rtcp.ReceiverReport:
+		return r.SSRC
+	}
+	return 0
+}
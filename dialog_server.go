@@ -3,22 +3,44 @@ package sipgox
 import (
 	"context"
 	"fmt"
+	"net"
+	"slices"
 	"strings"
 
-	"github.com/emiago/media"
 	"github.com/emiago/sipgo"
 	"github.com/emiago/sipgo/sip"
+	"github.com/rs/zerolog"
 )
 
 type DialogServerSession struct {
-	*media.MediaSession
+	// MediaSession holds negotiated media. Reads and writes go through RTP and RTCP
+	// sockets owned by dialog
+	*MediaSession
 
+	// Once answered InviteRequest is clone with Record-Route reversed, as sipgo reverses it
+	// again when building route set of requests sent in dialog
 	*sipgo.DialogServerSession
 
 	waitNotify chan error
 
 	// onClose used to cleanup internal logic
 	onClose func()
+
+	dmedia *dialogMedia
+
+	// auth answers digest challenges of requests sent in dialog
+	auth digestCredentials
+	// route is name of call route which answered dialog
+	route string
+	// reinvite takes over re-INVITEs when dialog is bridged
+	reinvite reInviteHook
+	// ua is user agent of phone which answered
+	ua *sipgo.UserAgent
+}
+
+// Route returns name of call route which answered dialog. Empty without router
+func (d *DialogServerSession) Route() string {
+	return d.route
 }
 
 func (d *DialogServerSession) Close() error {
@@ -34,6 +56,33 @@ func (d *DialogServerSession) Close() error {
 	return err
 }
 
+// RemoteMediaAddr returns address where RTP is sent. With MediaLatch option
+// it is address latched from received RTP
+func (d *DialogServerSession) RemoteMediaAddr() *net.UDPAddr {
+	if d.dmedia == nil {
+		return d.Raddr
+	}
+	return d.dmedia.RemoteAddr()
+}
+
+// ICESelectedPair returns candidate pair nominated by remote ICE agent.
+// It is nil if ICE is not used or nomination did not happen yet
+func (d *DialogServerSession) ICESelectedPair() *ICEPair {
+	if d.dmedia == nil || d.dmedia.ice == nil {
+		return nil
+	}
+	return d.dmedia.ice.selectedPair()
+}
+
+// Stats returns media quality stats. Loss, jitter of remote side and RTT
+// are only available with RTCPInterval option set
+func (d *DialogServerSession) Stats() CallStats {
+	if d.dmedia == nil {
+		return CallStats{}
+	}
+	return d.dmedia.Stats()
+}
+
 // Hangup is alias for Bye
 func (d *DialogServerSession) Hangup(ctx context.Context) error {
 	return d.Bye(ctx)
@@ -41,38 +90,69 @@ func (d *DialogServerSession) Hangup(ctx context.Context) error {
 func (d *DialogServerSession) Bye(ctx context.Context) error {
 	// defer close(d.done)
 	// defer d.MediaSession.Close()
-	return d.DialogServerSession.Bye(ctx)
+	bye := sip.NewRequest(sip.BYE, d.InviteRequest.Contact().Address)
+	bye.SetTransport(d.InviteRequest.Transport())
+	return dialogBye(ctx, d.DialogServerSession, bye, d.DialogServerSession.WriteBye, d.auth)
+}
+
+// inDialog checks does request belong to dialog
+func (d *DialogServerSession) inDialog(req *sip.Request) bool {
+	if d.InviteResponse == nil {
+		return false
+	}
+	id, _ := sip.MakeDialogIDFromResponse(d.InviteResponse)
+	rid, err := sip.MakeDialogIDFromRequest(req)
+	return err == nil && rid == id
+}
+
+// readReInvite applies SDP of INVITE received for update, unless dialog is bridged
+func (d *DialogServerSession) readReInvite(req *sip.Request, tx sip.ServerTransaction, log zerolog.Logger) {
+	if h := d.reinvite.get(); h != nil {
+		h(req, tx)
+		return
+	}
+
+	if err := d.MediaSession.RemoteSDP(req.Body()); err != nil {
+		res := sip.NewResponseFromRequest(req, 400, err.Error(), nil)
+		if err := tx.Respond(res); err != nil {
+			log.Error().Err(err).Msg("Fail to send 400")
+		}
+		return
+	}
+	if d.dmedia != nil {
+		d.dmedia.setRemote(d.Raddr)
+	}
+
+	res := sip.NewResponseFromRequest(req, 200, "OK", nil)
+	if err := tx.Respond(res); err != nil {
+		log.Error().Err(err).Msg("Fail to send 200")
+	}
+}
+
+// Do sends request within dialog and returns final response. Digest challenge is answered
+// with dialog credentials. Use it for INFO, MESSAGE, re-INVITE and other in dialog requests
+func (d *DialogServerSession) Do(ctx context.Context, req *sip.Request) (*sip.Response, error) {
+	return dialogDo(ctx, d.DialogServerSession, req, d.auth)
 }
 
 // Refer tries todo refer (blind transfer) on call
 func (d *DialogServerSession) Refer(ctx context.Context, referTo sip.Uri) error {
 	// TODO check state of call
 
+	// Dialog transaction adds dialog headers and route set. Invite request tags are preserved but switched
 	req := sip.NewRequest(sip.REFER, d.InviteRequest.Contact().Address)
-	UASRequestBuild(req, d.InviteResponse)
-
-	// Invite request tags must be preserved but switched
 	req.AppendHeader(sip.NewHeader("Refer-to", referTo.String()))
 
 	d.waitNotify = make(chan error)
 
-	tx, err := d.TransactionRequest(ctx, req)
+	res, err := d.Do(ctx, req)
 	if err != nil {
 		return err
 	}
-
-	select {
-	case <-tx.Done():
-		return tx.Err()
-	case res := <-tx.Responses():
-		if res.StatusCode != sip.StatusAccepted {
-			return sipgo.ErrDialogResponse{
-				Res: res,
-			}
+	if res.StatusCode != sip.StatusAccepted {
+		return sipgo.ErrDialogResponse{
+			Res: res,
 		}
-
-	case <-ctx.Done():
-		return tx.Err()
 	}
 
 	return d.Hangup(ctx)
@@ -133,12 +213,13 @@ func UACRequestBuild(req *sip.Request, lastReq *sip.Request, lastResp *sip.Respo
 		req.AppendHeader(cont)
 	}
 
-	// This is not clear
-	// hdrs := res.GetHeaders("Record-Route")
-	// for i := len(hdrs) - 1; i >= 0; i-- {
-	// 	recordRoute := hdrs[i]
-	// 	req.AppendHeader(sip.NewHeader("Route", recordRoute.Value()))
-	// }
+	// UAC route set is Record-Route of response in reverse order
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-12.1.2
+	if lastResp != nil {
+		routes := routeUris(lastResp.GetHeaders("Record-Route"))
+		slices.Reverse(routes)
+		applyRouteSet(req, routes)
+	}
 }
 
 func UASRequestBuild(req *sip.Request, lastResp *sip.Response) {
@@ -172,4 +253,8 @@ func UASRequestBuild(req *sip.Request, lastResp *sip.Response) {
 	if cont := lastResp.GetHeader("Contact"); cont != nil {
 		req.AppendHeader(cont)
 	}
+
+	// UAS route set is Record-Route in order. Response has them copied from request
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-12.1.1
+	applyRouteSet(req, routeUris(lastResp.GetHeaders("Record-Route")))
 }
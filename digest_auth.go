@@ -0,0 +1,339 @@
+package sipgox
+
+import (
+	"container/list"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/icholy/digest"
+)
+
+// Digest authentication of incoming requests
+// https://datatracker.ietf.org/doc/html/rfc3261#section-22.4
+// https://datatracker.ietf.org/doc/html/rfc8760
+
+var (
+	ErrCredentialNotFound = fmt.Errorf("credential not found")
+)
+
+// CredentialStore returns HA1 of user for digest authentication.
+// HA1 is H(username:realm:password) where H is MD5 or SHA-256 depending on algorithm.
+// ErrCredentialNotFound should be returned for unknown user
+type CredentialStore interface {
+	HA1(ctx context.Context, username string, realm string, algorithm string) (string, error)
+}
+
+// PasswordCredentials is CredentialStore of plain passwords by username
+type PasswordCredentials map[string]string
+
+func (c PasswordCredentials) HA1(ctx context.Context, username string, realm string, algorithm string) (string, error) {
+	password, exists := c[username]
+	if !exists {
+		return "", ErrCredentialNotFound
+	}
+	return DigestHA1(algorithm, username, realm, password)
+}
+
+// DigestHA1 calculates HA1 which can be kept in credential store instead of password
+func DigestHA1(algorithm string, username string, realm string, password string) (string, error) {
+	h, err := digestHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	return hashHex(h, username+":"+realm+":"+password), nil
+}
+
+func digestHash(algorithm string) (hash.Hash, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", "MD5":
+		return md5.New(), nil
+	case "SHA-256":
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("digest algorithm %q not supported", algorithm)
+}
+
+func hashHex(h hash.Hash, s string) string {
+	h.Reset()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DigestAuthorizer challenges and authorizes requests. Every challenge gets own nonce which
+// is valid for NonceExpiry. Request with expired nonce and correct credentials is challenged
+// with stale=true so that client can retry without asking user. Nonce without qop can be
+// used once, as there is no nonce count protecting it from replay.
+// It is safe to share it between handlers
+type DigestAuthorizer struct {
+	Realm string
+	Store CredentialStore
+	// Algorithms are offered in order of preference. Default is MD5
+	Algorithms []string
+	// NonceExpiry default is 5 min
+	NonceExpiry time.Duration
+	// Proxy challenges with 407 and Proxy-Authenticate
+	Proxy bool
+	// MaxNonces limits outstanding nonces. Oldest is dropped when it is reached. Default is 10000
+	MaxNonces int
+
+	mu     sync.Mutex
+	nonces map[string]*digestNonce
+	// issued are outstanding nonces in order of creation, so expired ones are removed from front
+	issued *list.List
+}
+
+type digestNonce struct {
+	created time.Time
+	// nc is last nonce count used by client
+	nc int
+	// elem is nonce in issued list
+	elem *list.Element
+}
+
+func NewDigestAuthorizer(realm string, store CredentialStore) *DigestAuthorizer {
+	return &DigestAuthorizer{
+		Realm: realm,
+		Store: store,
+	}
+}
+
+// Authorize checks credentials of request. If request is not authorized it responds with
+// challenge or error response on transaction and returns false.
+// Username of authorized user is returned
+func (a *DigestAuthorizer) Authorize(ctx context.Context, req *sip.Request, tx sip.ServerTransaction) (string, bool) {
+	username, res := a.authorize(ctx, req)
+	if res == nil {
+		return username, true
+	}
+	tx.Respond(res)
+	return username, false
+}
+
+// authorize returns response in case request is not authorized
+func (a *DigestAuthorizer) authorize(ctx context.Context, req *sip.Request) (string, *sip.Response) {
+	hname := "Authorization"
+	if a.Proxy {
+		hname = "Proxy-Authorization"
+	}
+
+	h := req.GetHeader(hname)
+	if h == nil {
+		return "", a.challenge(req, false)
+	}
+
+	cred, err := digest.ParseCredentials(h.Value())
+	if err != nil {
+		return "", sip.NewResponseFromRequest(req, sip.StatusBadRequest, "Bad credentials", nil)
+	}
+
+	algorithm := strings.ToUpper(cred.Algorithm)
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	if cred.Realm != a.Realm || !a.offers(algorithm) {
+		return cred.Username, a.challenge(req, false)
+	}
+
+	ha1, err := a.Store.HA1(ctx, cred.Username, cred.Realm, algorithm)
+	if err != nil {
+		if errors.Is(err, ErrCredentialNotFound) {
+			// Same as wrong password, so that existing users can not be found out
+			return cred.Username, a.challenge(req, false)
+		}
+		return cred.Username, sip.NewResponseFromRequest(req, sip.StatusInternalServerError, "Credential lookup failed", nil)
+	}
+
+	if !digestURIMatches(cred.URI, req.Recipient) {
+		return cred.Username, sip.NewResponseFromRequest(req, sip.StatusBadRequest, "Digest URI mismatch", nil)
+	}
+
+	expected, err := digestResponse(algorithm, ha1, string(req.Method), cred)
+	if err != nil {
+		return cred.Username, a.challenge(req, false)
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(cred.Response)) != 1 {
+		return cred.Username, a.challenge(req, false)
+	}
+
+	// Credentials are correct, so anything wrong from here is nonce
+	switch a.useNonce(cred.Nonce, cred.QOP, cred.Nc) {
+	case nonceStale:
+		return cred.Username, a.challenge(req, true)
+	case nonceReplay:
+		return cred.Username, a.challenge(req, false)
+	}
+	return cred.Username, nil
+}
+
+func (a *DigestAuthorizer) offers(algorithm string) bool {
+	if len(a.Algorithms) == 0 {
+		return algorithm == "MD5"
+	}
+	for _, alg := range a.Algorithms {
+		if strings.EqualFold(alg, algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge creates 401/407 with challenge of each algorithm
+func (a *DigestAuthorizer) challenge(req *sip.Request, stale bool) *sip.Response {
+	nonce, err := a.newNonce()
+	if err != nil {
+		return sip.NewResponseFromRequest(req, sip.StatusInternalServerError, "Nonce failed", nil)
+	}
+
+	code, reason, hname := sip.StatusUnauthorized, "Unauthorized", "WWW-Authenticate"
+	if a.Proxy {
+		code, reason, hname = sip.StatusProxyAuthRequired, "Proxy Authentication Required", "Proxy-Authenticate"
+	}
+	res := sip.NewResponseFromRequest(req, code, reason, nil)
+
+	algorithms := a.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{"MD5"}
+	}
+	for _, alg := range algorithms {
+		chal := digest.Challenge{
+			Realm:     a.Realm,
+			Nonce:     nonce,
+			Stale:     stale,
+			Algorithm: alg,
+			QOP:       []string{"auth"},
+		}
+		res.AppendHeader(sip.NewHeader(hname, chal.String()))
+	}
+	return res
+}
+
+func (a *DigestAuthorizer) nonceExpiry() time.Duration {
+	if a.NonceExpiry > 0 {
+		return a.NonceExpiry
+	}
+	return 5 * time.Minute
+}
+
+func (a *DigestAuthorizer) maxNonces() int {
+	if a.MaxNonces > 0 {
+		return a.MaxNonces
+	}
+	return 10000
+}
+
+// newNonce creates random nonce and removes expired ones
+func (a *DigestAuthorizer) newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.nonces == nil {
+		a.nonces = make(map[string]*digestNonce)
+		a.issued = list.New()
+	}
+	for e := a.issued.Front(); e != nil; e = a.issued.Front() {
+		oldest := e.Value.(string)
+		if now.Sub(a.nonces[oldest].created) <= a.nonceExpiry() && a.issued.Len() < a.maxNonces() {
+			break
+		}
+		a.removeNonce(oldest)
+	}
+	a.nonces[nonce] = &digestNonce{created: now, elem: a.issued.PushBack(nonce)}
+	return nonce, nil
+}
+
+// removeNonce removes nonce once it is used or expired. Lock must be held
+func (a *DigestAuthorizer) removeNonce(nonce string) {
+	s, exists := a.nonces[nonce]
+	if !exists {
+		return
+	}
+	a.issued.Remove(s.elem)
+	delete(a.nonces, nonce)
+}
+
+const (
+	nonceValid = iota
+	nonceStale
+	nonceReplay
+)
+
+// useNonce checks is nonce ours and not expired. With qop nonce count must increase,
+// without it nonce is removed on use
+// https://datatracker.ietf.org/doc/html/rfc2617#section-3.2.2
+func (a *DigestAuthorizer) useNonce(nonce string, qop string, nc int) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, exists := a.nonces[nonce]
+	if !exists || time.Since(s.created) > a.nonceExpiry() {
+		a.removeNonce(nonce)
+		return nonceStale
+	}
+	if qop == "" {
+		a.removeNonce(nonce)
+		return nonceValid
+	}
+	if nc <= s.nc {
+		return nonceReplay
+	}
+	s.nc = nc
+	return nonceValid
+}
+
+// digestURIMatches checks digest-uri is Request-URI of request, so that credentials can not be
+// used for other target
+// https://datatracker.ietf.org/doc/html/rfc3261#section-22.4
+func digestURIMatches(uri string, recipient sip.Uri) bool {
+	var u sip.Uri
+	if err := sip.ParseUri(uri, &u); err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, recipient.Scheme) &&
+		u.User == recipient.User &&
+		strings.EqualFold(u.Host, recipient.Host) &&
+		uriPort(u) == uriPort(recipient)
+}
+
+// uriPort is port of uri or default of its scheme
+func uriPort(u sip.Uri) int {
+	switch {
+	case u.Port > 0:
+		return u.Port
+	case strings.EqualFold(u.Scheme, "sips"):
+		return sip.DefaultTlsPort
+	}
+	return sip.DefaultUdpPort
+}
+
+// digestResponse calculates expected response of credentials
+func digestResponse(algorithm string, ha1 string, method string, cred *digest.Credentials) (string, error) {
+	h, err := digestHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	ha2 := hashHex(h, method+":"+cred.URI)
+	switch cred.QOP {
+	case "":
+		return hashHex(h, ha1+":"+cred.Nonce+":"+ha2), nil
+	case "auth":
+		nc := fmt.Sprintf("%08x", cred.Nc)
+		return hashHex(h, strings.Join([]string{ha1, cred.Nonce, nc, cred.Cnonce, cred.QOP, ha2}, ":")), nil
+	}
+	return "", fmt.Errorf("digest qop %q not supported", cred.QOP)
+}
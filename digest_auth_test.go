@@ -0,0 +1,258 @@
+package sipgox
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/icholy/digest"
+)
+
+const digestTestURI = "sip:example.test"
+
+func digestTestRequest(cred *digest.Credentials) *sip.Request {
+	req := sip.NewRequest(sip.REGISTER, sip.Uri{Scheme: "sip", Host: "example.test"})
+	req.AppendHeader(sip.NewHeader("Via", "SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bK.digest"))
+	req.AppendHeader(sip.NewHeader("From", "<sip:alice@example.test>;tag=a1"))
+	req.AppendHeader(sip.NewHeader("To", "<sip:alice@example.test>"))
+	req.AppendHeader(sip.NewHeader("Call-ID", "digest-test"))
+	req.AppendHeader(sip.NewHeader("CSeq", "1 REGISTER"))
+	if cred != nil {
+		req.AppendHeader(sip.NewHeader("Authorization", cred.String()))
+	}
+	return req
+}
+
+// digestTestChallenge returns challenge of response with algorithm
+func digestTestChallenge(t *testing.T, res *sip.Response, algorithm string) *digest.Challenge {
+	t.Helper()
+	if res == nil || res.StatusCode != sip.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v", res)
+	}
+	for _, h := range res.GetHeaders("WWW-Authenticate") {
+		chal, err := digest.ParseChallenge(h.Value())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chal.Algorithm == algorithm {
+			return chal
+		}
+	}
+	t.Fatalf("no challenge with algorithm %s", algorithm)
+	return nil
+}
+
+func digestTestCredentials(t *testing.T, chal *digest.Challenge, password string, nc int) *digest.Credentials {
+	t.Helper()
+	cred, err := digest.Digest(chal, digest.Options{
+		Method:   "REGISTER",
+		URI:      digestTestURI,
+		Username: "alice",
+		Password: password,
+		Count:    nc,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cred
+}
+
+func newDigestTestAuthorizer() *DigestAuthorizer {
+	return NewDigestAuthorizer("example.test", PasswordCredentials{"alice": "secret"})
+}
+
+func TestDigestAuthorize(t *testing.T) {
+	ctx := context.Background()
+	a := newDigestTestAuthorizer()
+
+	_, res := a.authorize(ctx, digestTestRequest(nil))
+	chal := digestTestChallenge(t, res, "MD5")
+	if chal.Stale || !chal.SupportsQOP("auth") {
+		t.Errorf("unexpected challenge %s", chal)
+	}
+
+	username, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "secret", 1)))
+	if res != nil || username != "alice" {
+		t.Fatalf("expected authorized alice, got %q %v", username, res)
+	}
+
+	// Nonce can be reused with higher nonce count
+	if _, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "secret", 2))); res != nil {
+		t.Fatalf("expected authorized with next nonce count, got %v", res)
+	}
+
+	// Replayed nonce count is challenged again, but not as stale
+	_, res = a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "secret", 2)))
+	if c := digestTestChallenge(t, res, "MD5"); c.Stale {
+		t.Error("replay must not be stale")
+	}
+}
+
+func TestDigestAuthorizeUnknownUser(t *testing.T) {
+	ctx := context.Background()
+	a := newDigestTestAuthorizer()
+	_, res := a.authorize(ctx, digestTestRequest(nil))
+	chal := digestTestChallenge(t, res, "MD5")
+
+	_, wrongPassword := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "wrong", 1)))
+
+	cred := digestTestCredentials(t, chal, "secret", 1)
+	cred.Username = "bob"
+	_, unknownUser := a.authorize(ctx, digestTestRequest(cred))
+
+	// Both are same challenge, so existing users are not revealed
+	for _, res := range []*sip.Response{wrongPassword, unknownUser} {
+		if c := digestTestChallenge(t, res, "MD5"); c.Stale {
+			t.Error("unexpected stale challenge")
+		}
+	}
+}
+
+func TestDigestAuthorizeStale(t *testing.T) {
+	ctx := context.Background()
+	a := newDigestTestAuthorizer()
+	_, res := a.authorize(ctx, digestTestRequest(nil))
+	chal := digestTestChallenge(t, res, "MD5")
+
+	a.mu.Lock()
+	a.nonces[chal.Nonce].created = time.Now().Add(-time.Hour)
+	a.mu.Unlock()
+
+	_, res = a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "secret", 1)))
+	if c := digestTestChallenge(t, res, "MD5"); !c.Stale || c.Nonce == chal.Nonce {
+		t.Errorf("expected stale challenge with new nonce, got %s", c)
+	}
+
+	// Expired nonce with wrong password is not stale
+	_, res = a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "wrong", 1)))
+	if c := digestTestChallenge(t, res, "MD5"); c.Stale {
+		t.Error("wrong password must not be stale")
+	}
+}
+
+func TestDigestAuthorizeWithoutQOP(t *testing.T) {
+	ctx := context.Background()
+	a := newDigestTestAuthorizer()
+	_, res := a.authorize(ctx, digestTestRequest(nil))
+	chal := digestTestChallenge(t, res, "MD5")
+	// RFC 2069 client
+	chal.QOP = nil
+
+	cred := digestTestCredentials(t, chal, "secret", 1)
+	if cred.QOP != "" {
+		t.Fatalf("expected credentials without qop, got %q", cred.QOP)
+	}
+	if _, res := a.authorize(ctx, digestTestRequest(cred)); res != nil {
+		t.Fatalf("expected authorized, got %v", res)
+	}
+
+	// Nonce is used once
+	if _, res := a.authorize(ctx, digestTestRequest(cred)); res == nil {
+		t.Fatal("expected replay without qop to be challenged")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// Only nonce of last challenge is outstanding
+	if _, exists := a.nonces[chal.Nonce]; exists || a.issued.Len() != 1 {
+		t.Errorf("expected used nonce removed, %d outstanding", a.issued.Len())
+	}
+}
+
+func TestDigestAuthorizeSHA256(t *testing.T) {
+	ctx := context.Background()
+	a := newDigestTestAuthorizer()
+	a.Algorithms = []string{"SHA-256", "MD5"}
+
+	_, res := a.authorize(ctx, digestTestRequest(nil))
+	if hdrs := res.GetHeaders("WWW-Authenticate"); len(hdrs) != 2 {
+		t.Fatalf("expected challenge for each algorithm, got %d", len(hdrs))
+	}
+	chal := digestTestChallenge(t, res, "SHA-256")
+	if _, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "secret", 1))); res != nil {
+		t.Fatalf("expected authorized with SHA-256, got %v", res)
+	}
+
+	// Algorithm which is not offered is challenged
+	a.Algorithms = []string{"MD5"}
+	_, res = a.authorize(ctx, digestTestRequest(nil))
+	chal = digestTestChallenge(t, res, "MD5")
+	chal.Algorithm = "SHA-256"
+	if _, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, chal, "secret", 1))); res == nil || res.StatusCode != sip.StatusUnauthorized {
+		t.Fatalf("expected 401 for algorithm not offered, got %v", res)
+	}
+}
+
+func TestDigestAuthorizeURIMismatch(t *testing.T) {
+	ctx := context.Background()
+	a := newDigestTestAuthorizer()
+	_, res := a.authorize(ctx, digestTestRequest(nil))
+	chal := digestTestChallenge(t, res, "MD5")
+
+	cred, err := digest.Digest(chal, digest.Options{
+		Method:   "REGISTER",
+		URI:      "sip:other.test",
+		Username: "alice",
+		Password: "secret",
+		Count:    1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, res = a.authorize(ctx, digestTestRequest(cred))
+	if res == nil || res.StatusCode != sip.StatusBadRequest {
+		t.Fatalf("expected 400, got %v", res)
+	}
+}
+
+func TestDigestURIMatches(t *testing.T) {
+	recipient := sip.Uri{Scheme: "sip", User: "alice", Host: "Example.test"}
+	tests := []struct {
+		uri   string
+		match bool
+	}{
+		{"sip:alice@example.test", true},
+		{"sip:alice@example.test:5060", true},
+		{"sip:alice@example.test:5070", false},
+		{"sip:bob@example.test", false},
+		{"sips:alice@example.test", false},
+		{"", false},
+	}
+	for _, tc := range tests {
+		if m := digestURIMatches(tc.uri, recipient); m != tc.match {
+			t.Errorf("%q: expected match %v", tc.uri, tc.match)
+		}
+	}
+}
+
+func TestDigestMaxNonces(t *testing.T) {
+	ctx := context.Background()
+	a := newDigestTestAuthorizer()
+	a.MaxNonces = 2
+
+	challenge := func() *digest.Challenge {
+		_, res := a.authorize(ctx, digestTestRequest(nil))
+		return digestTestChallenge(t, res, "MD5")
+	}
+
+	// Used nonce does not count against limit
+	used := challenge()
+	used.QOP = nil
+	if _, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, used, "secret", 1))); res != nil {
+		t.Fatalf("expected authorized, got %v", res)
+	}
+	first, second := challenge(), challenge()
+	if _, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, first, "secret", 1))); res != nil {
+		t.Fatalf("expected first nonce to be valid, got %v", res)
+	}
+
+	// Oldest is evicted when limit is reached
+	challenge()
+	if _, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, second, "secret", 1))); res != nil {
+		t.Fatalf("expected second nonce to be valid, got %v", res)
+	}
+	_, res := a.authorize(ctx, digestTestRequest(digestTestCredentials(t, first, "secret", 2)))
+	if c := digestTestChallenge(t, res, "MD5"); !c.Stale {
+		t.Error("expected evicted nonce to be stale")
+	}
+}
@@ -0,0 +1,237 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/icholy/digest"
+)
+
+// Digest authentication of requests we send. UAS challenges with 401 and proxy with 407
+// and each can have own credentials
+// https://datatracker.ietf.org/doc/html/rfc3261#section-22.2
+
+// maxDigestRetries limits resending in case of proxy and UAS challenges and stale nonces
+const maxDigestRetries = 4
+
+type digestCredentials struct {
+	username string
+	password string
+
+	proxyUsername string
+	proxyPassword string
+}
+
+// get returns credentials for challenge response. Proxy falls back to UAS credentials
+func (c digestCredentials) get(code sip.StatusCode) (string, string) {
+	if code == sip.StatusProxyAuthRequired && c.proxyPassword != "" {
+		return c.proxyUsername, c.proxyPassword
+	}
+	return c.username, c.password
+}
+
+func isDigestChallenge(res *sip.Response) bool {
+	return res.StatusCode == sip.StatusUnauthorized || res.StatusCode == sip.StatusProxyAuthRequired
+}
+
+// digestChallenges answers challenges of one request. When request is challenged again by
+// other side, like UAS after proxy, previous challenges are answered with increased nonce count
+type digestChallenges struct {
+	cred  digestCredentials
+	chals map[sip.StatusCode]*digestChallenge
+}
+
+type digestChallenge struct {
+	res *sip.Response
+	nc  int
+}
+
+func newDigestChallenges(cred digestCredentials) *digestChallenges {
+	return &digestChallenges{
+		cred:  cred,
+		chals: make(map[sip.StatusCode]*digestChallenge),
+	}
+}
+
+// authorize answers challenge of response on request. Error is returned if same challenge
+// was already answered and nonce is not stale, meaning that credentials are rejected
+func (c *digestChallenges) authorize(req *sip.Request, res *sip.Response) error {
+	if _, exists := c.chals[res.StatusCode]; exists && !challengeStale(res) {
+		return fmt.Errorf("credentials rejected: %s", res.StartLine())
+	}
+	c.chals[res.StatusCode] = &digestChallenge{res: res}
+
+	for _, chal := range c.chals {
+		chal.nc++
+		if err := digestAuthorize(req, chal.res, c.cred, chal.nc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// digestAuthorize answers challenge of response by adding Authorization or Proxy-Authorization
+// to request. First challenge with supported algorithm is used
+func digestAuthorize(req *sip.Request, res *sip.Response, cred digestCredentials, nc int) error {
+	chalName, authName := "WWW-Authenticate", "Authorization"
+	if res.StatusCode == sip.StatusProxyAuthRequired {
+		chalName, authName = "Proxy-Authenticate", "Proxy-Authorization"
+	}
+
+	username, password := cred.get(res.StatusCode)
+	if password == "" {
+		return fmt.Errorf("no credentials for challenge %q", res.StartLine())
+	}
+
+	for _, h := range res.GetHeaders(chalName) {
+		chal, err := digest.ParseChallenge(h.Value())
+		if err != nil {
+			continue
+		}
+		// Fix lower case algorithm although not supported by rfc
+		chal.Algorithm = strings.ToUpper(chal.Algorithm)
+
+		auth, err := digest.Digest(chal, digest.Options{
+			Method:   req.Method.String(),
+			URI:      req.Recipient.Addr(),
+			Username: username,
+			Password: password,
+			Count:    nc,
+		})
+		if err != nil {
+			// Algorithm not supported, try next
+			continue
+		}
+
+		removeHeaders(req, authName)
+		req.AppendHeader(sip.NewHeader(authName, auth.String()))
+		return nil
+	}
+	return fmt.Errorf("no supported digest challenge in %q", res.StartLine())
+}
+
+// challengeStale checks is challenge sent due to expired nonce
+func challengeStale(res *sip.Response) bool {
+	for _, name := range []string{"WWW-Authenticate", "Proxy-Authenticate"} {
+		for _, h := range res.GetHeaders(name) {
+			if chal, err := digest.ParseChallenge(h.Value()); err == nil && chal.Stale {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func removeHeaders(req *sip.Request, name string) {
+	for req.RemoveHeader(name) {
+	}
+}
+
+type dialogTransactioner interface {
+	TransactionRequest(ctx context.Context, req *sip.Request) (sip.ClientTransaction, error)
+}
+
+// dialogDo sends request within dialog and returns final response. Digest challenges are
+// answered with credentials and request is resent
+func dialogDo(ctx context.Context, d dialogTransactioner, req *sip.Request, cred digestCredentials) (*sip.Response, error) {
+	resend := newDialogResend(req)
+	res, err := dialogTransactionResponse(ctx, d, req)
+	if err != nil {
+		return nil, err
+	}
+	return dialogDigestRetry(ctx, d, req, resend, res, cred)
+}
+
+// dialogResend keeps Request-URI and Route of request as built by caller. Dialog transaction
+// appends route set and changes Request-URI in case of strict routing, so they are restored on resend
+type dialogResend struct {
+	recipient sip.Uri
+	routes    []sip.Header
+}
+
+func newDialogResend(req *sip.Request) dialogResend {
+	r := dialogResend{recipient: *req.Recipient.Clone()}
+	for _, h := range req.GetHeaders("Route") {
+		r.routes = append(r.routes, sip.HeaderClone(h))
+	}
+	return r
+}
+
+func (r dialogResend) restore(req *sip.Request) {
+	req.Recipient = *r.recipient.Clone()
+	removeHeaders(req, "Route")
+	for _, h := range r.routes {
+		req.AppendHeader(sip.HeaderClone(h))
+	}
+}
+
+// dialogDigestRetry resends request with credentials as long as response is challenge
+// that can be answered
+func dialogDigestRetry(ctx context.Context, d dialogTransactioner, req *sip.Request, resend dialogResend, res *sip.Response, cred digestCredentials) (*sip.Response, error) {
+	chals := newDigestChallenges(cred)
+	for i := 0; isDigestChallenge(res) && i < maxDigestRetries; i++ {
+		if err := chals.authorize(req, res); err != nil {
+			// Caller gets challenge as response
+			return res, nil
+		}
+
+		// Dialog transaction adds new Via, CSeq and route set
+		req.RemoveHeader("Via")
+		resend.restore(req)
+		var err error
+		res, err = dialogTransactionResponse(ctx, d, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// dialogBye sends BYE and answers challenge with credentials. Rejected BYE still ends dialog
+func dialogBye(ctx context.Context, d dialogTransactioner, bye *sip.Request, writeBye func(ctx context.Context, bye *sip.Request) error, cred digestCredentials) error {
+	resend := newDialogResend(bye)
+	err := writeBye(ctx, bye)
+	var rerr sipgo.ErrDialogResponse
+	if !errors.As(err, &rerr) || !isDigestChallenge(rerr.Res) {
+		return err
+	}
+
+	// Resend same BYE with credentials, so it has remote target and route set of dialog
+	res, err := dialogDigestRetry(ctx, d, bye, resend, rerr.Res, cred)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != sip.StatusOK {
+		return sipgo.ErrDialogResponse{Res: res}
+	}
+	return nil
+}
+
+func dialogTransactionResponse(ctx context.Context, d dialogTransactioner, req *sip.Request) (*sip.Response, error) {
+	tx, err := d.TransactionRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Terminate()
+
+	for {
+		select {
+		case res := <-tx.Responses():
+			if res.IsProvisional() {
+				continue
+			}
+			return res, nil
+		case <-tx.Done():
+			if err := tx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("transaction terminated without final response")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package sipgox
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// testDialogTx answers dialog requests with prepared responses. Like dialog transaction
+// it appends Via and route set, and strict route replaces Request-URI. Request is recorded as sent
+type testDialogTx struct {
+	responses []*sip.Response
+	sent      []*sip.Request
+}
+
+func (d *testDialogTx) TransactionRequest(ctx context.Context, req *sip.Request) (sip.ClientTransaction, error) {
+	req.AppendHeader(sip.NewHeader("Via", "SIP/2.0/UDP 127.0.0.1:5060;branch=z9hG4bK.test"))
+	req.AppendHeader(sip.NewHeader("Route", "<sip:proxy.test;lr>"))
+	req.Recipient = sip.Uri{Scheme: "sip", Host: "proxy.test"}
+	d.sent = append(d.sent, req.Clone())
+
+	tx := &testClientTx{responses: make(chan *sip.Response, 2), done: make(chan struct{})}
+	if len(d.responses) == 0 {
+		// Transaction timeout
+		close(tx.done)
+		return tx, nil
+	}
+	tx.responses <- sip.NewResponse(sip.StatusTrying, "Trying")
+	tx.responses <- d.responses[0]
+	d.responses = d.responses[1:]
+	return tx, nil
+}
+
+type testClientTx struct {
+	sip.ClientTransaction
+	responses chan *sip.Response
+	done      chan struct{}
+}
+
+func (tx *testClientTx) Responses() <-chan *sip.Response { return tx.responses }
+func (tx *testClientTx) Done() <-chan struct{}           { return tx.done }
+func (tx *testClientTx) Err() error                      { return nil }
+func (tx *testClientTx) Terminate()                      {}
+
+func testDigestRequest() *sip.Request {
+	req := sip.NewRequest(sip.INFO, sip.Uri{Scheme: "sip", User: "bob", Host: "example.test"})
+	req.AppendHeader(sip.NewHeader("Route", "<sip:edge.test;lr>"))
+	return req
+}
+
+func testDigestChallenge(code sip.StatusCode, nonce string, stale bool) *sip.Response {
+	name := "WWW-Authenticate"
+	if code == sip.StatusProxyAuthRequired {
+		name = "Proxy-Authenticate"
+	}
+	chal := `Digest realm="example.test", nonce="` + nonce + `", qop="auth", algorithm=MD5`
+	if stale {
+		chal += ", stale=true"
+	}
+	res := sip.NewResponse(code, "")
+	res.AppendHeader(sip.NewHeader(name, chal))
+	return res
+}
+
+func testDigestOK() *sip.Response {
+	return sip.NewResponse(sip.StatusOK, "OK")
+}
+
+func digestHeader(req *sip.Request, name string) string {
+	if h := req.GetHeader(name); h != nil {
+		return h.Value()
+	}
+	return ""
+}
+
+func TestDialogDigestRetry(t *testing.T) {
+	cred := digestCredentials{username: "alice", password: "secret", proxyUsername: "edge", proxyPassword: "proxy"}
+	tests := []struct {
+		name      string
+		cred      digestCredentials
+		responses []*sip.Response
+		status    sip.StatusCode
+		sent      int
+	}{
+		{
+			name:      "uas challenge",
+			cred:      cred,
+			responses: []*sip.Response{testDigestChallenge(sip.StatusUnauthorized, "n1", false), testDigestOK()},
+			status:    sip.StatusOK,
+			sent:      2,
+		},
+		{
+			name: "proxy and uas challenge",
+			cred: cred,
+			responses: []*sip.Response{
+				testDigestChallenge(sip.StatusProxyAuthRequired, "p1", false),
+				testDigestChallenge(sip.StatusUnauthorized, "n1", false),
+				testDigestOK(),
+			},
+			status: sip.StatusOK,
+			sent:   3,
+		},
+		{
+			name: "rejected credentials",
+			cred: cred,
+			responses: []*sip.Response{
+				testDigestChallenge(sip.StatusUnauthorized, "n1", false),
+				testDigestChallenge(sip.StatusUnauthorized, "n2", false),
+			},
+			status: sip.StatusUnauthorized,
+			sent:   2,
+		},
+		{
+			name: "stale nonce",
+			cred: cred,
+			responses: []*sip.Response{
+				testDigestChallenge(sip.StatusUnauthorized, "n1", false),
+				testDigestChallenge(sip.StatusUnauthorized, "n2", true),
+				testDigestOK(),
+			},
+			status: sip.StatusOK,
+			sent:   3,
+		},
+		{
+			name:      "no credentials",
+			responses: []*sip.Response{testDigestChallenge(sip.StatusUnauthorized, "n1", false)},
+			status:    sip.StatusUnauthorized,
+			sent:      1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &testDialogTx{responses: tc.responses}
+			res, err := dialogDo(context.Background(), d, testDigestRequest(), tc.cred)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, res.StatusCode)
+			}
+			if len(d.sent) != tc.sent {
+				t.Fatalf("expected %d requests, got %d", tc.sent, len(d.sent))
+			}
+
+			// Resent request has one Via and Request-URI and Route as built by caller
+			for _, req := range d.sent[1:] {
+				if n := len(req.GetHeaders("Via")); n != 1 {
+					t.Errorf("expected 1 Via, got %d", n)
+				}
+				if routes := req.GetHeaders("Route"); len(routes) != 2 || routes[0].Value() != "<sip:edge.test;lr>" {
+					t.Errorf("route set not restored %v", routes)
+				}
+			}
+		})
+	}
+}
+
+func TestDialogDigestRetryCredentials(t *testing.T) {
+	d := &testDialogTx{responses: []*sip.Response{
+		testDigestChallenge(sip.StatusProxyAuthRequired, "p1", false),
+		testDigestChallenge(sip.StatusUnauthorized, "n1", false),
+		testDigestOK(),
+	}}
+	cred := digestCredentials{username: "alice", password: "secret", proxyUsername: "edge", proxyPassword: "proxy"}
+	if _, err := dialogDo(context.Background(), d, testDigestRequest(), cred); err != nil {
+		t.Fatal(err)
+	}
+
+	// Proxy gets own credentials and its challenge is answered again with next nonce count
+	proxyAuth := digestHeader(d.sent[1], "Proxy-Authorization")
+	if !strings.Contains(proxyAuth, `username="edge"`) || !strings.Contains(proxyAuth, "nc=00000001") {
+		t.Errorf("unexpected proxy authorization %q", proxyAuth)
+	}
+	if auth := digestHeader(d.sent[1], "Authorization"); auth != "" {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+	last := d.sent[2]
+	if proxyAuth := digestHeader(last, "Proxy-Authorization"); !strings.Contains(proxyAuth, "nc=00000002") {
+		t.Errorf("expected increased nonce count, got %q", proxyAuth)
+	}
+	// Digest URI is Request-URI as sent
+	auth := digestHeader(last, "Authorization")
+	if !strings.Contains(auth, `username="alice"`) || !strings.Contains(auth, `nonce="n1"`) || !strings.Contains(auth, `uri="`+last.Recipient.Addr()+`"`) {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+}
+
+func TestDialogDigestRetryNoFinalResponse(t *testing.T) {
+	d := &testDialogTx{responses: []*sip.Response{testDigestChallenge(sip.StatusUnauthorized, "n1", false)}}
+	cred := digestCredentials{username: "alice", password: "secret"}
+	if res, err := dialogDo(context.Background(), d, testDigestRequest(), cred); err == nil {
+		t.Fatalf("expected error, got response %v", res)
+	}
+}
@@ -0,0 +1,245 @@
+package sipgox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/rs/zerolog"
+)
+
+// Forked answers. Proxy can fork our INVITE and more UAS can answer it with 2xx of different
+// To tag. Dialog cache only knows first one, so others are caught on transport and they are
+// ACKed and hung up, unless application keeps them.
+// https://datatracker.ietf.org/doc/html/rfc3261#section-13.2.2.4
+
+// ForkedAnswer is 2xx of other fork received after INVITE was answered. It is already ACKed
+type ForkedAnswer struct {
+	InviteRequest  *sip.Request
+	InviteResponse *sip.Response
+
+	client *sipgo.Client
+	cred   digestCredentials
+}
+
+// Hangup terminates forked call with BYE
+func (f *ForkedAnswer) Hangup(ctx context.Context) error {
+	bye := sip.NewAckRequest(f.InviteRequest, f.InviteResponse, nil)
+	bye.Method = sip.BYE
+
+	res, err := dialogDo(ctx, &forkTransactioner{client: f.client}, bye, f.cred)
+	if err != nil {
+		return err
+	}
+	if !res.IsSuccess() {
+		return &DialResponseError{InviteReq: bye, InviteResp: res, Msg: "BYE not accepted: " + res.StartLine()}
+	}
+	return nil
+}
+
+// forkTransactioner sends requests of forked dialog with client. Request already has route set
+type forkTransactioner struct {
+	client *sipgo.Client
+}
+
+func (t *forkTransactioner) TransactionRequest(ctx context.Context, req *sip.Request) (sip.ClientTransaction, error) {
+	return t.client.TransactionRequest(ctx, req)
+}
+
+// forkTracker watches 2xx responses of our INVITEs on transport by Call-ID and From tag.
+// Transport handler can not be removed, so there is one tracker per user agent shared by
+// its phones
+type forkTracker struct {
+	mu    sync.Mutex
+	calls map[string]*forkedCall
+}
+
+var (
+	uaForksMu sync.Mutex
+	uaForks   = make(map[*sipgo.UserAgent]*forkTracker)
+)
+
+// uaForkTracker returns tracker of user agent. Handler is added on transport on first use
+func uaForkTracker(ua *sipgo.UserAgent) *forkTracker {
+	uaForksMu.Lock()
+	defer uaForksMu.Unlock()
+	t, exists := uaForks[ua]
+	if !exists {
+		t = &forkTracker{calls: make(map[string]*forkedCall)}
+		uaForks[ua] = t
+		ua.TransportLayer().OnMessage(t.onMessage)
+	}
+	return t
+}
+
+type forkedCall struct {
+	invite *sip.Request
+	// toTag of answered dialog. Empty while waiting answer
+	toTag string
+	// pending are 2xx received before answer is known
+	pending []*sip.Response
+	// acks are sent ACKs by fork tag for 2xx retransmissions
+	acks   map[string]*sip.Request
+	client *sipgo.Client
+	handle func(res *sip.Response)
+	log    zerolog.Logger
+}
+
+func forkKey(m sip.Message) string {
+	callid, from := m.CallID(), m.From()
+	if callid == nil || from == nil {
+		return ""
+	}
+	tag, _ := from.Params.Get("tag")
+	return callid.Value() + ";" + tag
+}
+
+func responseToTag(res *sip.Response) string {
+	to := res.To()
+	if to == nil {
+		return ""
+	}
+	tag, _ := to.Params.Get("tag")
+	return tag
+}
+
+// watchForks starts tracking INVITE sent by client. It is called for each sent INVITE of call
+// as CSeq and Via change with authorization
+func (p *Phone) watchForks(client *sipgo.Client, invite *sip.Request) string {
+	t := p.forks
+	key := forkKey(invite)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls[key] = &forkedCall{
+		invite: invite.Clone(),
+		acks:   make(map[string]*sip.Request),
+		client: client,
+		log:    p.log,
+	}
+	return key
+}
+
+// unwatchForks stops tracking of failed call
+func (p *Phone) unwatchForks(key string) {
+	p.forks.mu.Lock()
+	defer p.forks.mu.Unlock()
+	delete(p.forks.calls, key)
+}
+
+// answeredForks sets dialog which answered call. Other 2xx received until Timer M are forks
+func (p *Phone) answeredForks(key string, toTag string, o DialOptions) {
+	t := p.forks
+	t.mu.Lock()
+	c, exists := t.calls[key]
+	if !exists {
+		t.mu.Unlock()
+		return
+	}
+	c.toTag = toTag
+	c.handle = func(res *sip.Response) {
+		p.handleForkedAnswer(c, res, o)
+	}
+	var forks []*sip.Response
+	for _, res := range c.pending {
+		tag := responseToTag(res)
+		if _, exists := c.acks[tag]; exists || tag == toTag {
+			continue
+		}
+		c.acks[tag] = nil
+		forks = append(forks, res)
+	}
+	c.pending = nil
+	t.mu.Unlock()
+
+	for _, res := range forks {
+		go c.handle(res)
+	}
+
+	time.AfterFunc(sip.Timer_M, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.calls[key] == c {
+			delete(t.calls, key)
+		}
+	})
+}
+
+// onMessage is called on transport for every message so it must not block
+func (t *forkTracker) onMessage(msg sip.Message) {
+	res, ok := msg.(*sip.Response)
+	if !ok || !res.IsSuccess() {
+		return
+	}
+	cseq := res.CSeq()
+	if cseq == nil || cseq.MethodName != sip.INVITE {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, exists := t.calls[forkKey(res)]
+	if !exists || cseq.SeqNo != c.invite.CSeq().SeqNo {
+		return
+	}
+
+	tag := responseToTag(res)
+	if c.toTag == "" {
+		c.pending = append(c.pending, res)
+		return
+	}
+	if tag == c.toTag {
+		return
+	}
+
+	if ack, exists := c.acks[tag]; exists {
+		// Retransmission of forked 2xx, our ACK was lost. Nil ACK is not sent yet
+		if ack == nil {
+			return
+		}
+		if err := c.client.WriteRequest(ack); err != nil {
+			c.log.Error().Err(err).Msg("Failed to resend ACK of forked answer")
+		}
+		return
+	}
+	c.acks[tag] = nil
+	go c.handle(res)
+}
+
+func (p *Phone) handleForkedAnswer(c *forkedCall, res *sip.Response, o DialOptions) {
+	log := p.log.With().Str("caller", "Dial").Str("to_tag", responseToTag(res)).Logger()
+	log.Info().Msg("Forked INVITE answered by other UAS")
+
+	invite := c.invite
+	if len(res.GetHeaders("Record-Route")) > 0 {
+		// Route set of fork is its Record-Route
+		invite = c.invite.Clone()
+		removeHeaders(invite, "Route")
+	}
+	ack := sip.NewAckRequest(invite, res, nil)
+	if err := c.client.WriteRequest(ack); err != nil {
+		log.Error().Err(err).Msg("Failed to ACK forked answer")
+	}
+	p.forks.mu.Lock()
+	c.acks[responseToTag(res)] = ack
+	p.forks.mu.Unlock()
+
+	fork := &ForkedAnswer{
+		InviteRequest:  invite,
+		InviteResponse: res,
+		client:         c.client,
+		cred:           o.credentials(),
+	}
+	if o.OnForkedAnswer != nil && o.OnForkedAnswer(fork) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := fork.Hangup(ctx); err != nil {
+		log.Error().Err(err).Msg("Failed to hang up forked answer")
+		return
+	}
+	log.Info().Msg("Forked answer hung up")
+}
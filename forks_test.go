@@ -0,0 +1,52 @@
+package sipgox
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestDialForkedAnswer(t *testing.T) {
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		// Proxy forked INVITE and both UAS answered
+		"fork": func(inv *testInvite) {
+			inv.respond(sip.StatusOK, "first")
+			// Responses are handled concurrently, so first must be handled first
+			time.Sleep(50 * time.Millisecond)
+			inv.respond(sip.StatusOK, "second")
+		},
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialog, err := p.Dial(ctx, uas.uri("fork"), DialOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialog.Close()
+	if tag := responseToTag(dialog.InviteResponse); tag != "first" {
+		t.Fatalf("expected dialog of first answer, got %q", tag)
+	}
+
+	uas.waitRequest(t, "fork", sip.ACK, "first")
+	// Other fork is ACKed and then hung up
+	uas.waitRequest(t, "fork", sip.ACK, "second")
+	uas.waitRequest(t, "fork", sip.BYE, "second")
+	if uas.hasRequest("fork", sip.BYE, "first") {
+		t.Error("answered dialog must not be hung up")
+	}
+}
+
+func TestForkTrackerSharedByUA(t *testing.T) {
+	p := newTestPhone(t)
+	other := NewPhone(p.UA)
+	if p.forks != other.forks {
+		t.Error("phones of same user agent must share fork tracker")
+	}
+	if newTestPhone(t).forks == p.forks {
+		t.Error("phones of other user agent must not share fork tracker")
+	}
+}
@@ -0,0 +1,110 @@
+package sipgox
+
+import "math/bits"
+
+// G.711 u-law and A-law codecs for 16 bit linear PCM, as in reference implementation of
+// ITU-T G.711 (Sun Microsystems g711.c)
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+func ulawEncode(s int16) uint8 {
+	pcm := int(s)
+	sign := 0
+	if pcm < 0 {
+		pcm = -pcm
+		sign = 0x80
+	}
+	pcm = min(pcm, ulawClip) + ulawBias
+
+	exp := max(bits.Len(uint(pcm>>7)&0xFF)-1, 0)
+	mantissa := (pcm >> (exp + 3)) & 0x0F
+	return ^uint8(sign | exp<<4 | mantissa)
+}
+
+func ulawDecode(u uint8) int16 {
+	u = ^u
+	t := (int(u&0x0F) << 3) + ulawBias
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(ulawBias - t)
+	}
+	return int16(t - ulawBias)
+}
+
+// alawSegEnd are segment ends of 13 bit magnitude
+var alawSegEnd = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+
+func alawEncode(s int16) uint8 {
+	pcm := int(s) >> 3
+	mask := 0xD5
+	if pcm < 0 {
+		mask = 0x55
+		pcm = -pcm - 1
+	}
+
+	seg := 0
+	for seg < len(alawSegEnd) && pcm > alawSegEnd[seg] {
+		seg++
+	}
+	if seg >= len(alawSegEnd) {
+		return uint8(0x7F ^ mask)
+	}
+
+	aval := seg << 4
+	if seg < 2 {
+		aval |= (pcm >> 1) & 0x0F
+	} else {
+		aval |= (pcm >> seg) & 0x0F
+	}
+	return uint8(aval ^ mask)
+}
+
+func alawDecode(a uint8) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch seg := int(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// g711Decode appends decoded payload of payload type 0 (PCMU) or 8 (PCMA)
+func g711Decode(pcm []int16, pt uint8, payload []byte) ([]int16, bool) {
+	var decode func(uint8) int16
+	switch pt {
+	case 0:
+		decode = ulawDecode
+	case 8:
+		decode = alawDecode
+	default:
+		return pcm, false
+	}
+	for _, b := range payload {
+		pcm = append(pcm, decode(b))
+	}
+	return pcm, true
+}
+
+// g711Encode appends encoded samples with payload type 0 (PCMU) or 8 (PCMA)
+func g711Encode(payload []byte, pt uint8, pcm []int16) []byte {
+	encode := ulawEncode
+	if pt == 8 {
+		encode = alawEncode
+	}
+	for _, s := range pcm {
+		payload = append(payload, encode(s))
+	}
+	return payload
+}
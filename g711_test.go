@@ -0,0 +1,87 @@
+package sipgox
+
+import (
+	"testing"
+)
+
+func TestG711Encode(t *testing.T) {
+	tests := []struct {
+		pcm  int16
+		ulaw uint8
+		alaw uint8
+	}{
+		{0, 0xFF, 0xD5},
+		{-1, 0x7F, 0x55},
+		{100, 0xF2, 0xD3},
+		{-100, 0x72, 0x53},
+		{1000, 0xCE, 0xFA},
+		{-1000, 0x4E, 0x7A},
+		{32767, 0x80, 0xAA},
+		{-32768, 0x00, 0x2A},
+	}
+	for _, tc := range tests {
+		if got := ulawEncode(tc.pcm); got != tc.ulaw {
+			t.Errorf("ulaw encode %d: expected %#02x, got %#02x", tc.pcm, tc.ulaw, got)
+		}
+		if got := alawEncode(tc.pcm); got != tc.alaw {
+			t.Errorf("alaw encode %d: expected %#02x, got %#02x", tc.pcm, tc.alaw, got)
+		}
+	}
+}
+
+func TestG711Decode(t *testing.T) {
+	tests := []struct {
+		name string
+		code uint8
+		pcm  int16
+		dec  func(uint8) int16
+	}{
+		{"ulaw zero", 0xFF, 0, ulawDecode},
+		{"ulaw max", 0x80, 32124, ulawDecode},
+		{"ulaw min", 0x00, -32124, ulawDecode},
+		{"ulaw segment", 0x9F, 8316, ulawDecode},
+		{"alaw zero", 0xD5, 8, alawDecode},
+		{"alaw negative zero", 0x55, -8, alawDecode},
+		{"alaw max", 0xAA, 32256, alawDecode},
+		{"alaw min", 0x2A, -32256, alawDecode},
+	}
+	for _, tc := range tests {
+		if got := tc.dec(tc.code); got != tc.pcm {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.pcm, got)
+		}
+	}
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		pt   uint8
+	}{
+		{"PCMU", 0},
+		{"PCMA", 8},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for s := -32768; s <= 32767; s += 7 {
+				pcm, ok := g711Decode(nil, tc.pt, g711Encode(nil, tc.pt, []int16{int16(s)}))
+				if !ok || len(pcm) != 1 {
+					t.Fatalf("decode failed for %d", s)
+				}
+				// Quantization step is 1/16 of segment, so error is within 1/16 of value
+				// besides smallest segment and clipping
+				diff := max(int(pcm[0])-s, s-int(pcm[0]))
+				if diff > max(abs(s)/16, 16) && abs(s) < 32124 {
+					t.Fatalf("sample %d decoded as %d", s, pcm[0])
+				}
+			}
+		})
+	}
+
+	if _, ok := g711Decode(nil, 101, []byte{1, 2}); ok {
+		t.Error("expected decode of other payload type to fail")
+	}
+}
+
+func abs(v int) int {
+	return max(v, -v)
+}
@@ -6,8 +6,12 @@ require (
 	github.com/emiago/media v0.1.1-0.20240619212740-bf8c5574162c
 	github.com/emiago/sipgo v0.24.2-0.20241017070934-7bd3a587de42
 	github.com/icholy/digest v0.1.22
+	github.com/pion/rtcp v1.2.14
 	github.com/pion/rtp v1.8.9
+	github.com/pion/srtp/v3 v3.0.4
+	github.com/pion/stun/v3 v3.0.0
 	github.com/rs/zerolog v1.33.0
+	golang.org/x/net v0.27.0
 )
 
 require (
@@ -17,8 +21,12 @@ require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/pion/dtls/v3 v3.0.1 // indirect
+	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.14 // indirect
+	github.com/pion/transport/v3 v3.0.7 // indirect
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b // indirect
+	github.com/wlynxg/anet v0.0.3 // indirect
+	golang.org/x/crypto v0.25.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
 )
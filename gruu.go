@@ -0,0 +1,94 @@
+package sipgox
+
+import (
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// GRUU. Registrar assigns globally routable uri to our instance which we use as Contact
+// in dialogs so that other side can reach us, for example on transfer
+// https://datatracker.ietf.org/doc/html/rfc5627
+
+// contactGRUU returns pub-gruu and temp-gruu of registered contact with our instance id.
+// Contact without +sip.instance is also accepted as some registrars do not echo it
+// https://datatracker.ietf.org/doc/html/rfc5627#section-5.2
+func contactGRUU(res *sip.Response, instanceID string) (pub *sip.Uri, temp *sip.Uri) {
+	instance := `"<` + instanceURN(instanceID) + `>"`
+	for _, c := range responseContacts(res) {
+		if c.Params == nil {
+			continue
+		}
+		if inst, ok := c.Params.Get("+sip.instance"); ok && !strings.EqualFold(inst, instance) {
+			continue
+		}
+		if v, ok := gruuParam(c.Params, "pub-gruu"); ok {
+			pub = parseGRUU(v, instanceURN(instanceID))
+		}
+		if v, ok := gruuParam(c.Params, "temp-gruu"); ok {
+			temp = parseGRUU(v, "")
+		}
+		if pub != nil || temp != nil {
+			return pub, temp
+		}
+	}
+	return nil, nil
+}
+
+// responseContacts returns all Contact addresses of response
+func responseContacts(res *sip.Response) []sip.ContactHeader {
+	var contacts []sip.ContactHeader
+	for _, h := range res.GetHeaders("Contact") {
+		if c, ok := h.(*sip.ContactHeader); ok {
+			contacts = append(contacts, *c)
+			continue
+		}
+		for _, v := range splitAddressList(h.Value()) {
+			c := sip.ContactHeader{Params: sip.NewParams()}
+			if _, err := sip.ParseAddressValue(v, &c.Address, c.Params); err != nil {
+				continue
+			}
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts
+}
+
+// gruuParam returns unquoted gruu param. sipgo splits header params on every ';' even inside
+// quotes, so value is only part up to first uri param and can be split on '=' as well.
+// Empty value is same as missing
+func gruuParam(params sip.HeaderParams, name string) (string, bool) {
+	for k, v := range params {
+		if k != name && !strings.HasPrefix(k, name+"=") {
+			continue
+		}
+		v = strings.Trim(strings.TrimPrefix(k+"="+v, name+"="), `"`)
+		return v, v != ""
+	}
+	return "", false
+}
+
+// parseGRUU parses gruu and adds gr param if it was lost. Public GRUU is AOR with gr
+// set to instance id and temporary GRUU has gr without value
+// https://datatracker.ietf.org/doc/html/rfc5627#section-3
+func parseGRUU(v string, gr string) *sip.Uri {
+	var uri sip.Uri
+	if err := sip.ParseUri(v, &uri); err != nil {
+		return nil
+	}
+	if uri.UriParams == nil {
+		uri.UriParams = sip.NewParams()
+	}
+	if !uri.UriParams.Has("gr") {
+		uri.UriParams.Add("gr", gr)
+	}
+	return &uri
+}
+
+// gruu returns GRUU to use as Contact. Public GRUU is preferred
+func (t *RegisterTransaction) gruu() *sip.Uri {
+	if pub := t.PublicGRUU(); pub != nil {
+		return pub
+	}
+	return t.TempGRUU()
+}
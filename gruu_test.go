@@ -0,0 +1,87 @@
+package sipgox
+
+import (
+	"testing"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+func TestGRUUParam(t *testing.T) {
+	tests := []struct {
+		contact string
+		name    string
+		value   string
+		found   bool
+	}{
+		{
+			contact: `<sip:alice@10.0.0.1>;pub-gruu="sip:alice@example.com;gr=urn:uuid:f81d4fae";expires=3600`,
+			name:    "pub-gruu",
+			value:   "sip:alice@example.com",
+			found:   true,
+		},
+		{
+			contact: `<sip:alice@10.0.0.1>;temp-gruu="sip:tgruu.7hs==jd7vnzga5w7fajsc7-ajd6fabz0f8g5@example.com;gr";expires=3600`,
+			name:    "temp-gruu",
+			value:   "sip:tgruu.7hs==jd7vnzga5w7fajsc7-ajd6fabz0f8g5@example.com",
+			found:   true,
+		},
+		{
+			contact: `<sip:alice@10.0.0.1>;temp-gruu="sip:a=b@example.com;gr";pub-gruu="sip:alice@example.com;gr=urn:uuid:f81d4fae"`,
+			name:    "temp-gruu",
+			value:   "sip:a=b@example.com",
+			found:   true,
+		},
+		{
+			contact: `<sip:alice@10.0.0.1>;temp-gruu="sip:a=b@example.com;gr";pub-gruu="sip:alice@example.com;gr=urn:uuid:f81d4fae"`,
+			name:    "pub-gruu",
+			value:   "sip:alice@example.com",
+			found:   true,
+		},
+		{
+			contact: `<sip:alice@10.0.0.1>;pub-gruu="sip:alice@example.com";expires=3600`,
+			name:    "pub-gruu",
+			value:   "sip:alice@example.com",
+			found:   true,
+		},
+		{contact: `<sip:alice@10.0.0.1>;pub-gruu="";expires=3600`, name: "pub-gruu"},
+		{contact: `<sip:alice@10.0.0.1>;pub-gruu;expires=3600`, name: "pub-gruu"},
+		{contact: `<sip:alice@10.0.0.1>;expires=3600`, name: "pub-gruu"},
+		{contact: `<sip:alice@10.0.0.1>;pub-gruu="sip:alice@example.com;gr=x"`, name: "temp-gruu"},
+	}
+	for _, tc := range tests {
+		var uri sip.Uri
+		params := sip.NewParams()
+		if _, err := sip.ParseAddressValue(tc.contact, &uri, params); err != nil {
+			t.Fatal(err)
+		}
+		v, found := gruuParam(params, tc.name)
+		if v != tc.value || found != tc.found {
+			t.Errorf("%s of %s: expected %q %v, got %q %v", tc.name, tc.contact, tc.value, tc.found, v, found)
+		}
+	}
+}
+
+func TestContactGRUU(t *testing.T) {
+	instanceID := "f81d4fae-7dec-11d0-a765-00a0c91e6bf6"
+	res := sip.NewResponse(sip.StatusOK, "OK")
+	res.AppendHeader(sip.NewHeader("Contact", `<sip:alice@10.0.0.1>;+sip.instance="<urn:uuid:`+instanceID+`>"`+
+		`;pub-gruu="sip:alice@example.com;gr=urn:uuid:`+instanceID+`"`+
+		`;temp-gruu="sip:tgruu.7hs==jd7@example.com;gr";expires=3600`))
+
+	pub, temp := contactGRUU(res, instanceID)
+	if pub == nil || temp == nil {
+		t.Fatalf("expected both GRUUs, got %v %v", pub, temp)
+	}
+	// gr param lost by parsing is restored
+	if gr, _ := pub.UriParams.Get("gr"); pub.User != "alice" || gr != "urn:uuid:"+instanceID {
+		t.Errorf("unexpected public GRUU %s", pub.String())
+	}
+	if !temp.UriParams.Has("gr") || temp.User != "tgruu.7hs==jd7" {
+		t.Errorf("unexpected temporary GRUU %s", temp.String())
+	}
+
+	// Contact of other instance is not ours
+	if pub, temp := contactGRUU(res, "other"); pub != nil || temp != nil {
+		t.Errorf("expected no GRUU of other instance, got %v %v", pub, temp)
+	}
+}
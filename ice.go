@@ -0,0 +1,195 @@
+package sipgox
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pion/stun/v3"
+)
+
+// ICE-lite implementation. We only gather host and server reflexive candidates
+// and respond on connectivity checks. Controlling agent on other side does checks and nomination
+// https://datatracker.ietf.org/doc/html/rfc8445#section-2.5
+
+const (
+	iceComponentRTP  = 1
+	iceComponentRTCP = 2
+
+	iceTypePrefHost  = 126
+	iceTypePrefSrflx = 100
+)
+
+// ICEPair is selected candidate pair of RTP component
+type ICEPair struct {
+	Local  *net.UDPAddr
+	Remote *net.UDPAddr
+}
+
+func (p ICEPair) String() string {
+	return p.Local.String() + " <-> " + p.Remote.String()
+}
+
+type iceCandidate struct {
+	component int
+	typ       string
+	addr      *net.UDPAddr
+	// related address for srflx
+	raddr *net.UDPAddr
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8445#section-5.1.2.1
+func (c iceCandidate) priority() uint32 {
+	typePref := iceTypePrefHost
+	if c.typ == "srflx" {
+		typePref = iceTypePrefSrflx
+	}
+	return uint32(typePref)<<24 | uint32(65535)<<8 | uint32(256-c.component)
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8839#section-5.1
+func (c iceCandidate) String() string {
+	foundation := "1"
+	if c.typ == "srflx" {
+		foundation = "2"
+	}
+	s := fmt.Sprintf("%s %d UDP %d %s %d typ %s", foundation, c.component, c.priority(), c.addr.IP, c.addr.Port, c.typ)
+	if c.raddr != nil {
+		s += fmt.Sprintf(" raddr %s rport %d", c.raddr.IP, c.raddr.Port)
+	}
+	return s
+}
+
+// iceCandidates returns host and server reflexive candidates of RTP and RTCP component
+func iceCandidates(laddr *net.UDPAddr, mapping *stunMapping) []iceCandidate {
+	rtcpAddr := &net.UDPAddr{IP: laddr.IP, Port: laddr.Port + 1}
+	cands := []iceCandidate{
+		{component: iceComponentRTP, typ: "host", addr: laddr},
+		{component: iceComponentRTCP, typ: "host", addr: rtcpAddr},
+	}
+	if mapping == nil {
+		return cands
+	}
+
+	if !mapping.rtp.IP.Equal(laddr.IP) || mapping.rtp.Port != laddr.Port {
+		cands = append(cands, iceCandidate{component: iceComponentRTP, typ: "srflx", addr: mapping.rtp, raddr: laddr})
+	}
+	if mapping.rtcp != nil && (!mapping.rtcp.IP.Equal(rtcpAddr.IP) || mapping.rtcp.Port != rtcpAddr.Port) {
+		cands = append(cands, iceCandidate{component: iceComponentRTCP, typ: "srflx", addr: mapping.rtcp, raddr: rtcpAddr})
+	}
+	return cands
+}
+
+// iceLite holds our credentials and answers connectivity checks
+type iceLite struct {
+	ufrag string
+	pwd   string
+
+	mu       sync.Mutex
+	selected *ICEPair
+}
+
+const iceChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789+/"
+
+func iceRandString(n int) (string, error) {
+	b := make([]byte, n)
+	limit := big.NewInt(int64(len(iceChars)))
+	for i := range b {
+		r, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		b[i] = iceChars[r.Int64()]
+	}
+	return string(b), nil
+}
+
+// iceLiteOffer adds ICE-lite credentials and candidates to SDP
+func iceLiteOffer(body []byte, candidates []iceCandidate) ([]byte, error) {
+	ufrag, err := iceRandString(8)
+	if err != nil {
+		return nil, err
+	}
+	pwd, err := iceRandString(24)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []string{"ice-ufrag:" + ufrag, "ice-pwd:" + pwd}
+	for _, c := range candidates {
+		attrs = append(attrs, "candidate:"+c.String())
+	}
+	body = sdpInsertSessionAttributes(body, "ice-lite")
+	return sdpAppendAttributes(body, attrs...), nil
+}
+
+// iceLiteFromSDP returns our ICE agent based on credentials we have put in SDP.
+// It returns nil if SDP has no ICE
+func iceLiteFromSDP(body []byte) *iceLite {
+	ufrag, pwd := sdpAttributes(body, "ice-ufrag"), sdpAttributes(body, "ice-pwd")
+	if len(ufrag) == 0 || len(pwd) == 0 {
+		return nil
+	}
+	return &iceLite{ufrag: ufrag[0], pwd: pwd[0]}
+}
+
+// sdpHasICE checks does remote SDP have ICE credentials
+func sdpHasICE(body []byte) bool {
+	return len(sdpAttributes(body, "ice-ufrag")) > 0
+}
+
+// selectedPair returns nominated pair of RTP component
+func (i *iceLite) selectedPair() *ICEPair {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.selected
+}
+
+// handleSTUN answers connectivity check received on conn. It returns true if
+// remote has nominated this pair
+func (i *iceLite) handleSTUN(conn net.PacketConn, data []byte, src *net.UDPAddr, component int) (nominated bool, err error) {
+	req := &stun.Message{Raw: append([]byte{}, data...)}
+	if err := req.Decode(); err != nil {
+		return false, err
+	}
+	if req.Type != stun.BindingRequest {
+		// Could be indication or response, nothing to do as lite agent
+		return false, nil
+	}
+
+	var user stun.Username
+	if err := user.GetFrom(req); err != nil {
+		return false, fmt.Errorf("connectivity check without username: %w", err)
+	}
+	if !strings.HasPrefix(user.String(), i.ufrag+":") {
+		return false, fmt.Errorf("connectivity check username %q does not match", user.String())
+	}
+
+	integrity := stun.NewShortTermIntegrity(i.pwd)
+	if err := integrity.Check(req); err != nil {
+		return false, fmt.Errorf("connectivity check integrity: %w", err)
+	}
+
+	res, err := stunBindingResponse(req, src, integrity)
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.WriteTo(res.Raw, src); err != nil {
+		return false, err
+	}
+
+	if !req.Contains(stun.AttrUseCandidate) {
+		return false, nil
+	}
+
+	if component == iceComponentRTP {
+		laddr, _ := conn.LocalAddr().(*net.UDPAddr)
+		i.mu.Lock()
+		i.selected = &ICEPair{Local: laddr, Remote: src}
+		i.mu.Unlock()
+	}
+	return true, nil
+}
@@ -0,0 +1,362 @@
+package sipgox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	// ErrJitterBufferGap is returned by JitterBuffer.ReadRTP when packet did not arrive before its playout time.
+	// Packet header is filled with expected sequence number and timestamp, payload is empty
+	// so caller can apply loss concealment.
+	ErrJitterBufferGap = fmt.Errorf("jitter buffer gap")
+)
+
+// RTPReader is implemented by dialog sessions and media.MediaSession
+type RTPReader interface {
+	ReadRTP(buf []byte, pkt *rtp.Packet) error
+}
+
+type JitterBufferOptions struct {
+	// MinDelay is lowest playout delay. Default 20ms
+	MinDelay time.Duration
+	// MaxDelay is highest playout delay buffer will adapt to. Default 200ms
+	MaxDelay time.Duration
+	// ClockRate of RTP timestamps. Default 8000
+	ClockRate uint32
+	// MaxPackets is buffer capacity. On overflow oldest packets are dropped. Default 50
+	MaxPackets int
+}
+
+type JitterBufferStats struct {
+	PacketsReceived  uint64
+	PacketsPlayed    uint64
+	PacketsReordered uint64
+	PacketsDuplicate uint64
+	// PacketsLate are dropped as they arrived after their playout time
+	PacketsLate uint64
+	// PacketsLost are gaps signaled with ErrJitterBufferGap
+	PacketsLost     uint64
+	PacketsOverflow uint64
+
+	// Jitter is interarrival jitter estimate (RFC 3550)
+	Jitter time.Duration
+	// Delay is current playout delay
+	Delay    time.Duration
+	Buffered int
+}
+
+type jitterPacket struct {
+	pkt     *rtp.Packet
+	seq     int64 // extended sequence number
+	arrival time.Time
+}
+
+// JitterBuffer reorders RTP packets by sequence number and plays them out with delay adapted
+// to measured jitter. Reading of underlying reader starts in background on creation
+// and JitterBuffer must be used as only reader of it.
+//
+// Playout delay is adapted on each talkspurt (marker bit) or after buffer underrun.
+type JitterBuffer struct {
+	src  RTPReader
+	opts JitterBufferOptions
+
+	mu      sync.Mutex
+	packets []jitterPacket // sorted by seq
+	notify  chan struct{}
+	done    chan struct{}
+	err     error
+	stats   JitterBufferStats
+
+	// receiving side
+	highestSeq  int64
+	lastArrival time.Time
+	lastArrTS   uint32
+	jitter      float64 // in seconds
+	delay       time.Duration
+
+	// playout side
+	started    bool
+	nextSeq    int64
+	lastSeq    int64
+	lastTS     uint32
+	lastHeader rtp.Header
+	baseTime   time.Time
+	baseTS     uint32
+	reanchor   bool
+	anchorSeq  int64
+}
+
+// NewJitterBuffer creates jitter buffer on top of reader, normally dialog session
+func NewJitterBuffer(src RTPReader, opts JitterBufferOptions) *JitterBuffer {
+	if opts.MinDelay <= 0 {
+		opts.MinDelay = 20 * time.Millisecond
+	}
+	if opts.MaxDelay < opts.MinDelay {
+		opts.MaxDelay = max(200*time.Millisecond, opts.MinDelay)
+	}
+	if opts.ClockRate == 0 {
+		opts.ClockRate = 8000
+	}
+	if opts.MaxPackets <= 0 {
+		opts.MaxPackets = 50
+	}
+
+	jb := &JitterBuffer{
+		src:     src,
+		opts:    opts,
+		packets: make([]jitterPacket, 0, opts.MaxPackets),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		delay:   opts.MinDelay,
+	}
+	go jb.readLoop()
+	return jb
+}
+
+// Close stops playout. Underlying reader must be closed by caller
+func (jb *JitterBuffer) Close() error {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	select {
+	case <-jb.done:
+	default:
+		close(jb.done)
+	}
+	return nil
+}
+
+// Stats returns current buffer statistics
+func (jb *JitterBuffer) Stats() JitterBufferStats {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	s := jb.stats
+	s.Jitter = time.Duration(jb.jitter * float64(time.Second))
+	s.Delay = jb.delay
+	s.Buffered = len(jb.packets)
+	return s
+}
+
+func (jb *JitterBuffer) readLoop() {
+	for {
+		buf := make([]byte, 1600)
+		pkt := rtp.Packet{}
+		if err := jb.src.ReadRTP(buf, &pkt); err != nil {
+			jb.mu.Lock()
+			jb.err = err
+			jb.mu.Unlock()
+			jb.wakeup()
+			return
+		}
+
+		select {
+		case <-jb.done:
+			return
+		default:
+		}
+
+		jb.push(&pkt, time.Now())
+		jb.wakeup()
+	}
+}
+
+func (jb *JitterBuffer) wakeup() {
+	select {
+	case jb.notify <- struct{}{}:
+	default:
+	}
+}
+
+// extendSeq unwraps sequence number closest to highest received
+func extendSeq(highest int64, seq uint16) int64 {
+	delta := int16(seq - uint16(highest))
+	return highest + int64(delta)
+}
+
+func (jb *JitterBuffer) push(pkt *rtp.Packet, now time.Time) {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+
+	jb.stats.PacketsReceived++
+	var seq int64
+	if jb.stats.PacketsReceived == 1 {
+		seq = int64(pkt.SequenceNumber)
+		jb.highestSeq = seq
+	} else {
+		seq = extendSeq(jb.highestSeq, pkt.SequenceNumber)
+		if seq > jb.highestSeq {
+			jb.updateJitter(pkt.Timestamp, now)
+			jb.highestSeq = seq
+		} else {
+			jb.stats.PacketsReordered++
+		}
+	}
+	if jb.lastArrival.IsZero() {
+		jb.lastArrival, jb.lastArrTS = now, pkt.Timestamp
+	}
+
+	if jb.started && seq < jb.nextSeq {
+		jb.stats.PacketsLate++
+		return
+	}
+
+	// Insert sorted. Mostly packets come in order so search from back
+	i := len(jb.packets)
+	for i > 0 && jb.packets[i-1].seq > seq {
+		i--
+	}
+	if i > 0 && jb.packets[i-1].seq == seq {
+		jb.stats.PacketsDuplicate++
+		return
+	}
+
+	jb.packets = append(jb.packets, jitterPacket{})
+	copy(jb.packets[i+1:], jb.packets[i:])
+	jb.packets[i] = jitterPacket{pkt: pkt, seq: seq, arrival: now}
+
+	if len(jb.packets) > jb.opts.MaxPackets {
+		// Drop oldest and continue from next one
+		jb.stats.PacketsOverflow++
+		jb.packets = jb.packets[1:]
+		if jb.started && jb.packets[0].seq > jb.nextSeq {
+			jb.nextSeq = jb.packets[0].seq
+			jb.reanchor = true
+		}
+	}
+
+	if !jb.started {
+		jb.reanchor = true
+	}
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3550#appendix-A.8
+func (jb *JitterBuffer) updateJitter(ts uint32, now time.Time) {
+	rate := float64(jb.opts.ClockRate)
+	d := now.Sub(jb.lastArrival).Seconds() - float64(int32(ts-jb.lastArrTS))/rate
+	if d < 0 {
+		d = -d
+	}
+	jb.jitter += (d - jb.jitter) / 16
+	jb.lastArrival, jb.lastArrTS = now, ts
+
+	delay := jb.opts.MinDelay + time.Duration(3*jb.jitter*float64(time.Second))
+	jb.delay = min(delay, jb.opts.MaxDelay)
+}
+
+func (jb *JitterBuffer) playoutTime(ts uint32) time.Time {
+	diff := float64(int32(ts-jb.baseTS)) / float64(jb.opts.ClockRate)
+	return jb.baseTime.Add(time.Duration(diff * float64(time.Second)))
+}
+
+// ReadRTP blocks until next packet is due for playout.
+// It returns ErrJitterBufferGap in case packet is missing and pkt holds only header of missing packet
+func (jb *JitterBuffer) ReadRTP(buf []byte, pkt *rtp.Packet) error {
+	for {
+		jb.mu.Lock()
+		wait, err := jb.next(pkt, time.Now())
+		jb.mu.Unlock()
+		if wait == 0 {
+			return err
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-jb.notify:
+		case <-timeout:
+		case <-jb.done:
+			err = fmt.Errorf("jitter buffer closed")
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// next returns 0 wait when pkt is filled or err is returned
+// negative wait means waiting for new packets
+func (jb *JitterBuffer) next(pkt *rtp.Packet, now time.Time) (time.Duration, error) {
+	if len(jb.packets) == 0 {
+		if jb.err != nil {
+			return 0, jb.err
+		}
+		// Underrun, delay must be applied again on next packet
+		jb.reanchor = true
+		return -1, nil
+	}
+
+	head := jb.packets[0]
+	if !jb.started {
+		jb.started = true
+		jb.nextSeq = head.seq
+		jb.lastSeq = head.seq - 1
+		jb.lastTS = head.pkt.Timestamp
+	}
+
+	if head.pkt.Marker && head.seq != jb.anchorSeq {
+		// New talkspurt is good point to adapt our delay. It is applied when it reaches head,
+		// otherwise queued packets of previous talkspurt would get delay added again
+		jb.reanchor = true
+	}
+
+	if jb.reanchor {
+		jb.reanchor = false
+		jb.anchorSeq = head.seq
+		// Packet may already wait in buffer, so delay is counted from its arrival
+		jb.baseTime = head.arrival.Add(jb.delay)
+		if jb.baseTime.Before(now) {
+			jb.baseTime = now
+		}
+		jb.baseTS = head.pkt.Timestamp
+		if head.seq > jb.nextSeq {
+			// We are skipping missing packets after underrun
+			jb.stats.PacketsLost += uint64(head.seq - jb.nextSeq)
+			jb.nextSeq = head.seq
+		}
+	}
+
+	if head.seq == jb.nextSeq {
+		if wait := jb.playoutTime(head.pkt.Timestamp).Sub(now); wait > 0 {
+			return wait, nil
+		}
+
+		jb.packets = jb.packets[1:]
+		jb.nextSeq++
+		jb.lastSeq, jb.lastTS, jb.lastHeader = head.seq, head.pkt.Timestamp, head.pkt.Header
+		jb.stats.PacketsPlayed++
+		*pkt = *head.pkt
+		return 0, nil
+	}
+
+	// Missing packet. Interpolate its timestamp between last played and head
+	ts := jb.lastTS
+	if span := head.seq - jb.lastSeq; span > 0 {
+		ts += uint32(int64(head.pkt.Timestamp-jb.lastTS) * (jb.nextSeq - jb.lastSeq) / span)
+	}
+	if wait := jb.playoutTime(ts).Sub(now); wait > 0 {
+		return wait, nil
+	}
+
+	hdr := jb.lastHeader
+	hdr.SequenceNumber = uint16(jb.nextSeq)
+	hdr.Timestamp = ts
+	hdr.Marker = false
+	*pkt = rtp.Packet{Header: hdr}
+
+	jb.lastSeq, jb.lastTS = jb.nextSeq, ts
+	jb.nextSeq++
+	jb.stats.PacketsLost++
+	return 0, ErrJitterBufferGap
+}
@@ -0,0 +1,244 @@
+package sipgox
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// blockingReader never returns packets, so test can push them to buffer directly
+type blockingReader struct{}
+
+func (blockingReader) ReadRTP(buf []byte, pkt *rtp.Packet) error {
+	select {}
+}
+
+type jitterTestPacket struct {
+	seq    uint16
+	ts     uint32
+	marker bool
+	// at is arrival time after start
+	at time.Duration
+}
+
+type jitterTestRead struct {
+	seq uint16
+	ts  uint32
+	gap bool
+	// at is playout time after start
+	at time.Duration
+}
+
+func TestJitterBufferPlayout(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		packets []jitterTestPacket
+		reads   []jitterTestRead
+		stats   JitterBufferStats
+	}{
+		{
+			name: "in order",
+			packets: []jitterTestPacket{
+				{seq: 1, ts: 0, at: 0},
+				{seq: 2, ts: 160, at: 20 * ms},
+				{seq: 3, ts: 320, at: 40 * ms},
+			},
+			reads: []jitterTestRead{
+				{seq: 1, ts: 0, at: 20 * ms},
+				{seq: 2, ts: 160, at: 40 * ms},
+				{seq: 3, ts: 320, at: 60 * ms},
+			},
+			stats: JitterBufferStats{PacketsReceived: 3, PacketsPlayed: 3},
+		},
+		{
+			name: "reordered",
+			packets: []jitterTestPacket{
+				{seq: 1, ts: 0, at: 0},
+				{seq: 3, ts: 320, at: 5 * ms},
+				{seq: 2, ts: 160, at: 10 * ms},
+			},
+			reads: []jitterTestRead{
+				{seq: 1, ts: 0, at: 20 * ms},
+				{seq: 2, ts: 160, at: 40 * ms},
+				{seq: 3, ts: 320, at: 60 * ms},
+			},
+			stats: JitterBufferStats{PacketsReceived: 3, PacketsPlayed: 3, PacketsReordered: 1},
+		},
+		{
+			name: "duplicate",
+			packets: []jitterTestPacket{
+				{seq: 1, ts: 0, at: 0},
+				{seq: 2, ts: 160, at: 10 * ms},
+				{seq: 2, ts: 160, at: 15 * ms},
+			},
+			reads: []jitterTestRead{
+				{seq: 1, ts: 0, at: 20 * ms},
+				{seq: 2, ts: 160, at: 40 * ms},
+			},
+			stats: JitterBufferStats{PacketsReceived: 3, PacketsPlayed: 2, PacketsReordered: 1, PacketsDuplicate: 1},
+		},
+		{
+			name: "missing packet",
+			packets: []jitterTestPacket{
+				{seq: 1, ts: 0, at: 0},
+				{seq: 3, ts: 320, at: 10 * ms},
+			},
+			reads: []jitterTestRead{
+				{seq: 1, ts: 0, at: 20 * ms},
+				{seq: 2, ts: 160, gap: true, at: 40 * ms},
+				{seq: 3, ts: 320, at: 60 * ms},
+			},
+			stats: JitterBufferStats{PacketsReceived: 2, PacketsPlayed: 2, PacketsLost: 1},
+		},
+		{
+			name: "sequence wrap",
+			packets: []jitterTestPacket{
+				{seq: 65535, ts: 0, at: 0},
+				{seq: 0, ts: 160, at: 20 * ms},
+			},
+			reads: []jitterTestRead{
+				{seq: 65535, ts: 0, at: 20 * ms},
+				{seq: 0, ts: 160, at: 40 * ms},
+			},
+			stats: JitterBufferStats{PacketsReceived: 2, PacketsPlayed: 2},
+		},
+		{
+			// Marker of queued packet must not delay packets before it
+			name: "talkspurt queued",
+			packets: []jitterTestPacket{
+				{seq: 1, ts: 0, at: 0},
+				{seq: 2, ts: 160, at: 20 * ms},
+				{seq: 3, ts: 320, at: 40 * ms},
+				{seq: 4, ts: 480, marker: true, at: 60 * ms},
+				{seq: 5, ts: 640, marker: true, at: 80 * ms},
+			},
+			reads: []jitterTestRead{
+				{seq: 1, ts: 0, at: 20 * ms},
+				{seq: 2, ts: 160, at: 40 * ms},
+				{seq: 3, ts: 320, at: 60 * ms},
+				{seq: 4, ts: 480, at: 80 * ms},
+				{seq: 5, ts: 640, at: 100 * ms},
+			},
+			stats: JitterBufferStats{PacketsReceived: 5, PacketsPlayed: 5},
+		},
+		{
+			name: "talkspurt after silence",
+			packets: []jitterTestPacket{
+				{seq: 1, ts: 0, at: 0},
+				{seq: 2, ts: 160, at: 20 * ms},
+				{seq: 3, ts: 8320, marker: true, at: 1040 * ms},
+			},
+			reads: []jitterTestRead{
+				{seq: 1, ts: 0, at: 20 * ms},
+				{seq: 2, ts: 160, at: 40 * ms},
+				{seq: 3, ts: 8320, at: 1060 * ms},
+			},
+			stats: JitterBufferStats{PacketsReceived: 3, PacketsPlayed: 3},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			jb := NewJitterBuffer(blockingReader{}, JitterBufferOptions{MinDelay: 20 * ms})
+			defer jb.Close()
+
+			// Packets are pushed as they arrive while reading, as reading loop would do
+			start := time.Now()
+			now := start
+			packets := tc.packets
+			arrive := func() {
+				for len(packets) > 0 && !start.Add(packets[0].at).After(now) {
+					p := packets[0]
+					packets = packets[1:]
+					jb.push(&rtp.Packet{Header: rtp.Header{
+						SequenceNumber: p.seq,
+						Timestamp:      p.ts,
+						Marker:         p.marker,
+					}}, start.Add(p.at))
+				}
+			}
+
+			for i, r := range tc.reads {
+				pkt := rtp.Packet{}
+				var err error
+				for {
+					arrive()
+					var wait time.Duration
+					wait, err = jb.next(&pkt, now)
+					if wait == 0 {
+						break
+					}
+					if wait < 0 && len(packets) == 0 {
+						t.Fatalf("read %d: buffer is empty", i)
+					}
+					if len(packets) > 0 && (wait < 0 || start.Add(packets[0].at).Before(now.Add(wait))) {
+						now = start.Add(packets[0].at)
+						continue
+					}
+					now = now.Add(wait)
+				}
+
+				if r.gap != errors.Is(err, ErrJitterBufferGap) {
+					t.Fatalf("read %d: unexpected error %v", i, err)
+				}
+				if !r.gap && err != nil {
+					t.Fatalf("read %d: %v", i, err)
+				}
+				if pkt.SequenceNumber != r.seq || pkt.Timestamp != r.ts {
+					t.Errorf("read %d: got seq=%d ts=%d, expected seq=%d ts=%d", i, pkt.SequenceNumber, pkt.Timestamp, r.seq, r.ts)
+				}
+				if at := now.Sub(start); (at - r.at).Abs() > time.Millisecond {
+					t.Errorf("read %d: played at %s, expected %s", i, at, r.at)
+				}
+			}
+
+			stats := jb.Stats()
+			stats.Jitter, stats.Delay, stats.Buffered = 0, 0, 0
+			if stats != tc.stats {
+				t.Errorf("got stats %+v, expected %+v", stats, tc.stats)
+			}
+		})
+	}
+}
+
+func TestJitterBufferLate(t *testing.T) {
+	jb := NewJitterBuffer(blockingReader{}, JitterBufferOptions{})
+	defer jb.Close()
+
+	start := time.Now()
+	jb.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 10, Timestamp: 1600}}, start)
+	pkt := rtp.Packet{}
+	if wait, err := jb.next(&pkt, start.Add(time.Second)); wait != 0 || err != nil {
+		t.Fatalf("expected packet, got wait=%s err=%v", wait, err)
+	}
+
+	// Arrived after newer packet was played
+	jb.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 9, Timestamp: 1440}}, start.Add(time.Second))
+	if stats := jb.Stats(); stats.PacketsLate != 1 || stats.Buffered != 0 {
+		t.Errorf("expected late packet to be dropped, got %+v", stats)
+	}
+}
+
+func TestJitterBufferOverflow(t *testing.T) {
+	jb := NewJitterBuffer(blockingReader{}, JitterBufferOptions{MaxPackets: 3})
+	defer jb.Close()
+
+	start := time.Now()
+	for i := range 5 {
+		jb.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i), Timestamp: uint32(i * 160)}}, start)
+	}
+	if stats := jb.Stats(); stats.PacketsOverflow != 2 || stats.Buffered != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	pkt := rtp.Packet{}
+	if wait, err := jb.next(&pkt, start.Add(time.Second)); wait != 0 || err != nil {
+		t.Fatalf("expected packet, got wait=%s err=%v", wait, err)
+	}
+	if pkt.SequenceNumber != 2 {
+		t.Errorf("expected oldest packets dropped, got seq=%d", pkt.SequenceNumber)
+	}
+}
@@ -0,0 +1,63 @@
+package sipgox
+
+import "net"
+
+// MediaLatchPolicy controls symmetric RTP. Remote media address is by default taken from SDP,
+// but peer behind NAT normally advertises its private IP. With latching we send media
+// back to address we receive media from.
+type MediaLatchPolicy int
+
+const (
+	// MediaLatchDisabled sends media only to SDP address
+	MediaLatchDisabled MediaLatchPolicy = iota
+	// MediaLatchOnce latches to first received source. Later packets from other sources are still read
+	MediaLatchOnce
+	// MediaLatchStrict latches to first received source and drops packets from any other source
+	MediaLatchStrict
+	// MediaLatchFollow always follows latest received source
+	MediaLatchFollow
+)
+
+func (p MediaLatchPolicy) String() string {
+	switch p {
+	case MediaLatchOnce:
+		return "once"
+	case MediaLatchStrict:
+		return "strict"
+	case MediaLatchFollow:
+		return "follow"
+	}
+	return "disabled"
+}
+
+// mediaLatch tracks remote address of single stream (RTP or RTCP)
+type mediaLatch struct {
+	raddr   *net.UDPAddr
+	latched bool
+}
+
+// update applies policy on received source. It returns false if packet should be dropped
+// and true with changed if remote address is changed
+func (l *mediaLatch) update(policy MediaLatchPolicy, src *net.UDPAddr) (accept bool, changed bool) {
+	same := l.raddr != nil && l.raddr.IP.Equal(src.IP) && l.raddr.Port == src.Port
+	if !l.latched {
+		l.latched = true
+		if !same {
+			l.raddr = src
+		}
+		return true, !same
+	}
+
+	if same {
+		return true, false
+	}
+
+	switch policy {
+	case MediaLatchStrict:
+		return false, false
+	case MediaLatchFollow:
+		l.raddr = src
+		return true, true
+	}
+	return true, false
+}
@@ -0,0 +1,91 @@
+package sipgox
+
+import (
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// MediaSession is negotiated media of dialog. It embeds media.MediaSession for SDP state like
+// Laddr, Raddr and Formats, while RTP and RTCP go through sockets owned by dialog. We need source
+// address of received packets for latching, ICE and STUN, which media.MediaSession does not expose.
+//
+// All read and write methods of media.MediaSession are overridden, so MediaSession can be read
+// and written as before. Embedded media.MediaSession has no sockets and must not be passed to
+// media readers and writers of emiago/media, which read its sockets directly.
+type MediaSession struct {
+	// Deprecated: has no sockets. Use it only for SDP state. RTP and RTCP must go through
+	// methods of MediaSession or dialog
+	*media.MediaSession
+
+	dm *dialogMedia
+}
+
+func newMediaSession(dm *dialogMedia) *MediaSession {
+	return &MediaSession{MediaSession: dm.sess, dm: dm}
+}
+
+// Fork returns media session for media update. It shares sockets of dialog
+func (s *MediaSession) Fork() *MediaSession {
+	return &MediaSession{MediaSession: s.MediaSession.Fork(), dm: s.dm}
+}
+
+// Close closes media sockets
+func (s *MediaSession) Close() {
+	s.dm.Close()
+}
+
+// ReadRTP reads RTP packet. It keeps stats of received stream and decrypts SRTP
+func (s *MediaSession) ReadRTP(buf []byte, pkt *rtp.Packet) error {
+	return s.dm.ReadRTP(buf, pkt)
+}
+
+// ReadRTPRaw reads RTP packet as received on media socket
+func (s *MediaSession) ReadRTPRaw(buf []byte) (int, error) {
+	return s.dm.readRTPRaw(buf)
+}
+
+func (s *MediaSession) ReadRTPRawDeadline(buf []byte, t time.Time) (int, error) {
+	s.dm.rtpConn.SetReadDeadline(t)
+	return s.dm.readRTPRaw(buf)
+}
+
+// ReadRTCP reads RTCP packets. In case of SRTP they are decrypted
+func (s *MediaSession) ReadRTCP(pkts []rtcp.Packet) (int, error) {
+	return s.dm.ReadRTCP(pkts)
+}
+
+// ReadRTCPRaw reads RTCP packet as received on media socket
+func (s *MediaSession) ReadRTCPRaw(buf []byte) (int, error) {
+	return s.dm.readRTCPRaw(buf)
+}
+
+func (s *MediaSession) ReadRTCPRawDeadline(buf []byte, t time.Time) (int, error) {
+	return s.dm.readRTCPRawDeadline(buf, t)
+}
+
+// WriteRTP writes RTP packet to remote media address. In case of SRTP it is encrypted
+func (s *MediaSession) WriteRTP(pkt *rtp.Packet) error {
+	return s.dm.WriteRTP(pkt)
+}
+
+// WriteRTPRaw writes RTP packet as is to remote media address
+func (s *MediaSession) WriteRTPRaw(data []byte) (int, error) {
+	return s.dm.writeRTPRaw(data)
+}
+
+func (s *MediaSession) WriteRTCP(pkt rtcp.Packet) error {
+	return s.dm.WriteRTCPs([]rtcp.Packet{pkt})
+}
+
+func (s *MediaSession) WriteRTCPDeadline(pkt rtcp.Packet, deadline time.Time) error {
+	s.dm.rtcpConn.SetWriteDeadline(deadline)
+	return s.WriteRTCP(pkt)
+}
+
+// WriteRTCPs writes RTCP packets. In case of SRTP they are encrypted
+func (s *MediaSession) WriteRTCPs(pkts []rtcp.Packet) error {
+	return s.dm.WriteRTCPs(pkts)
+}
@@ -0,0 +1,119 @@
+package sipgox
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/emiago/media/sdp"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+)
+
+func newTestDialogMedia(t *testing.T) *dialogMedia {
+	rtpConn, rtcpConn := newTestMediaConn(t), newTestMediaConn(t)
+	sess := &media.MediaSession{
+		Laddr:   rtpConn.LocalAddr().(*net.UDPAddr),
+		Formats: sdp.Formats{sdp.FORMAT_TYPE_ULAW},
+		Mode:    sdp.ModeSendrecv,
+	}
+	return newDialogMedia(sess, rtpConn, rtcpConn, "test", zerolog.Nop())
+}
+
+func newTestPeer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readTestRTP(t *testing.T, conn *net.UDPConn) rtp.Packet {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := rtp.Packet{}
+	if err := pkt.Unmarshal(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func TestMediaSessionReadWrite(t *testing.T) {
+	dm := newTestDialogMedia(t)
+	peer := newTestPeer(t)
+	dm.setRemote(peer.LocalAddr().(*net.UDPAddr))
+	sess := newMediaSession(dm)
+
+	// Dialog embeds MediaSession, so media can be written with session as before
+	d := &DialogClientSession{MediaSession: sess, dmedia: dm}
+	if err := d.MediaSession.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1}, Payload: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if pkt := readTestRTP(t, peer); pkt.SSRC != 1 {
+		t.Errorf("unexpected packet %v", pkt)
+	}
+
+	// Fork for media update shares sockets of dialog
+	if err := sess.Fork().WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 2}, Payload: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if pkt := readTestRTP(t, peer); pkt.SSRC != 2 {
+		t.Errorf("unexpected packet %v", pkt)
+	}
+
+	data, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 3}, Payload: []byte{1}}).Marshal()
+	peer.WriteTo(data, sess.Laddr)
+	buf := make([]byte, 1500)
+	pkt := rtp.Packet{}
+	if err := d.ReadRTP(buf, &pkt); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.SSRC != 3 {
+		t.Errorf("unexpected packet %v", pkt)
+	}
+	if s := d.Stats(); s.PacketsSent != 2 || s.PacketsReceived != 1 {
+		t.Errorf("expected stats of session reads and writes, got %+v", s)
+	}
+
+	if _, err := sess.ReadRTPRawDeadline(buf, time.Now().Add(10*time.Millisecond)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+
+	sess.Close()
+	if err := sess.ReadRTP(buf, &pkt); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected closed error, got %v", err)
+	}
+}
+
+func TestMediaSessionLatch(t *testing.T) {
+	dm := newTestDialogMedia(t)
+	sdpPeer, natPeer := newTestPeer(t), newTestPeer(t)
+	dm.setRemote(sdpPeer.LocalAddr().(*net.UDPAddr))
+	dm.setLatch(MediaLatchOnce)
+	sess := newMediaSession(dm)
+
+	// Peer behind NAT sends from other address than in SDP
+	data, _ := (&rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1}, Payload: []byte{1}}).Marshal()
+	natPeer.WriteTo(data, sess.Laddr)
+	buf := make([]byte, 1500)
+	if _, err := sess.ReadRTPRaw(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if raddr := dm.RemoteAddr(); raddr.Port != natPeer.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("expected latched address %s, got %s", natPeer.LocalAddr(), raddr)
+	}
+	if _, err := sess.WriteRTPRaw(data); err != nil {
+		t.Fatal(err)
+	}
+	readTestRTP(t, natPeer)
+}
@@ -0,0 +1,184 @@
+package sipgox
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// externalPacketConn reports external address as local address. Transport layer of sipgo
+// uses it for Via sent-by and for matching connection by Via, so our requests carry
+// public address while we are still listening on local interface
+type externalPacketConn struct {
+	net.PacketConn
+	addr *net.UDPAddr
+
+	// reading is closed when transport starts reading, which is after connection is added to pool
+	reading     chan struct{}
+	readingOnce sync.Once
+}
+
+func newExternalPacketConn(conn net.PacketConn, addr *net.UDPAddr) *externalPacketConn {
+	return &externalPacketConn{
+		PacketConn: conn,
+		addr:       addr,
+		reading:    make(chan struct{}),
+	}
+}
+
+func (c *externalPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *externalPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readingOnce.Do(func() { close(c.reading) })
+	return c.PacketConn.ReadFrom(b)
+}
+
+// externalHostPort maps local signaling host port to external if phone is behind static NAT
+func (p *Phone) externalHostPort(host string, port int) (string, int) {
+	if p.externalIP == nil {
+		return host, port
+	}
+	if p.externalPort > 0 {
+		port = p.externalPort
+	}
+	return p.externalIP.String(), port
+}
+
+// externalUDPConn wraps listener connection so that it is seen with external address
+func (p *Phone) externalUDPConn(conn *net.UDPConn) net.PacketConn {
+	if p.externalIP == nil {
+		return conn
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	host, port := p.externalHostPort(laddr.IP.String(), laddr.Port)
+	return newExternalPacketConn(conn, &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+}
+
+// serveExternalUDP makes sure there is UDP connection on local host port which is seen with external address.
+// It returns external host port which must be used for client Via and Contact
+func (p *Phone) serveExternalUDP(host string, port int) (string, int, error) {
+	ehost, eport := p.externalHostPort(host, port)
+	eaddr := net.JoinHostPort(ehost, strconv.Itoa(eport))
+
+	tp := p.UA.TransportLayer()
+	if c, _ := tp.GetConnection("udp", eaddr); c != nil {
+		return ehost, eport, nil
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+	if err != nil {
+		return "", 0, fmt.Errorf("fail to listen for external address: %w", err)
+	}
+	ehost, eport = p.externalHostPort(host, conn.LocalAddr().(*net.UDPAddr).Port)
+	eaddr = net.JoinHostPort(ehost, strconv.Itoa(eport))
+
+	p.mu.Lock()
+	p.closers = append(p.closers, conn)
+	p.mu.Unlock()
+
+	econn := newExternalPacketConn(conn, &net.UDPAddr{IP: net.ParseIP(ehost), Port: eport})
+	if err := p.serveUDP(econn, econn.reading); err != nil {
+		return "", 0, fmt.Errorf("external udp connection %s not served: %w", eaddr, err)
+	}
+	return ehost, eport, nil
+}
+
+// serveUDP serves connection on transport layer. It returns once connection is read,
+// as serving adds connection to pool before it starts reading
+func (p *Phone) serveUDP(conn net.PacketConn, reading <-chan struct{}) error {
+	served := make(chan error, 1)
+	go func() {
+		err := p.UA.TransportLayer().ServeUDP(conn)
+		if err != nil {
+			p.log.Error().Err(err).Str("addr", conn.LocalAddr().String()).Msg("Serving UDP failed")
+		}
+		served <- err
+	}()
+
+	select {
+	case <-reading:
+		return nil
+	case err := <-served:
+		return err
+	}
+}
+
+// localSDP is media session SDP with external media IP if set or public mapping discovered with STUN.
+// With ICE-lite candidates are added
+func (p *Phone) localSDP(dm *dialogMedia) []byte {
+	msess := dm.sess
+	body := msess.LocalSDP()
+
+	var mapping *stunMapping
+	switch {
+	case p.externalMediaIP != nil:
+		body = sdpSetConnectionIP(body, p.externalMediaIP)
+		// Static NAT keeps ports
+		mapping = &stunMapping{
+			rtp:  &net.UDPAddr{IP: p.externalMediaIP, Port: msess.Laddr.Port},
+			rtcp: &net.UDPAddr{IP: p.externalMediaIP, Port: msess.Laddr.Port + 1},
+		}
+
+	case dm.stun != nil:
+		m, err := dm.stun.wait()
+		if err != nil {
+			p.log.Warn().Err(err).Str("server", p.stun.server).Msg("STUN discovery failed. Using local media address")
+			break
+		}
+		p.log.Debug().Str("laddr", msess.Laddr.String()).Str("mapped", m.rtp.String()).Msg("Media public address discovered")
+		mapping = &m
+
+		body = sdpSetConnectionIP(body, m.rtp.IP)
+		body = sdpSetMediaPort(body, m.rtp.Port)
+		if m.rtcp != nil {
+			// https://datatracker.ietf.org/doc/html/rfc3605
+			body = sdpAppendAttributes(body, fmt.Sprintf("rtcp:%d IN %s %s", m.rtcp.Port, sdpAddrType(m.rtcp.IP), m.rtcp.IP))
+		}
+	}
+
+	if p.iceLite {
+		ice, err := iceLiteOffer(body, iceCandidates(msess.Laddr, mapping))
+		if err != nil {
+			p.log.Error().Err(err).Msg("Failed to add ICE to SDP")
+			return body
+		}
+		body = ice
+	}
+	return body
+}
+
+// parseExternalAddr parses ip[:port]
+func parseExternalAddr(addr string) (net.IP, int, error) {
+	ip, port := net.ParseIP(addr), 0
+	if ip == nil {
+		host, p, err := sip.ParseAddr(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		ip, port = net.ParseIP(host), p
+		if ip == nil {
+			return nil, 0, fmt.Errorf("external address must be IP, got %q", host)
+		}
+	}
+	if ip.IsUnspecified() {
+		return nil, 0, fmt.Errorf("external address can not be unspecified %s", ip)
+	}
+	if port < 0 || port > 65535 {
+		return nil, 0, fmt.Errorf("bad external port %d", port)
+	}
+	return ip, port, nil
+}
+
+// clientHostPort returns host port which client should use for Via. With external address on UDP
+// we serve connection ourselves so that Via carries external address
+func (p *Phone) clientHostPort(network string, host string, port int) (string, int, error) {
+	if p.externalIP == nil || network != "udp" {
+		return host, port, nil
+	}
+	return p.serveExternalUDP(host, port)
+}
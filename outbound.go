@@ -0,0 +1,253 @@
+package sipgox
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+	"github.com/pion/stun/v3"
+)
+
+// SIP Outbound. Registration with instance id and reg-id creates flow on which registrar
+// or edge proxy sends incoming requests. Flow is kept open with keep alives
+// https://datatracker.ietf.org/doc/html/rfc5626
+
+// Keep alive intervals in case registrar does not send Flow-Timer
+// https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.1
+const (
+	flowTimerStream = 120 * time.Second
+	flowTimerUDP    = 29 * time.Second
+)
+
+// instanceURN returns instance id as URN. Plain UUID is converted to urn:uuid
+func instanceURN(instanceID string) string {
+	if strings.HasPrefix(strings.ToLower(instanceID), "urn:") {
+		return instanceID
+	}
+	return "urn:uuid:" + instanceID
+}
+
+// outboundContact adds +sip.instance and reg-id to Contact of REGISTER.
+// reg-id is only added with instance id
+// https://datatracker.ietf.org/doc/html/rfc5626#section-4.2
+func outboundContact(contact *sip.ContactHeader, instanceID string, regID int) {
+	if instanceID == "" {
+		return
+	}
+	if contact.Params == nil {
+		contact.Params = sip.NewParams()
+	}
+	contact.Params.Add("+sip.instance", `"<`+instanceURN(instanceID)+`>"`)
+	if regID > 0 {
+		contact.Params.Add("reg-id", strconv.Itoa(regID))
+	}
+}
+
+// hasOptionTag checks option tag in Supported/Require like headers with comma separated values
+func hasOptionTag(hdrs []sip.Header, tag string) bool {
+	for _, h := range hdrs {
+		for _, v := range strings.Split(h.Value(), ",") {
+			if strings.EqualFold(strings.TrimSpace(v), tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// flowTimer returns Flow-Timer of registrar response or 0
+// https://datatracker.ietf.org/doc/html/rfc5626#section-10
+func flowTimer(res *sip.Response) time.Duration {
+	h := res.GetHeader("Flow-Timer")
+	if h == nil {
+		return 0
+	}
+	sec, err := strconv.Atoi(strings.TrimSpace(h.Value()))
+	if err != nil || sec <= 0 {
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// flowKeepAlive keeps registered flow alive. Interval is Flow-Timer or default of transport.
+// Over UDP STUN binding is sent on flow connection and flow has failed if it is not answered
+// or mapped address changes. Registration is then refreshed to recover flow
+// https://datatracker.ietf.org/doc/html/rfc5626#section-4.4
+func (p *Phone) flowKeepAlive(ctx context.Context, t *RegisterTransaction, network string, laddr string, raddr string, flow *flowConn) {
+	interval := t.FlowTimer()
+	if interval <= 0 {
+		interval = flowTimerUDP
+		if isStreamTransport(network) || isWebSocket(network) {
+			interval = flowTimerStream
+		}
+	}
+
+	switch {
+	case network == "udp":
+		if flow == nil {
+			p.log.Error().Str("laddr", laddr).Msg("Flow keep alive disabled. Flow connection is not ours")
+			return
+		}
+		host, port, err := sip.ParseAddr(raddr)
+		if port == 0 {
+			port = sip.DefaultPort(network)
+		}
+		var addr *net.UDPAddr
+		if err == nil {
+			addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+		if err != nil {
+			p.log.Error().Err(err).Str("raddr", raddr).Msg("Flow keep alive disabled")
+			return
+		}
+		go p.flowSTUNKeepAlive(ctx, t, flow, addr, interval)
+	case isStreamTransport(network):
+		p.sendKeepAlive(ctx, network, laddr, interval, writeKeepAlive)
+	}
+}
+
+// flowSTUNKeepAlive sends STUN binding on flow until context is done
+// https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.2
+func (p *Phone) flowSTUNKeepAlive(ctx context.Context, t *RegisterTransaction, flow *flowConn, raddr *net.UDPAddr, interval time.Duration) {
+	log := p.log.With().Str("laddr", flow.LocalAddr().String()).Str("raddr", raddr.String()).Logger()
+	var mapped *net.UDPAddr
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(keepAliveWait(interval)):
+		}
+
+		addr, err := flow.binding(raddr, flowSTUNTimeout)
+		if err == nil && (mapped == nil || addr.String() == mapped.String()) {
+			mapped = addr
+			log.Debug().Str("mapped", addr.String()).Msg("Keep alive STUN answered")
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			log.Warn().Err(err).Msg("Flow failed. Refreshing registration")
+		} else {
+			log.Warn().Str("mapped", addr.String()).Str("previous", mapped.String()).Msg("Flow mapped address changed. Refreshing registration")
+		}
+		mapped = nil
+		if err := t.qualify(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to refresh registration of flow")
+		}
+	}
+}
+
+// flowSTUNTimeout is time to wait for keep alive STUN response including retransmissions
+const flowSTUNTimeout = 10 * time.Second
+
+// flowConn is UDP connection of outbound flow. It is served by transport layer like listener,
+// but STUN messages are taken out before SIP parsing so that keep alive responses are read
+type flowConn struct {
+	net.PacketConn
+
+	reading     chan struct{}
+	readingOnce sync.Once
+
+	mu      sync.Mutex
+	pending map[[stun.TransactionIDSize]byte]chan *stun.Message
+}
+
+func newFlowConn(conn net.PacketConn) *flowConn {
+	return &flowConn{
+		PacketConn: conn,
+		reading:    make(chan struct{}),
+		pending:    make(map[[stun.TransactionIDSize]byte]chan *stun.Message),
+	}
+}
+
+func (c *flowConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readingOnce.Do(func() { close(c.reading) })
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !stun.IsMessage(b[:n]) {
+			return n, addr, err
+		}
+
+		res := &stun.Message{Raw: append([]byte{}, b[:n]...)}
+		if err := res.Decode(); err != nil {
+			continue
+		}
+		c.mu.Lock()
+		ch, exists := c.pending[res.TransactionID]
+		c.mu.Unlock()
+		if exists {
+			select {
+			case ch <- res:
+			default:
+			}
+		}
+	}
+}
+
+// binding sends STUN binding request to raddr and returns mapped address.
+// Request is retransmitted starting with 500ms interval
+func (c *flowConn) binding(raddr *net.UDPAddr, timeout time.Duration) (*net.UDPAddr, error) {
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	resCh := make(chan *stun.Message, 1)
+	c.mu.Lock()
+	c.pending[req.TransactionID] = resCh
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, req.TransactionID)
+		c.mu.Unlock()
+	}()
+
+	deadline := time.Now().Add(timeout)
+	rto := 500 * time.Millisecond
+	for now := time.Now(); now.Before(deadline); now = time.Now() {
+		if _, err := c.WriteTo(req.Raw, raddr); err != nil {
+			return nil, err
+		}
+
+		timer := time.NewTimer(min(rto, deadline.Sub(now)))
+		rto *= 2
+		select {
+		case res := <-resCh:
+			timer.Stop()
+			return stunMappedAddress(res)
+		case <-timer.C:
+		}
+	}
+	return nil, ErrSTUNTimeout
+}
+
+// serveFlowUDP creates UDP connection of outbound flow on host and serves it. Returned host port
+// is address of connection in transport pool, which is external address if set
+func (p *Phone) serveFlowUDP(host string) (*flowConn, string, int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("fail to listen for flow: %w", err)
+	}
+	var pconn net.PacketConn = conn
+	fhost, fport := p.externalHostPort(host, conn.LocalAddr().(*net.UDPAddr).Port)
+	if p.externalIP != nil {
+		pconn = newExternalPacketConn(conn, &net.UDPAddr{IP: net.ParseIP(fhost), Port: fport})
+	}
+
+	p.mu.Lock()
+	p.closers = append(p.closers, conn)
+	p.mu.Unlock()
+
+	flow := newFlowConn(pconn)
+	if err := p.serveUDP(flow, flow.reading); err != nil {
+		return nil, "", 0, fmt.Errorf("flow connection not served: %w", err)
+	}
+	return flow, fhost, fport, nil
+}
@@ -7,16 +7,17 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emiago/media"
 	"github.com/emiago/media/sdp"
 	"github.com/emiago/sipgo"
 	"github.com/emiago/sipgo/sip"
-	"github.com/icholy/digest"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -37,6 +38,54 @@ type Phone struct {
 
 	log zerolog.Logger
 
+	// mediaIP is used for RTP instead of signaling IP
+	mediaIP net.IP
+	// rtpPorts if set restricts RTP to port range
+	rtpPorts *rtpPortRange
+
+	// External addresses in case phone is behind static NAT
+	externalIP      net.IP
+	externalPort    int
+	externalMediaIP net.IP
+	// stun discovers public media address if set
+	stun *stunDiscovery
+	// iceLite adds ICE candidates to SDP and answers connectivity checks
+	iceLite bool
+
+	// keepAliveInterval enables CRLF keep alive on TCP/TLS connections
+	keepAliveInterval time.Duration
+
+	// proxy is outbound proxy for initial requests
+	proxy *sip.Uri
+
+	// acl filters incoming requests by source
+	acl *requestFilter
+	// router dispatches calls of Answer by routes
+	router *CallRouter
+
+	// resolver locates SIP servers by NAPTR/SRV when uri host is not IP
+	resolver Resolver
+	// targets caches chosen target of resolved uri
+	targets *targetCache
+	// forks catches other 2xx of forked INVITEs. It is shared by phones of UA
+	forks *forkTracker
+
+	// optErr is error of invalid options. Answer, Dial and Register fail with it
+	optErr error
+
+	// inviteMu makes INVITEs written one at a time. Client connection is created by first
+	// request and parallel INVITEs would race on binding its local address
+	inviteMu sync.Mutex
+
+	mu sync.Mutex
+	// closers are connections owned by phone
+	closers []io.Closer
+	// streamAddrs are local addresses of TCP/TLS connections per target for reuse
+	streamAddrs map[string]string
+	// registration is last successful registration while it is kept. Dial through its registrar
+	// uses its Service-Route, GRUU and outbound flow
+	registration *RegisterTransaction
+
 	// Custom client or server
 	// By default they are created
 	client *sipgo.Client
@@ -57,6 +106,11 @@ type Listener struct {
 
 type PhoneOption func(p *Phone)
 
+// optionError records invalid option. Phone is not usable with it
+func (p *Phone) optionError(err error) {
+	p.optErr = errors.Join(p.optErr, err)
+}
+
 // WithPhoneListenAddrs
 // NOT TLS supported
 func WithPhoneListenAddr(addr ListenAddr) PhoneOption {
@@ -71,6 +125,101 @@ func WithPhoneLogger(l zerolog.Logger) PhoneOption {
 	}
 }
 
+// WithPhoneMediaIP sets IP for binding RTP. By default IP of signaling is used.
+// It is advertised in SDP so it can not be unspecified address
+func WithPhoneMediaIP(ip net.IP) PhoneOption {
+	return func(p *Phone) {
+		if ip == nil || ip.IsUnspecified() {
+			p.optionError(fmt.Errorf("media IP must be specified address, got %s", ip))
+			return
+		}
+		p.mediaIP = ip
+	}
+}
+
+// WithPhoneRTPPortRange restricts RTP to ports in range [start, end].
+// RTP is allocated on even and RTCP on next odd port
+func WithPhoneRTPPortRange(start int, end int) PhoneOption {
+	return func(p *Phone) {
+		r, err := newRTPPortRange(start, end)
+		if err != nil {
+			p.optionError(err)
+			return
+		}
+		p.rtpPorts = r
+	}
+}
+
+// WithPhoneExternalAddr sets public signaling address in format ip[:port] when phone
+// is behind static NAT. It is used for Contact and for Via sent-by on UDP.
+// If port is not set, local listen port is used
+func WithPhoneExternalAddr(addr string) PhoneOption {
+	return func(p *Phone) {
+		ip, port, err := parseExternalAddr(addr)
+		if err != nil {
+			p.optionError(fmt.Errorf("bad external address: %w", err))
+			return
+		}
+		p.externalIP, p.externalPort = ip, port
+	}
+}
+
+// WithPhoneExternalMediaIP sets public IP advertised in SDP when phone is behind static NAT
+func WithPhoneExternalMediaIP(ip net.IP) PhoneOption {
+	return func(p *Phone) {
+		if ip == nil || ip.IsUnspecified() {
+			p.optionError(fmt.Errorf("external media IP must be specified address, got %s", ip))
+			return
+		}
+		p.externalMediaIP = ip
+	}
+}
+
+// WithPhoneSTUN enables discovery of public RTP address with STUN server (host:port).
+// Discovered mapping is put in SDP and cached for ttl. Default ttl is 5 minutes
+func WithPhoneSTUN(server string, ttl time.Duration) PhoneOption {
+	return func(p *Phone) {
+		p.stun = newSTUNDiscovery(server, ttl)
+	}
+}
+
+// WithPhoneICELite enables ICE-lite. Host and server reflexive (STUN or external media IP)
+// candidates are added to SDP and connectivity checks are answered on RTP/RTCP sockets.
+// NOTE: checks are answered only while RTP is read from dialog
+func WithPhoneICELite() PhoneOption {
+	return func(p *Phone) {
+		p.iceLite = true
+	}
+}
+
+// WithPhoneKeepAlive enables sending CRLF keep alive on TCP/TLS connection while dialog
+// or registration is active. Recommended interval is 95-120s (RFC 5626)
+func WithPhoneKeepAlive(interval time.Duration) PhoneOption {
+	return func(p *Phone) {
+		p.keepAliveInterval = interval
+	}
+}
+
+// WithPhoneResolver sets resolver used for locating SIP servers (RFC 3263). Default is system DNS
+func WithPhoneResolver(r Resolver) PhoneOption {
+	return func(p *Phone) {
+		p.resolver = r
+	}
+}
+
+// WithPhoneOutboundProxy sends initial requests (INVITE, REGISTER) through proxy. Proxy
+// is sip uri or host[:port]. It can be overridden per call with OutboundProxy option
+func WithPhoneOutboundProxy(proxy string) PhoneOption {
+	return func(p *Phone) {
+		uri, err := parseProxyUri(proxy)
+		if err != nil {
+			p.optionError(fmt.Errorf("bad outbound proxy: %w", err))
+			return
+		}
+		p.proxy = &uri
+	}
+}
+
 // func WithPhoneClient(c *sipgo.Client) PhoneOption {
 // 	return func(p *Phone) {
 // 		p.client = c
@@ -83,18 +232,25 @@ func WithPhoneLogger(l zerolog.Logger) PhoneOption {
 // 	}
 // }
 
+// NewPhone creates phone. In case of invalid options Answer, Dial and Register return error.
+// Use NewPhoneChecked to get it on creation
 func NewPhone(ua *sipgo.UserAgent, options ...PhoneOption) *Phone {
 	p := &Phone{
 		UA: ua,
 		// c:           client,
 		listenAddrs: []ListenAddr{},
 		log:         log.Logger,
+		resolver:    &dnsResolver{net.DefaultResolver},
+		targets:     newTargetCache(5 * time.Minute),
 	}
 
 	for _, o := range options {
 		o(p)
 	}
 
+	// Transport handlers can not be added safely once messages are flowing
+	p.forks = uaForkTracker(ua)
+
 	if len(p.listenAddrs) == 0 {
 		// WithPhoneListenAddr(ListenAddr{"udp", "127.0.0.1:5060"})(p)
 		// WithPhoneListenAddr(ListenAddr{"tcp", "0.0.0.0:5060"})(p)
@@ -104,7 +260,22 @@ func NewPhone(ua *sipgo.UserAgent, options ...PhoneOption) *Phone {
 	return p
 }
 
+// NewPhoneChecked creates phone and returns error if any option is invalid
+func NewPhoneChecked(ua *sipgo.UserAgent, options ...PhoneOption) (*Phone, error) {
+	p := NewPhone(ua, options...)
+	if p.optErr != nil {
+		return nil, p.optErr
+	}
+	return p, nil
+}
+
 func (p *Phone) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.closers {
+		c.Close()
+	}
+	p.closers = nil
 }
 
 // func (p *Phone) getOrCreateClient(opts ...sipgo.ClientOption) (*sipgo.Client, error) {
@@ -163,7 +334,7 @@ func (p *Phone) createServerListener(s *sipgo.Server, a ListenAddr) (*Listener,
 		return &Listener{
 			a,
 			udpConn,
-			func() error { return s.ServeUDP(udpConn) },
+			func() error { return s.ServeUDP(p.externalUDPConn(udpConn)) },
 		}, nil
 
 	case "ws", "tcp":
@@ -288,36 +459,84 @@ func (e RegisterResponseError) Error() string {
 type RegisterOptions struct {
 	Username string
 	Password string
+	// ProxyUsername and ProxyPassword answer 407 of proxy. Default are Username and Password
+	ProxyUsername string
+	ProxyPassword string
 
 	Expiry        int
 	AllowHeaders  []string
 	UnregisterAll bool
+
+	// OutboundProxy overrides phone outbound proxy. Format is sip uri or host[:port]
+	OutboundProxy string
+	// Routes are pre-loaded Route headers after outbound proxy
+	Routes []sip.Uri
+	// SupportPath advertises Path support to registrar. Needed when registering through edge proxy
+	// https://datatracker.ietf.org/doc/html/rfc3327
+	SupportPath bool
+
+	// InstanceID is added as +sip.instance Contact param. Format is urn:uuid or plain UUID
+	InstanceID string
+	// RegID together with InstanceID registers outbound flow (RFC 5626). Registered flow is kept alive
+	// and incoming requests are received on it
+	RegID int
+	// GRUU requests GRUU (RFC 5627) for InstanceID. Assigned GRUU is used as Contact in Dial and Answer
+	GRUU bool
+}
+
+func (o RegisterOptions) credentials() digestCredentials {
+	return digestCredentials{o.Username, o.Password, o.ProxyUsername, o.ProxyPassword}
 }
 
 func (p *Phone) Register(ctx context.Context, recipient sip.Uri, opts RegisterOptions) error {
+	if p.optErr != nil {
+		return p.optErr
+	}
 	log := p.getLoggerCtx(ctx, "Register")
+	proxy, err := p.outboundProxy(opts.OutboundProxy)
+	if err != nil {
+		return err
+	}
+	// Transport and target are of next hop
+	hop := nextHop(recipient, proxy, opts.Routes)
+
 	// Make our client reuse address
-	network := recipient.Headers["transport"]
-	if network == "" {
-		network = "udp"
+	network := uriTransport(hop)
+	targets, err := p.lookupTargets(ctx, hop)
+	if err != nil {
+		return err
 	}
-	lhost, lport, _ := p.getInterfaceHostPort(network, recipient.HostPort())
+	target := hop.HostPort()
+	if len(targets) > 0 {
+		network, target = targets[0].network, targets[0].addr
+	}
+	lhost, lport, _ := p.clientLocalHostPort(network, target)
 	// addr := net.JoinHostPort(lhost, strconv.Itoa(lport))
+	var flow *flowConn
+	if network == "udp" && opts.InstanceID != "" && opts.RegID > 0 {
+		// Flow is on own connection so that keep alive STUN responses can be read
+		flow, lhost, lport, err = p.serveFlowUDP(lhost)
+	} else {
+		lhost, lport, err = p.clientHostPort(network, lhost, lport)
+	}
+	if err != nil {
+		return err
+	}
 
 	// Run server on UA just to handle OPTIONS
 	// We do not need to create listener as client will create underneath connections and point contact header
-	server, err := sipgo.NewServer(p.UA)
+	server, err := p.newServer()
 	if err != nil {
 		return err
 	}
 	defer server.Close()
 
-	server.OnOptions(func(req *sip.Request, tx sip.ServerTransaction) {
+	server.OnOptions(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
 		res := sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil)
 		if err := tx.Respond(res); err != nil {
 			log.Error().Err(err).Msg("OPTIONS 200 failed to respond")
 		}
-	})
+	}))
 
 	client, err := sipgo.NewClient(p.UA,
 		sipgo.WithClientHostname(lhost),
@@ -326,24 +545,22 @@ func (p *Phone) Register(ctx context.Context, recipient sip.Uri, opts RegisterOp
 	)
 	defer client.Close()
 
-	contactHdr := sip.ContactHeader{
-		Address: sip.Uri{
-			User:      p.UA.Name(),
-			Host:      lhost,
-			Port:      lport,
-			Headers:   sip.HeaderParams{"transport": network},
-			UriParams: sip.NewParams(),
-		},
-		Params: sip.NewParams(),
-	}
+	contactHdr := p.clientContactHeader(lhost, lport, network)
 
-	t, err := p.register(ctx, client, recipient, contactHdr, opts)
+	t, err := p.registerTargets(ctx, client, recipient, contactHdr, opts, hop, targets)
 	if err != nil {
 		return err
 	}
+	laddr := net.JoinHostPort(lhost, strconv.Itoa(lport))
+	if t.Outbound() {
+		p.flowKeepAlive(ctx, t, network, laddr, t.Origin.Destination(), flow)
+	} else {
+		p.keepAlive(ctx, network, laddr)
+	}
 
 	// Unregister
 	defer func() {
+		p.clearRegistration(t)
 		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
 		err := t.Unregister(ctx)
 		if err != nil {
@@ -354,8 +571,17 @@ func (p *Phone) Register(ctx context.Context, recipient sip.Uri, opts RegisterOp
 	return t.QualifyLoop(ctx)
 }
 
-func (p *Phone) register(ctx context.Context, client *sipgo.Client, recipient sip.Uri, contact sip.ContactHeader, opts RegisterOptions) (*RegisterTransaction, error) {
+func (p *Phone) register(ctx context.Context, client *sipgo.Client, recipient sip.Uri, contact sip.ContactHeader, opts RegisterOptions, destination string) (*RegisterTransaction, error) {
 	t := NewRegisterTransaction(p.getLoggerCtx(ctx, "Register"), client, recipient, contact, opts)
+	proxy, err := p.outboundProxy(opts.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	preloadRoutes(t.Origin, proxy, opts.Routes)
+	t.hop = registrationHop(recipient, proxy, opts.Routes)
+	if destination != "" {
+		t.Origin.SetDestination(destination)
+	}
 
 	if opts.UnregisterAll {
 		if err := t.Unregister(ctx); err != nil {
@@ -363,14 +589,26 @@ func (p *Phone) register(ctx context.Context, client *sipgo.Client, recipient si
 		}
 	}
 
-	err := t.Register(ctx)
+	err = t.Register(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	p.mu.Lock()
+	p.registration = t
+	p.mu.Unlock()
 	return t, nil
 }
 
+// clearRegistration removes phone registration when it ends, unless newer one replaced it
+func (p *Phone) clearRegistration(t *RegisterTransaction) {
+	p.mu.Lock()
+	if p.registration == t {
+		p.registration = nil
+	}
+	p.mu.Unlock()
+}
+
 type DialResponseError struct {
 	InviteReq  *sip.Request
 	InviteResp *sip.Response
@@ -387,20 +625,52 @@ func (e DialResponseError) Error() string {
 }
 
 type DialOptions struct {
-	// Authentication via digest challenge
+	// Authentication via digest challenge. They are used for INVITE and all requests in dialog
 	Username string
 	Password string
+	// ProxyUsername and ProxyPassword answer 407 of proxy. Default are Username and Password
+	ProxyUsername string
+	ProxyPassword string
 
 	// Custom headers passed on INVITE
 	SipHeaders []sip.Header
 
+	// OutboundProxy overrides phone outbound proxy. Format is sip uri or host[:port]
+	OutboundProxy string
+	// Routes are pre-loaded Route headers after outbound proxy.
+	// If empty Service-Route of phone registration is used when dialing through its registrar
+	Routes []sip.Uri
+
 	// SDP Formats to customize. NOTE: Only ulaw and alaw are fully supported
 	Formats sdp.Formats
 
+	// FollowRedirects dials Contact targets of 3xx responses in q-value order.
+	// Dialog Target returns uri which answered
+	FollowRedirects bool
+	// MaxRedirects limits followed 3xx responses. Default is 5
+	MaxRedirects int
+
+	// OnForkedAnswer is called when forked INVITE is answered by more UAS. Fork is already
+	// ACKed and it is hung up after callback, unless callback returns true to keep it
+	OnForkedAnswer func(fork *ForkedAnswer) bool
+
 	// OnResponse is just callback called after INVITE is sent and all responses before final one
 	// Useful for tracking call state
 	OnResponse func(inviteResp *sip.Response)
 
+	// RTCPInterval enables sending RTCP sender/receiver reports on this interval
+	// and reading remote reports. Check dialog Stats for call quality.
+	// NOTE: RTCP should not be read by caller when this is enabled
+	RTCPInterval time.Duration
+
+	// SRTP enables SDES-SRTP (AES_CM_128_HMAC_SHA1_80) media encryption.
+	// Dialog ReadRTP/WriteRTP encrypt and decrypt transparently
+	SRTP SRTPMode
+
+	// MediaLatch enables symmetric RTP. Media is sent back to source of received RTP
+	// instead of SDP address which is useful for peers behind NAT
+	MediaLatch MediaLatchPolicy
+
 	// OnRefer is called 2 times.
 	// 1st with state NONE and dialog=nil. This is to have caller prepared
 	// 2nd with state Established or Ended with dialog
@@ -408,10 +678,19 @@ type DialOptions struct {
 
 	// Experimental
 	//
-	// OnMedia handles INVITE updates and passes new MediaSession with new propertie
+	// OnMediaUpdate handles INVITE updates and passes new MediaSession with new properties.
+	// It can be read and written as dialog, which sends media to new address
+	OnMediaUpdate func(sess *MediaSession)
+
+	// Deprecated: media.MediaSession has no sockets, as they are owned by dialog, so it can
+	// only be used for SDP state. Use OnMediaUpdate
 	OnMedia func(sess *media.MediaSession)
 }
 
+func (o DialOptions) credentials() digestCredentials {
+	return digestCredentials{o.Username, o.Password, o.ProxyUsername, o.ProxyPassword}
+}
+
 type DialogReferState struct {
 	// Updates current transfer progress with state
 	State sip.DialogState
@@ -588,20 +867,75 @@ func RegisterAndDial(ctx context.Context, params RegisterAndDialParams) (*Regist
 //
 // return DialResponseError in case non 200 responses
 func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions) (*DialogClientSession, error) {
-	log := p.getLoggerCtx(dialCtx, "Dial")
+	if o.FollowRedirects {
+		return p.dialRedirects(dialCtx, recipient, o)
+	}
+	return p.dialURI(dialCtx, recipient, o)
+}
+
+func (p *Phone) dialURI(dialCtx context.Context, recipient sip.Uri, o DialOptions) (*DialogClientSession, error) {
 	ctx, _ := context.WithCancel(dialCtx)
 	// defer cancel()
 
-	network := "udp"
-	if recipient.UriParams != nil {
-		if t := recipient.UriParams["transport"]; t != "" {
-			network = t
-		}
-	}
 	// Remove password from uri.
 	recipient.Password = ""
 
-	server, err := sipgo.NewServer(p.UA)
+	dl, err := p.newDialer(ctx, recipient, o)
+	if err != nil {
+		return nil, err
+	}
+	dialog, err := dl.dial(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+	dl.answered(dialog)
+	return dialog, nil
+}
+
+// dialer is setup of Dial shared by all its INVITEs. They are sent with same client and
+// dialog client cache so that requests in dialog are handled by same server
+type dialer struct {
+	dial func(ctx context.Context, recipient sip.Uri) (*DialogClientSession, error)
+	// answered must be called with dialog which is returned to caller
+	answered func(dialog *DialogClientSession)
+}
+
+// newDialer creates client and server for dialing. Transport and local address are chosen
+// by recipient
+func (p *Phone) newDialer(ctx context.Context, recipient sip.Uri, o DialOptions) (*dialer, error) {
+	if p.optErr != nil {
+		return nil, p.optErr
+	}
+	log := p.getLoggerCtx(ctx, "Dial")
+	proxy, err := p.outboundProxy(o.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	routes := o.Routes
+	reg := p.dialRegistration(recipient, proxy)
+	if len(routes) == 0 && reg != nil {
+		// Dial through our registration if registrar has given Service-Route
+		if serviceRoute := reg.ServiceRoute(); len(serviceRoute) > 0 {
+			if proxy == nil {
+				proxy = reg.hop
+			}
+			routes = serviceRoute
+		}
+	}
+	// Transport and target are of next hop
+	hop := nextHop(recipient, proxy, routes)
+	network := uriTransport(hop)
+
+	targets, err := p.lookupTargets(ctx, hop)
+	if err != nil {
+		return nil, err
+	}
+	target := hop.HostPort()
+	if len(targets) > 0 {
+		network, target = targets[0].network, targets[0].addr
+	}
+
+	server, err := p.newServer()
 	if err != nil {
 		return nil, err
 	}
@@ -615,14 +949,26 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 	// host, listenPort, _ := sip.ParseAddr(listeners[0].Addr)
 
 	// NOTE: this can return empty port, in this case we probably have hostname
-	host, port, err := p.getInterfaceHostPort(network, recipient.HostPort())
+	host, port, err := p.clientLocalHostPort(network, target)
 	if err != nil {
 		return nil, err
 	}
-
-	contactHDR := sip.ContactHeader{
-		Address: sip.Uri{User: p.UA.Name(), Host: host, Port: port},
-		Params:  sip.HeaderParams{"transport": network},
+	// In case of external address media must still bind locally
+	mediaHost := host
+	host, port, err = p.clientHostPort(network, host, port)
+	if err != nil {
+		return nil, err
+	}
+	contactHDR := p.clientContactHeader(host, port, network)
+	if reg != nil {
+		if gruu := reg.gruu(); gruu != nil {
+			// https://datatracker.ietf.org/doc/html/rfc5627#section-4.3
+			contactHDR.Address = *gruu.Clone()
+		} else if reg.Outbound() {
+			// Requests in dialog should reach us over registered flow
+			// https://datatracker.ietf.org/doc/html/rfc5626#section-5.4
+			contactHDR.Address.UriParams.Add("ob", "")
+		}
 	}
 
 	// We will force client to use same interface and port as defined for contact header
@@ -638,7 +984,7 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 	// Setup dialog client
 	dc := sipgo.NewDialogClientCache(client, contactHDR)
 
-	server.OnBye(func(req *sip.Request, tx sip.ServerTransaction) {
+	server.OnBye(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
 		if err := dc.ReadBye(req, tx); err != nil {
 			if errors.Is(err, sipgo.ErrDialogDoesNotExists) {
 				log.Info().Msg("Received BYE but dialog was already closed")
@@ -649,9 +995,9 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 			return
 		}
 		log.Debug().Msg("Received BYE")
-	})
+	}))
 
-	server.OnRefer(func(req *sip.Request, tx sip.ServerTransaction) {
+	server.OnRefer(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
 		if o.OnRefer == nil {
 			log.Warn().Str("req", req.StartLine()).Msg("Refer is not handled. Missing OnRefer")
 			tx.Respond(sip.NewResponseFromRequest(req, sip.StatusMethodNotAllowed, "Method not allowed", nil))
@@ -729,16 +1075,7 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 			}
 
 			// Setup session
-			var rtpIp net.IP
-			if lip := net.ParseIP(host); lip != nil && !lip.IsUnspecified() {
-				rtpIp = lip
-			} else {
-				rtpIp, _, err = sip.ResolveInterfacesIP("ip4", nil)
-				if err != nil {
-					return err
-				}
-			}
-			msess, err := media.NewMediaSession(&net.UDPAddr{IP: rtpIp, Port: 0})
+			dm, err := p.newDialogMedia(mediaHost, log)
 			if err != nil {
 				return err
 			}
@@ -750,26 +1087,24 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 				notify := sip.NewRequest(sip.NOTIFY, req.Contact().Address)
 				notify.AppendHeader(sip.NewHeader("Content-Type", "message/sipfrag;version=2.0"))
 				notify.SetBody([]byte("SIP/2.0 100 Trying"))
-				cliTx, err := dialog.TransactionRequest(dialog.Context(), notify)
-				if err != nil {
-					return err
-				}
-				defer cliTx.Terminate()
-
-				select {
-				case <-cliTx.Done():
-				case res := <-cliTx.Responses():
-					notifyAccepted = res.StatusCode == sip.StatusOK
-				}
+				res, err := dialogDo(dialog.Context(), dialog, notify, o.credentials())
+				notifyAccepted = err == nil && res.StatusCode == sip.StatusOK
 			}
 
 			invite := sip.NewRequest(sip.INVITE, referUri)
 			invite.SetTransport(network)
+			preloadRoutes(invite, proxy, routes)
 			invite.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
-			invite.SetBody(msess.LocalSDP())
+			sdpSend, err := srtpOffer(p.localSDP(dm), o.SRTP)
+			if err != nil {
+				dm.Close()
+				return err
+			}
+			invite.SetBody(sdpSend)
 
-			newDialog, err = p.dial(context.TODO(), dc, invite, msess, o)
+			newDialog, err = p.dial(context.TODO(), client, dc, invite, dm, o)
 			if err != nil {
+				dm.Close()
 				return err
 			}
 
@@ -777,11 +1112,9 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 				notify := sip.NewRequest(sip.NOTIFY, req.Contact().Address)
 				notify.AppendHeader(sip.NewHeader("Content-Type", "message/sipfrag;version=2.0"))
 				notify.SetBody([]byte("SIP/2.0 200 OK"))
-				cliTx, err := dialog.TransactionRequest(dialog.Context(), notify)
-				if err != nil {
+				if _, err := dialogDo(dialog.Context(), dialog, notify, o.credentials()); err != nil {
 					return err
 				}
-				defer cliTx.Terminate()
 			}
 			return nil
 		}
@@ -803,12 +1136,12 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 		// defer dialog.Bye(context.TODO())
 
 		o.OnRefer(DialogReferState{State: sip.DialogStateConfirmed, Dialog: newDialog})
-	})
+	}))
 
 	var dialogRef *DialogClientSession
 	// waitingAck := atomic.
 
-	server.OnInvite(func(req *sip.Request, tx sip.ServerTransaction) {
+	server.OnInvite(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
 		id, err := sip.UACReadRequestDialogID(req)
 		if err != nil {
 			tx.Respond(sip.NewResponseFromRequest(req, sip.StatusBadRequest, "Bad Request", nil))
@@ -820,6 +1153,11 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 			return
 		}
 
+		if h := dialogRef.reinvite.get(); h != nil {
+			h(req, tx)
+			return
+		}
+
 		// Forking current dialog session and applying new SDP
 		msess := dialogRef.MediaSession.Fork()
 
@@ -828,21 +1166,28 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 			return
 		}
 
+		// Media of dialog is sent to new address
+		dialogRef.dmedia.setRemote(msess.Raddr)
+
 		log.Info().
 			Str("formats", logFormats(msess.Formats)).
 			Str("localAddr", msess.Laddr.String()).
 			Str("remoteAddr", msess.Raddr.String()).
 			Msg("Media/RTP session updated")
 
-		if o.OnMedia != nil {
-			o.OnMedia(msess)
+		if o.OnMediaUpdate != nil || o.OnMedia != nil {
+			if o.OnMediaUpdate != nil {
+				o.OnMediaUpdate(msess)
+			} else {
+				o.OnMedia(msess.MediaSession)
+			}
 			tx.Respond(sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil))
 			return
 		}
 		tx.Respond(sip.NewResponseFromRequest(req, sip.StatusMethodNotAllowed, "Method not allowed", nil))
-	})
+	}))
 
-	server.OnAck(func(req *sip.Request, tx sip.ServerTransaction) {
+	server.OnAck(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
 		// This gets received when we send 200 on INVITE media update
 		id, err := sip.UACReadRequestDialogID(req)
 		if err != nil {
@@ -854,7 +1199,7 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 			tx.Respond(sip.NewResponseFromRequest(req, sip.StatusNotFound, "Dialog does not exist", nil))
 			return
 		}
-	})
+	}))
 
 	// Start server
 	// for _, l := range listeners {
@@ -862,63 +1207,124 @@ func (p *Phone) Dial(dialCtx context.Context, recipient sip.Uri, o DialOptions)
 	// 	go l.Listen()
 	// }
 
-	// Setup session
-	var rtpIp net.IP
-	if lip := net.ParseIP(host); lip != nil && !lip.IsUnspecified() {
-		rtpIp = lip
-	} else {
-		rtpIp, _, err = sip.ResolveInterfacesIP("ip4", nil)
+	// Targets are resolved once per hop
+	var resolvedMu sync.Mutex
+	resolved := map[string][]sipTarget{targetCacheKey(hop): targets}
+
+	dl := &dialer{}
+	dl.dial = func(ctx context.Context, recipient sip.Uri) (*DialogClientSession, error) {
+		recipient.Password = ""
+		hop := nextHop(recipient, proxy, routes)
+		key := targetCacheKey(hop)
+		resolvedMu.Lock()
+		targets, exists := resolved[key]
+		resolvedMu.Unlock()
+		if !exists {
+			var err error
+			targets, err = p.lookupTargets(ctx, hop)
+			if err != nil {
+				return nil, err
+			}
+			resolvedMu.Lock()
+			resolved[key] = targets
+			resolvedMu.Unlock()
+		}
+		targetNetwork := uriTransport(hop)
+		if len(targets) > 0 {
+			targetNetwork = targets[0].network
+		}
+		if targetNetwork != network {
+			return nil, fmt.Errorf("transport %s of %s differs from dialing transport %s", targetNetwork, recipient.String(), network)
+		}
+
+		// Setup session
+		dm, err := p.newDialogMedia(mediaHost, log)
 		if err != nil {
 			return nil, err
 		}
-	}
-	msess, err := media.NewMediaSession(&net.UDPAddr{IP: rtpIp, Port: 0})
-	if err != nil {
-		return nil, err
-	}
 
-	// Create Generic SDP
-	if len(o.Formats) > 0 {
-		msess.Formats = o.Formats
-	}
-	sdpSend := msess.LocalSDP()
+		// Create Generic SDP
+		if len(o.Formats) > 0 {
+			dm.sess.Formats = o.Formats
+		}
+		sdpSend, err := srtpOffer(p.localSDP(dm), o.SRTP)
+		if err != nil {
+			dm.Close()
+			return nil, err
+		}
 
-	// Creating INVITE
-	req := sip.NewRequest(sip.INVITE, recipient)
-	req.SetTransport(network)
-	req.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
-	req.SetBody(sdpSend)
+		// Creating INVITE
+		req := sip.NewRequest(sip.INVITE, recipient)
+		req.SetTransport(network)
+		preloadRoutes(req, proxy, routes)
+		req.AppendHeader(sip.NewHeader("Content-Type", "application/sdp"))
+		req.SetBody(sdpSend)
+
+		// Add custom headers
+		for _, h := range o.SipHeaders {
+			log.Info().Str(h.Name(), h.Value()).Msg("Adding SIP header")
+			req.AppendHeader(h)
+		}
 
-	// Add custom headers
-	for _, h := range o.SipHeaders {
-		log.Info().Str(h.Name(), h.Value()).Msg("Adding SIP header")
-		req.AppendHeader(h)
+		dialog, err := p.dialTargets(ctx, client, dc, req, dm, o, hop, targets)
+		if err != nil {
+			dm.Close()
+			return nil, err
+		}
+		dialog.target = recipient
+		return dialog, nil
 	}
-
-	dialog, err := p.dial(ctx, dc, req, msess, o)
-	if err != nil {
-		return nil, err
+	dl.answered = func(dialog *DialogClientSession) {
+		dialogRef = dialog
+		p.acl.addDialog(&dialog.Dialog)
+		dialog.onClose = func() { p.acl.removeDialog(&dialog.Dialog) }
+		p.keepAlive(dialog.Context(), network, net.JoinHostPort(host, strconv.Itoa(port)))
 	}
-
-	dialogRef = dialog
-
-	return dialog, nil
+	return dl, nil
 }
 
-func (p *Phone) dial(ctx context.Context, dc *sipgo.DialogClientCache, invite *sip.Request, msess *media.MediaSession, o DialOptions) (*DialogClientSession, error) {
+func (p *Phone) dial(ctx context.Context, client *sipgo.Client, dc *sipgo.DialogClientCache, invite *sip.Request, dm *dialogMedia, o DialOptions) (*DialogClientSession, error) {
 	log := p.getLoggerCtx(ctx, "Dial")
-	dialog, err := dc.WriteInvite(ctx, invite)
-	if err != nil {
-		return nil, err
+	// Challenges are answered with new INVITE transaction as dialog can not use
+	// separate proxy and UAS credentials
+	chals := newDigestChallenges(o.credentials())
+	for i := 0; ; i++ {
+		p.inviteMu.Lock()
+		dialog, err := dc.WriteInvite(ctx, invite)
+		p.inviteMu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		p.logSipRequest(&log, invite)
+		watchKey := p.watchForks(client, invite)
+		d, err := p.dialWaitAnswer(ctx, dialog, dm, o)
+
+		if err != nil {
+			p.unwatchForks(watchKey)
+			// Remove failed dialog from cache as it can be shared by many INVITEs
+			dialog.Close()
+		} else {
+			p.answeredForks(watchKey, responseToTag(dialog.InviteResponse), o)
+		}
+
+		var rerr *DialResponseError
+		if !errors.As(err, &rerr) || !isDigestChallenge(rerr.InviteResp) || i == maxDigestRetries {
+			return d, err
+		}
+		if aerr := chals.authorize(invite, rerr.InviteResp); aerr != nil {
+			return nil, err
+		}
+		invite.RemoveHeader("Via")
 	}
-	p.logSipRequest(&log, invite)
-	return p.dialWaitAnswer(ctx, dialog, msess, o)
 }
 
-func (p *Phone) dialWaitAnswer(ctx context.Context, dialog *sipgo.DialogClientSession, msess *media.MediaSession, o DialOptions) (*DialogClientSession, error) {
+func (p *Phone) dialWaitAnswer(ctx context.Context, dialog *sipgo.DialogClientSession, dm *dialogMedia, o DialOptions) (*DialogClientSession, error) {
 	log := p.getLoggerCtx(ctx, "Dial")
 	invite := dialog.InviteRequest
-	// Wait 200
+
+	// Wait 200. When ctx is done CANCEL is sent, but only after provisional response, so
+	// we wait for it. Without any response transaction times out after Timer B
+	// https://datatracker.ietf.org/doc/html/rfc3261#section-9.1
 	waitStart := time.Now()
 	err := dialog.WaitAnswer(ctx, sipgo.AnswerOptions{
 		OnResponse: func(res *sip.Response) error {
@@ -928,10 +1334,14 @@ func (p *Phone) dialWaitAnswer(ctx context.Context, dialog *sipgo.DialogClientSe
 			}
 			return nil
 		},
-		Username: o.Username,
-		Password: o.Password,
 	})
 
+	if err != nil && dialog.InviteResponse != nil && dialog.InviteResponse.IsSuccess() {
+		// 2xx crossed CANCEL. Call is established on other side so it must be ACKed and hung up
+		p.hangupAnswer(dialog, "answered after cancel", log)
+		return nil, err
+	}
+
 	var rerr *sipgo.ErrDialogResponse
 	if errors.As(err, &rerr) {
 		return nil, &DialResponseError{
@@ -946,6 +1356,7 @@ func (p *Phone) dialWaitAnswer(ctx context.Context, dialog *sipgo.DialogClientSe
 	}
 
 	r := dialog.InviteResponse
+	dialogRouteSet(dialog)
 	log.Info().
 		Int("code", int(r.StatusCode)).
 		// Str("reason", r.Reason).
@@ -953,16 +1364,22 @@ func (p *Phone) dialWaitAnswer(ctx context.Context, dialog *sipgo.DialogClientSe
 		Msg("Call answered")
 
 	// Setup media
+	msess := dm.sess
 	err = msess.RemoteSDP(r.Body())
-	// TODO handle bad SDP
 	if err != nil {
-		return nil, err
+		// Call is established on other side even if we can not use its media
+		p.hangupAnswer(dialog, "bad SDP", log)
+		return nil, fmt.Errorf("bad SDP in answer: %w", err)
 	}
+	dm.setRemote(msess.Raddr)
+
+	srtpSess, srtpErr := srtpNegotiated(invite.Body(), r.Body(), o.SRTP)
 
 	log.Info().
 		Str("formats", logFormats(msess.Formats)).
 		Str("localAddr", msess.Laddr.String()).
 		Str("remoteAddr", msess.Raddr.String()).
+		Bool("srtp", srtpSess != nil).
 		Msg("Media/RTP session created")
 
 	// Send ACK
@@ -970,10 +1387,63 @@ func (p *Phone) dialWaitAnswer(ctx context.Context, dialog *sipgo.DialogClientSe
 		return nil, fmt.Errorf("fail to send ACK: %w", err)
 	}
 
-	return &DialogClientSession{
-		MediaSession:        msess,
+	if srtpErr != nil {
+		// Call is established so we need to terminate it
+		if err := dialog.Bye(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to send BYE")
+		}
+		return nil, srtpErr
+	}
+
+	d := &DialogClientSession{
+		MediaSession:        newMediaSession(dm),
 		DialogClientSession: dialog,
-	}, nil
+		dmedia:              dm,
+		auth:                o.credentials(),
+		ua:                  p.UA,
+	}
+	d.dmedia.srtp = srtpSess
+	d.dmedia.setLatch(o.MediaLatch)
+	if sdpHasICE(r.Body()) {
+		d.dmedia.setICE(iceLiteFromSDP(invite.Body()))
+	}
+	if o.RTCPInterval > 0 {
+		d.dmedia.monitorRTCP(dialog.Context(), o.RTCPInterval)
+	}
+	return d, nil
+}
+
+// dialogRouteSet removes pre-loaded routes from INVITE of dialog when response has Record-Route.
+// Route set of dialog is then Record-Route and pre-loaded routes would be duplicated on ACK and BYE.
+// Sent INVITE is still held by transaction, so dialog gets clone without them
+func dialogRouteSet(dialog *sipgo.DialogClientSession) {
+	invite := dialog.InviteRequest
+	if len(dialog.InviteResponse.GetHeaders("Record-Route")) == 0 || invite.Route() == nil {
+		return
+	}
+	dinvite := invite.Clone()
+	dinvite.SetBody(invite.Body())
+	removeHeaders(dinvite, "Route")
+	dialog.InviteRequest = dinvite
+}
+
+// hangupAnswer ACKs and hangs up call which is answered but we can not take, ex answered
+// after we stopped waiting. 2xx must be ACKed, otherwise it is retransmitted
+// https://datatracker.ietf.org/doc/html/rfc3261#section-15
+func (p *Phone) hangupAnswer(dialog *sipgo.DialogClientSession, reason string, log zerolog.Logger) {
+	log.Info().Str("response", dialog.InviteResponse.StartLine()).Str("reason", reason).Msg("Hanging up answered call")
+	dialogRouteSet(dialog)
+	if err := dialog.Ack(context.Background()); err != nil {
+		log.Error().Err(err).Msg("Failed to ACK answer")
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sip.Timer_B)
+		defer cancel()
+		if err := dialog.Bye(ctx); err != nil {
+			log.Error().Err(err).Msg("Failed to hang up answer")
+		}
+	}()
 }
 
 var (
@@ -992,18 +1462,49 @@ type AnswerOptions struct {
 	Username string
 	Password string
 	Realm    string //default sipgo
+	// Authorizer authorizes INVITE with its credential store instead of Username/Password.
+	// It can be shared between Answer calls and other handlers
+	Authorizer *DigestAuthorizer
+	// ProxyUsername and ProxyPassword answer 407 of requests sent in dialog.
+	// With RegisterAddr Username and Password answer 401 and 407
+	ProxyUsername string
+	ProxyPassword string
 
 	RegisterAddr string //If defined it will keep registration in background
+	// InstanceID and RegID register outbound flow (RFC 5626) with RegisterAddr.
+	// Calls are then received on registered flow instead of listener
+	InstanceID string
+	RegID      int
+	// GRUU requests GRUU with registration which is then used as Contact
+	GRUU bool
 
 	// For SDP codec manipulating
 	Formats sdp.Formats
 
+	// RTCPInterval enables sending RTCP sender/receiver reports on this interval
+	// and reading remote reports. Check dialog Stats for call quality.
+	// NOTE: RTCP should not be read by caller when this is enabled
+	RTCPInterval time.Duration
+
+	// SRTP enables SDES-SRTP (AES_CM_128_HMAC_SHA1_80) media encryption.
+	// Dialog ReadRTP/WriteRTP encrypt and decrypt transparently
+	SRTP SRTPMode
+
+	// MediaLatch enables symmetric RTP. Media is sent back to source of received RTP
+	// instead of SDP address which is useful for peers behind NAT
+	MediaLatch MediaLatchPolicy
+
 	// OnCall is just INVITE request handler that you can use to notify about incoming call
 	// After this dialog should be created and you can watch your changes with dialog.State
 	// -1 == Cancel
 	// 0 == continue
 	// >0 different response
+	// Deprecated: use OnCallDecision
 	OnCall func(inviteRequest *sip.Request) int
+	// OnCallDecision decides about incoming call and is used instead of OnCall.
+	// It runs in own goroutine so it can block, for example on database lookup.
+	// Context is canceled if caller cancels call. Rejected call does not stop Answer
+	OnCallDecision func(ctx context.Context, inviteRequest *sip.Request) CallDecision
 
 	// Default is 200 (answer a call)
 	AnswerCode   sip.StatusCode
@@ -1029,14 +1530,18 @@ func (p *Phone) Answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 }
 
 func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServerSession, error) {
+	if p.optErr != nil {
+		return nil, p.optErr
+	}
 	log := p.getLoggerCtx(ansCtx, "Answer")
-	ringtime := opts.Ringtime
 
 	waitDialog := make(chan *DialogServerSession)
 	var d *DialogServerSession
+	// answered is returned dialog. Its requests keep coming to our handlers
+	var answered atomic.Pointer[DialogServerSession]
 
 	// TODO reuse server and listener
-	server, err := sipgo.NewServer(p.UA)
+	server, err := p.newServer()
 	if err != nil {
 		return nil, err
 	}
@@ -1063,23 +1568,45 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 	}
 
 	lhost, lport, _ := sip.ParseAddr(listeners[0].Addr)
-	contactHdr := sip.ContactHeader{
-		Address: sip.Uri{
-			User:      p.UA.Name(),
-			Host:      lhost,
-			Port:      lport,
-			Headers:   sip.HeaderParams{"transport": listeners[0].Network},
-			UriParams: sip.NewParams(),
-		},
-		Params: sip.NewParams(),
-	}
+	chost, cport := p.externalHostPort(lhost, lport)
+	contactHdr := p.contactHeader(chost, cport, listeners[0].Network)
 
 	// Create client handle for responding
-	client, err := sipgo.NewClient(p.UA,
+	clientOpts := []sipgo.ClientOption{
 		sipgo.WithClientNAT(), // needed for registration
 		sipgo.WithClientHostname(lhost),
 		// Do not use with ClientPort as we want always this to be a seperate connection
-	)
+	}
+	if p.externalIP != nil && listeners[0].Network == "udp" {
+		// Listener is seen with external address so we must go through it to have it in Via
+		clientOpts = []sipgo.ClientOption{
+			sipgo.WithClientNAT(),
+			sipgo.WithClientHostname(chost),
+			sipgo.WithClientPort(cport),
+		}
+	}
+	// With outbound we register from own flow and requests are received on it instead of listener
+	outbound := opts.RegisterAddr != "" && opts.InstanceID != "" && opts.RegID > 0
+	network := listeners[0].Network
+	flowHost, flowPort := lhost, lport
+	var flow *flowConn
+	if outbound && (network == "udp" || isStreamTransport(network)) {
+		if network == "udp" {
+			flow, flowHost, flowPort, err = p.serveFlowUDP(lhost)
+		} else {
+			flowHost, flowPort, err = p.clientLocalHostPort(network, opts.RegisterAddr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		contactHdr = p.contactHeader(flowHost, flowPort, network)
+		clientOpts = []sipgo.ClientOption{
+			sipgo.WithClientNAT(),
+			sipgo.WithClientHostname(flowHost),
+			sipgo.WithClientPort(flowPort),
+		}
+	}
+	client, err := sipgo.NewClient(p.UA, clientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -1091,9 +1618,14 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 		// Keep registration
 		rhost, rport, _ := sip.ParseAddr(opts.RegisterAddr)
 		registerURI := sip.Uri{
-			Host: rhost,
-			Port: rport,
-			User: p.UA.Name(),
+			Host:      rhost,
+			Port:      rport,
+			User:      p.UA.Name(),
+			UriParams: sip.NewParams(),
+		}
+		if network != "udp" {
+			// Register over same transport as we listen
+			registerURI.UriParams.Add("transport", network)
 		}
 		if opts.Expiry == 0 {
 			opts.Expiry = 1800 // 註冊過期時間預設為1800秒 (30分鐘)
@@ -1105,7 +1637,10 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 			Expiry:   opts.Expiry, // 註冊過期時間 2025-03-18 Jacksu
 			// UnregisterAll: true,
 			// AllowHeaders: server.RegisteredMethods(),
-		})
+			InstanceID: opts.InstanceID,
+			RegID:      opts.RegID,
+			GRUU:       opts.GRUU,
+		}, "")
 		if err != nil {
 			return nil, err
 		}
@@ -1113,10 +1648,21 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 		// In case our register changed contact due to NAT detection via rport, lets update
 		contact := regTr.Origin.Contact()
 		contactHdr = *contact.Clone()
+		// Registration params are not part of dialog contact
+		contactHdr.Params.Remove("+sip.instance").Remove("reg-id")
+		if gruu := regTr.gruu(); gruu != nil {
+			contactHdr.Address = *gruu.Clone()
+		} else if regTr.Outbound() {
+			contactHdr.Address.UriParams.Add("ob", "")
+		}
+		if regTr.Outbound() {
+			p.flowKeepAlive(ctx, regTr, network, net.JoinHostPort(flowHost, strconv.Itoa(flowPort)), opts.RegisterAddr, flow)
+		}
 
 		origStopAnswer := stopAnswer
 		// Override stopAnswer with unregister
 		stopAnswer = sync.OnceFunc(func() {
+			p.clearRegistration(regTr)
 			ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 			err := regTr.Unregister(ctx)
 			if err != nil {
@@ -1133,28 +1679,21 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 	}
 
 	ds := sipgo.NewDialogServerCache(client, contactHdr)
-	var chal *digest.Challenge
-	server.OnInvite(func(req *sip.Request, tx sip.ServerTransaction) {
-		if d != nil {
-			didAnswered, _ := sip.MakeDialogIDFromResponse(d.InviteResponse)
-			did, _ := sip.MakeDialogIDFromRequest(req)
-			if did == didAnswered {
-
-				// We received INVITE for update
-				if err := d.MediaSession.RemoteSDP(req.Body()); err != nil {
-					res := sip.NewResponseFromRequest(req, 400, err.Error(), nil)
-					if err := tx.Respond(res); err != nil {
-						log.Error().Err(err).Msg("Fail to send 400")
-						return
-					}
-					return
-				}
+	// Credentials for requests we send in dialog. Username and Password are our account only with registration
+	dialogAuth := digestCredentials{proxyUsername: opts.ProxyUsername, proxyPassword: opts.ProxyPassword}
+	if opts.RegisterAddr != "" {
+		dialogAuth.username, dialogAuth.password = opts.Username, opts.Password
+	}
+	routes := newCallRoutes(p.router, opts)
+	server.OnInvite(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
+		if a := answered.Load(); a != nil && a.inDialog(req) {
+			a.readReInvite(req, tx, log)
+			return
+		}
 
-				res := sip.NewResponseFromRequest(req, 200, "OK", nil)
-				if err := tx.Respond(res); err != nil {
-					log.Error().Err(err).Msg("Fail to send 200")
-					return
-				}
+		if d != nil {
+			if d.inDialog(req) {
+				d.readReInvite(req, tx, log)
 				return
 			}
 			log.Error().Msg("Received second INVITE is not yet supported: 486 busy here")
@@ -1166,65 +1705,34 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 			return
 		}
 
-		// We authorize request if password provided and no register addr defined
+		// With router call is answered with options of matched route
+		route := routes.route(req)
+		if route == nil {
+			code, reason := routes.reject()
+			log.Info().Str("recipient", req.Recipient.String()).Int("code", int(code)).Msg("No call route matched")
+			res := sip.NewResponseFromRequest(req, code, reason, nil)
+			if err := tx.Respond(res); err != nil {
+				log.Error().Err(err).Msg("Failed to reject call")
+			}
+			return
+		}
+		opts, auth := route.opts, route.auth
+		ringtime := opts.Ringtime
+		callAuth := dialogAuth
+		if opts.ProxyPassword != "" {
+			callAuth.proxyUsername, callAuth.proxyPassword = opts.ProxyUsername, opts.ProxyPassword
+		}
+
+		// We authorize request if credentials provided and no register addr defined
 		// Use cases:
 		// 1. INVITE auth like registrar before processing INVITE
 		// 2. Auto answering client which keeps registration and accepts calls
-		if opts.Password != "" && opts.RegisterAddr == "" {
-			// https://www.rfc-editor.org/rfc/rfc2617#page-6
-			h := req.GetHeader("Authorization")
-
-			if h == nil {
-				if chal != nil {
-					// If challenge is created next is forbidden
-					res := sip.NewResponseFromRequest(req, 403, "Forbidden", nil)
-					tx.Respond(res)
-					return
-				}
-
-				if opts.Realm == "" {
-					opts.Realm = "sipgo"
-				}
-
-				chal = &digest.Challenge{
-					Realm: opts.Realm,
-					Nonce: fmt.Sprintf("%d", time.Now().UnixMicro()),
-					// Opaque:    "sipgo",
-					Algorithm: "MD5",
-				}
-
-				res := sip.NewResponseFromRequest(req, 401, "Unathorized", nil)
-				res.AppendHeader(sip.NewHeader("WWW-Authenticate", chal.String()))
-				tx.Respond(res)
-				return
-			}
-
-			cred, err := digest.ParseCredentials(h.Value())
-			if err != nil {
-				log.Error().Err(err).Msg("parsing creds failed")
-				tx.Respond(sip.NewResponseFromRequest(req, 401, "Bad credentials", nil))
-				return
-			}
-
-			// Make digest and compare response
-			digCred, err := digest.Digest(chal, digest.Options{
-				Method:   "INVITE",
-				URI:      cred.URI,
-				Username: opts.Username,
-				Password: opts.Password,
-			})
-
-			if err != nil {
-				log.Error().Err(err).Msg("Calc digest failed")
-				tx.Respond(sip.NewResponseFromRequest(req, 401, "Bad credentials", nil))
-				return
-			}
-
-			if cred.Response != digCred.Response {
-				tx.Respond(sip.NewResponseFromRequest(req, 401, "Unathorized", nil))
+		if auth != nil {
+			username, ok := auth.Authorize(ctx, req, tx)
+			if !ok {
 				return
 			}
-			log.Info().Str("username", cred.Username).Str("source", req.Source()).Msg("INVITE authorized")
+			log.Info().Str("username", username).Str("source", req.Source()).Msg("INVITE authorized")
 		}
 		p.logSipRequest(&log, req)
 
@@ -1241,23 +1749,39 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 		}
 
 		err = func() error {
-			if opts.OnCall != nil {
-				// Handle OnCall handler
-				res := opts.OnCall(req)
-				switch {
-				case res < 0:
-					if err := dialog.Respond(sip.StatusBusyHere, "Busy", nil); err != nil {
-						d = nil
-						return fmt.Errorf("failed to respond oncall status code %d: %w", res, err)
-					}
-				case res > 0:
-					if err := dialog.Respond(sip.StatusCode(res), "", nil); err != nil {
-						d = nil
-						return fmt.Errorf("failed to respond oncall status code %d: %w", res, err)
-					}
+			trying := false
+			if opts.OnCallDecision != nil {
+				// Let caller know we are deciding
+				res := sip.NewResponseFromRequest(req, 100, "Trying", nil)
+				if err := dialog.WriteResponse(res); err != nil {
+					return fmt.Errorf("failed to send 100 response: %w", err)
 				}
+				p.logSipResponse(&log, res)
+				trying = true
 			}
 
+			decision, err := decideCall(ctx, tx, req, opts)
+			if err != nil {
+				return err
+			}
+			if decision.rejects() {
+				if err := dialog.WriteResponse(decision.response(req)); err != nil {
+					return fmt.Errorf("failed to respond call decision %d: %w", int(decision.Code), err)
+				}
+				p.logSipResponse(&log, dialog.InviteResponse)
+				return errCallRejected
+			}
+			if decision.provisional() {
+				res := decision.response(req)
+				if err := dialog.WriteResponse(res); err != nil {
+					return fmt.Errorf("failed to send call decision %d: %w", int(decision.Code), err)
+				}
+				p.logSipResponse(&log, res)
+				trying = true
+			}
+			// New slice as headers of options are shared between calls
+			opts.SipHeaders = slices.Concat(opts.SipHeaders, decision.Headers)
+
 			if opts.AnswerCode > 0 && opts.AnswerCode != sip.StatusOK {
 				log.Info().Int("code", int(opts.AnswerCode)).Msg("Answering call")
 				if opts.AnswerReason == "" {
@@ -1280,8 +1804,12 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 
 				d = &DialogServerSession{
 					DialogServerSession: dialog,
+					auth:                callAuth,
+					route:               route.name,
+					ua:                  p.UA,
 					// done:                make(chan struct{}),
 				}
+				p.acl.addDialog(&dialog.Dialog)
 				select {
 				case <-tx.Done():
 					return tx.Err()
@@ -1304,6 +1832,24 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 				return fmt.Errorf("fail to setup client handle: %w", err)
 			}
 
+			contentType := req.ContentType()
+			if contentType == nil || contentType.Value() != "application/sdp" {
+				return fmt.Errorf("no SDP in INVITE provided")
+			}
+
+			// Media is created before ringing, so that STUN discovery runs meanwhile
+			dm, err := p.newDialogMedia(lhost, log)
+			if err != nil {
+				return err
+			}
+			// Once answered media is closed with dialog
+			answered := false
+			defer func() {
+				if !answered {
+					dm.Close()
+				}
+			}()
+
 			// Now place a ring tone or do autoanswer
 			if ringtime > 0 {
 				res := sip.NewResponseFromRequest(req, 180, "Ringing", nil)
@@ -1320,7 +1866,7 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 				case <-time.After(ringtime):
 					// Ring time finished
 				}
-			} else {
+			} else if !trying {
 				// Send progress
 				res := sip.NewResponseFromRequest(req, 100, "Trying", nil)
 				if err := dialog.WriteResponse(res); err != nil {
@@ -1330,25 +1876,7 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 				p.logSipResponse(&log, res)
 			}
 
-			contentType := req.ContentType()
-			if contentType == nil || contentType.Value() != "application/sdp" {
-				return fmt.Errorf("no SDP in INVITE provided")
-			}
-
-			var ip net.IP
-			if lip := net.ParseIP(lhost); lip != nil && !lip.IsUnspecified() {
-				ip = lip
-			} else {
-				ip, _, err = sip.ResolveInterfacesIP("ip4", nil)
-				if err != nil {
-					return err
-				}
-			}
-
-			msess, err := media.NewMediaSession(&net.UDPAddr{IP: ip, Port: 0})
-			if err != nil {
-				return err
-			}
+			msess := dm.sess
 			// Set our custom formats in this negotiation
 			if len(opts.Formats) > 0 {
 				msess.Formats = opts.Formats
@@ -1358,14 +1886,24 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 			if err != nil {
 				return err
 			}
+			dm.setRemote(msess.Raddr)
+
+			sdpSend, srtpSess, err := srtpAnswer(req.Body(), p.localSDP(dm), opts.SRTP)
+			if err != nil {
+				if err := dialog.Respond(sip.StatusNotAcceptableHere, "Not Acceptable Here", nil); err != nil {
+					log.Error().Err(err).Msg("Failed to send 488 response")
+				}
+				return err
+			}
 
 			log.Info().
 				Str("formats", logFormats(msess.Formats)).
 				Str("localAddr", msess.Laddr.String()).
 				Str("remoteAddr", msess.Raddr.String()).
+				Bool("srtp", srtpSess != nil).
 				Msg("Media/RTP session created")
 
-			res := sip.NewSDPResponseFromRequest(req, msess.LocalSDP())
+			res := sip.NewSDPResponseFromRequest(req, sdpSend)
 
 			// via, _ := res.Via()
 			// via.Params["received"] = rhost
@@ -1379,15 +1917,32 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 
 			d = &DialogServerSession{
 				DialogServerSession: dialog,
-				MediaSession:        msess,
+				MediaSession:        newMediaSession(dm),
+				dmedia:              dm,
+				auth:                callAuth,
+				route:               route.name,
+				ua:                  p.UA,
 				// done:                make(chan struct{}),
 			}
+			p.acl.addDialog(&dialog.Dialog)
+			d.dmedia.srtp = srtpSess
+			d.dmedia.setLatch(opts.MediaLatch)
+			if sdpHasICE(req.Body()) {
+				d.dmedia.setICE(iceLiteFromSDP(sdpSend))
+			}
+			if opts.RTCPInterval > 0 {
+				d.dmedia.monitorRTCP(dialog.Context(), opts.RTCPInterval)
+			}
+
+			// Response has Record-Route copied, so dialog can now have route set order of UAS
+			uasRouteSet(dialog)
 
 			log.Info().Msg("Answering call")
 			if err := dialog.WriteResponse(res); err != nil {
 				d = nil
 				return fmt.Errorf("fail to send 200 response: %w", err)
 			}
+			answered = true
 			p.logSipResponse(&log, res)
 
 			select {
@@ -1403,19 +1958,29 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 			return nil
 		}()
 
+		if errors.Is(err, errCallRejected) {
+			// Keep waiting for next call
+			dialog.Close()
+			return
+		}
 		if err != nil {
 			dialog.Close()
 			exitError(err)
 			stopAnswer()
 		}
 
-	})
+	}))
+
+	server.OnAck(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
+		if a := answered.Load(); a != nil && a.inDialog(req) {
+			// ACK of re-INVITE
+			return
+		}
 
-	server.OnAck(func(req *sip.Request, tx sip.ServerTransaction) {
 		// This on 2xx
 		if d == nil {
-			if chal != nil {
-				// Ack is for authorization
+			if routes.mayReject() {
+				// Ack is for authorization or rejected call
 				return
 			}
 
@@ -1437,9 +2002,9 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 		}
 
 		// Needs check for SDP is right?
-	})
+	}))
 
-	server.OnBye(func(req *sip.Request, tx sip.ServerTransaction) {
+	server.OnBye(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
 		if err := ds.ReadBye(req, tx); err != nil {
 			exitError(fmt.Errorf("dialog BYE err: %w", err))
 			return
@@ -1452,12 +2017,12 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 		// 	close(d.done)
 		// 	d = nil
 		// }
-	})
+	}))
 
-	server.OnOptions(func(req *sip.Request, tx sip.ServerTransaction) {
+	server.OnOptions(p.filterRequest(func(req *sip.Request, tx sip.ServerTransaction) {
 		res := sip.NewResponseFromRequest(req, 200, "OK", nil)
 		tx.Respond(res)
-	})
+	}))
 
 	for _, l := range listeners {
 		log.Info().Str("network", l.Network).Str("addr", l.Addr).Msg("Listening on")
@@ -1472,7 +2037,12 @@ func (p *Phone) answer(ansCtx context.Context, opts AnswerOptions) (*DialogServe
 	select {
 	case d = <-waitDialog:
 		// Make sure we have cleanup after dialog stop
-		d.onClose = stopAnswer
+		dialog := &d.Dialog
+		d.onClose = func() {
+			p.acl.removeDialog(dialog)
+			stopAnswer()
+		}
+		answered.Store(d)
 		return d, nil
 	case <-ctx.Done():
 		// Check is this caller stopped answer
@@ -1524,10 +2094,15 @@ func (p *Phone) logSipResponse(log *zerolog.Logger, res *sip.Response) {
 		Msg("Response")
 }
 
+var errTransactionDied = fmt.Errorf("transaction died")
+
 func getResponse(ctx context.Context, tx sip.ClientTransaction) (*sip.Response, error) {
 	select {
 	case <-tx.Done():
-		return nil, fmt.Errorf("transaction died")
+		if err := tx.Err(); err != nil {
+			return nil, fmt.Errorf("%w: %w", errTransactionDied, err)
+		}
+		return nil, errTransactionDied
 	case res := <-tx.Responses():
 		return res, nil
 	case <-ctx.Done():
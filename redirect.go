@@ -0,0 +1,129 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// Following of 3xx redirects. Contacts are tried in q-value order and each uri is dialed
+// only once to avoid loops
+// https://datatracker.ietf.org/doc/html/rfc3261#section-8.1.3.4
+
+var (
+	ErrMaxRedirects = fmt.Errorf("max redirects reached")
+)
+
+const defaultMaxRedirects = 5
+
+// dialRedirects dials recipient and follows redirects. Contacts of redirect are tried before
+// remaining ones, so redirect chain is followed first
+func (p *Phone) dialRedirects(ctx context.Context, recipient sip.Uri, o DialOptions) (*DialogClientSession, error) {
+	log := p.getLoggerCtx(ctx, "Dial")
+	maxRedirects := o.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
+	visited := map[string]bool{redirectKey(recipient): true}
+	targets := []sip.Uri{recipient}
+	redirects := 0
+	var lastErr error
+	for len(targets) > 0 {
+		target := targets[0]
+		targets = targets[1:]
+
+		dialog, err := p.dialURI(ctx, target, o)
+		if err == nil {
+			if redirects > 0 {
+				log.Info().Str("target", target.String()).Int("redirects", redirects).Msg("Redirected call answered")
+			}
+			return dialog, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+
+		var rerr *DialResponseError
+		if !errors.As(err, &rerr) || !rerr.InviteResp.IsRedirection() {
+			// Try next contact of redirect
+			continue
+		}
+		if redirects == maxRedirects {
+			lastErr = fmt.Errorf("%w (%d): %w", ErrMaxRedirects, maxRedirects, err)
+			continue
+		}
+		redirects++
+
+		var contacts []sip.Uri
+		for _, c := range redirectContacts(rerr.InviteResp) {
+			key := redirectKey(c)
+			if visited[key] {
+				log.Debug().Str("contact", c.String()).Msg("Redirect contact already tried, loop")
+				continue
+			}
+			visited[key] = true
+			contacts = append(contacts, c)
+		}
+		log.Info().Str("response", rerr.InviteResp.StartLine()).Int("contacts", len(contacts)).Msg("Following redirect")
+		targets = append(contacts, targets...)
+	}
+	return nil, lastErr
+}
+
+// redirectContacts returns sip contacts of response ordered by q-value. Contacts without q
+// have highest priority and keep order of response.
+// NOTE: sipgo parser gives first contact of comma separated list params of whole list,
+// so q-values are reliable only with separate Contact headers
+func redirectContacts(res *sip.Response) []sip.Uri {
+	type qContact struct {
+		uri sip.Uri
+		q   float64
+	}
+	var contacts []qContact
+	for _, c := range responseContacts(res) {
+		if c.Address.Scheme != "" && c.Address.Scheme != "sip" && c.Address.Scheme != "sips" {
+			continue
+		}
+		if c.Address.Host == "" {
+			continue
+		}
+		q := 1.0
+		if c.Params != nil {
+			if v, ok := c.Params.Get("q"); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		contacts = append(contacts, qContact{uri: *c.Address.Clone(), q: q})
+	}
+
+	slices.SortStableFunc(contacts, func(a, b qContact) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+
+	uris := make([]sip.Uri, len(contacts))
+	for i, c := range contacts {
+		uris[i] = c.uri
+	}
+	return uris
+}
+
+// redirectKey identifies uri for loop detection. Params are ignored and host is case insensitive
+func redirectKey(uri sip.Uri) string {
+	uri.Host = strings.ToLower(uri.Host)
+	return uri.Addr()
+}
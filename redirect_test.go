@@ -0,0 +1,123 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// testRedirect redirects INVITE with 302 to contacts of UAS. Each contact is own header
+// with q-value, or without it if q is empty
+func testRedirect(contacts ...[2]string) func(inv *testInvite) {
+	return func(inv *testInvite) {
+		res := sip.NewResponseFromRequest(inv.req, sip.StatusMovedTemporarily, "Moved Temporarily", nil)
+		for _, c := range contacts {
+			h := &sip.ContactHeader{Address: inv.uas.uri(c[0]), Params: sip.NewParams()}
+			if c[1] != "" {
+				h.Params.Add("q", c[1])
+			}
+			res.AppendHeader(h)
+		}
+		inv.uas.write(res, inv.src)
+	}
+}
+
+// invitesOrder returns users of received INVITEs in order
+func (u *testUAS) invitesOrder() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var users []string
+	for _, r := range u.received {
+		if r.method == sip.INVITE {
+			users = append(users, r.user)
+		}
+	}
+	return users
+}
+
+func TestDialFollowRedirects(t *testing.T) {
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		// Redirect back to start is loop and not dialed again
+		"start": testRedirect([2]string{"low", "0.2"}, [2]string{"high", "0.9"}, [2]string{"noq", ""}, [2]string{"start", "1"}),
+		"noq":   testRedirect([2]string{"chain", "0.5"}),
+		"chain": testBusy,
+		"high":  testBusy,
+		"low":   testAnswerAfter(0),
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dialog, err := p.Dial(ctx, uas.uri("start"), DialOptions{FollowRedirects: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialog.Close()
+
+	// Contact without q is first and its redirect is followed before remaining contacts
+	expected := []string{"start", "noq", "chain", "high", "low"}
+	if order := uas.invitesOrder(); !slices.Equal(order, expected) {
+		t.Errorf("expected dial order %v, got %v", expected, order)
+	}
+	if target := dialog.Target(); target.User != "low" {
+		t.Errorf("expected target low, got %s", target.String())
+	}
+	uas.waitRequest(t, "low", sip.ACK, "")
+}
+
+func TestDialMaxRedirects(t *testing.T) {
+	uas := newTestUAS(t, map[string]func(inv *testInvite){
+		"r1": testRedirect([2]string{"r2", ""}),
+		"r2": testRedirect([2]string{"r3", ""}),
+		"r3": testAnswerAfter(0),
+	})
+	p := newTestPhone(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := p.Dial(ctx, uas.uri("r1"), DialOptions{FollowRedirects: true, MaxRedirects: 1})
+	if !errors.Is(err, ErrMaxRedirects) {
+		t.Fatalf("expected max redirects error, got %v", err)
+	}
+	var rerr *DialResponseError
+	if !errors.As(err, &rerr) || rerr.InviteResp.StatusCode != sip.StatusMovedTemporarily {
+		t.Errorf("expected last redirect response in error, got %v", err)
+	}
+	if uas.hasRequest("r3", sip.INVITE, "") {
+		t.Error("redirect over limit must not be dialed")
+	}
+
+	// Without following redirect is returned as error
+	_, err = p.Dial(ctx, uas.uri("r1"), DialOptions{})
+	if !errors.As(err, &rerr) || rerr.InviteResp.StatusCode != sip.StatusMovedTemporarily {
+		t.Errorf("expected redirect response error, got %v", err)
+	}
+}
+
+func TestRedirectContacts(t *testing.T) {
+	res := sip.NewResponse(300, "Multiple Choices")
+	for _, c := range []string{
+		"<sip:low@example.test>;q=0.1",
+		"<tel:+15551234>",
+		"<sip:first@example.test>",
+		"<sips:high@example.test>;q=0.8",
+		"<sip:bad@example.test>;q=x",
+		"<sip:second@example.test>",
+	} {
+		res.AppendHeader(sip.NewHeader("Contact", c))
+	}
+
+	var users []string
+	for _, c := range redirectContacts(res) {
+		users = append(users, c.User)
+	}
+	// Bad q is ignored, so contact has default priority
+	expected := []string{"first", "bad", "second", "high", "low"}
+	if !slices.Equal(users, expected) {
+		t.Errorf("expected %v, got %v", expected, users)
+	}
+}
@@ -2,9 +2,11 @@ package sipgox
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emiago/sipgo"
@@ -19,6 +21,85 @@ type RegisterTransaction struct {
 
 	client *sipgo.Client
 	log    zerolog.Logger
+
+	// hop is registrar or outbound proxy where REGISTER is sent
+	hop *sip.Uri
+
+	mu sync.Mutex
+	// serviceRoute is route set returned by registrar
+	serviceRoute []sip.Uri
+	// outbound is set when registrar has accepted flow
+	outbound  bool
+	flowTimer time.Duration
+	// pubGRUU and tempGRUU are assigned by registrar to our instance
+	pubGRUU  *sip.Uri
+	tempGRUU *sip.Uri
+}
+
+// ServiceRoute returns Service-Route set of last successful registration.
+// Requests sent through this registration must preload this route set
+// https://datatracker.ietf.org/doc/html/rfc3608#section-6
+func (t *RegisterTransaction) ServiceRoute() []sip.Uri {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.serviceRoute
+}
+
+// Outbound returns true if registrar has accepted registration as outbound flow
+// https://datatracker.ietf.org/doc/html/rfc5626#section-6
+func (t *RegisterTransaction) Outbound() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.outbound
+}
+
+// FlowTimer returns keep alive interval requested by registrar or 0
+func (t *RegisterTransaction) FlowTimer() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flowTimer
+}
+
+// PublicGRUU returns public GRUU assigned by registrar or nil
+// https://datatracker.ietf.org/doc/html/rfc5627#section-3.1
+func (t *RegisterTransaction) PublicGRUU() *sip.Uri {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pubGRUU
+}
+
+// TempGRUU returns temporary GRUU from last registration or nil
+func (t *RegisterTransaction) TempGRUU() *sip.Uri {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tempGRUU
+}
+
+// updateRegistration updates route set, flow and GRUU from 2xx response. Missing header
+// clears route set
+func (t *RegisterTransaction) updateRegistration(res *sip.Response) {
+	routes := routeUris(res.GetHeaders("Service-Route"))
+	outbound := t.opts.RegID > 0 && hasOptionTag(res.GetHeaders("Require"), "outbound")
+	var pub, temp *sip.Uri
+	if t.opts.GRUU {
+		pub, temp = contactGRUU(res, t.opts.InstanceID)
+	}
+	t.mu.Lock()
+	t.serviceRoute = routes
+	t.outbound = outbound
+	t.flowTimer = flowTimer(res)
+	if pub != nil {
+		// Public GRUU stays same, but keep previous in case registrar omits it on refresh
+		t.pubGRUU = pub
+	}
+	if temp != nil {
+		// Any temporary GRUU stays valid during registration so we can keep first
+		// https://datatracker.ietf.org/doc/html/rfc5627#section-4.2
+		if t.tempGRUU == nil {
+			t.tempGRUU = temp
+		}
+	}
+	t.mu.Unlock()
 }
 
 func (t *RegisterTransaction) Terminate() error {
@@ -29,7 +110,18 @@ func NewRegisterTransaction(log zerolog.Logger, client *sipgo.Client, recipient
 	expiry, allowHDRS := opts.Expiry, opts.AllowHeaders
 	// log := p.getLoggerCtx(ctx, "Register")
 	req := sip.NewRequest(sip.REGISTER, recipient)
+	if opts.InstanceID == "" {
+		// reg-id and GRUU are meaningless without instance
+		opts.RegID = 0
+		opts.GRUU = false
+	}
+	contact = *contact.Clone()
+	outboundContact(&contact, opts.InstanceID, opts.RegID)
 	req.AppendHeader(&contact)
+	if tp, _ := contact.Address.UriParams.Get("transport"); tp != "" {
+		// Request is sent over same transport as we are reachable
+		req.SetTransport(tp)
+	}
 	if expiry > 0 {
 		expires := sip.ExpiresHeader(expiry)
 		req.AppendHeader(&expires)
@@ -37,6 +129,22 @@ func NewRegisterTransaction(log zerolog.Logger, client *sipgo.Client, recipient
 	if allowHDRS != nil {
 		req.AppendHeader(sip.NewHeader("Allow", strings.Join(allowHDRS, ", ")))
 	}
+	var supported []string
+	if opts.SupportPath {
+		// https://datatracker.ietf.org/doc/html/rfc3327#section-5.1
+		supported = append(supported, "path")
+	}
+	if opts.RegID > 0 {
+		// https://datatracker.ietf.org/doc/html/rfc5626#section-4.2.1
+		supported = append(supported, "outbound")
+	}
+	if opts.GRUU {
+		// https://datatracker.ietf.org/doc/html/rfc5627#section-4.1
+		supported = append(supported, "gruu")
+	}
+	if len(supported) > 0 {
+		req.AppendHeader(sip.NewHeader("Supported", strings.Join(supported, ", ")))
+	}
 
 	t := &RegisterTransaction{
 		Origin: req, // origin maybe updated after first register
@@ -49,7 +157,7 @@ func NewRegisterTransaction(log zerolog.Logger, client *sipgo.Client, recipient
 }
 
 func (p *RegisterTransaction) Register(ctx context.Context) error {
-	username, password, expiry := p.opts.Username, p.opts.Password, p.opts.Expiry
+	expiry := p.opts.Expiry
 	client := p.client
 	log := p.log
 	req := p.Origin
@@ -71,7 +179,7 @@ func (p *RegisterTransaction) Register(ctx context.Context) error {
 	res, err := getResponse(ctxWithTimeout, tx)
 	if err != nil {
 		// 提供更詳細的錯誤資訊
-		if err.Error() == "transaction died" {
+		if errors.Is(err, errTransactionDied) {
 			return fmt.Errorf("SIP 伺服器沒有回應 REGISTER 請求，請檢查: 1) 伺服器是否運行在 %s 2) 網路連通性 3) 防火牆設定。原始錯誤: %w", req.Recipient.String(), err)
 		}
 		return fmt.Errorf("fail to get response req=%q : %w", req.StartLine(), err)
@@ -83,7 +191,9 @@ func (p *RegisterTransaction) Register(ctx context.Context) error {
 	}
 
 	// https://datatracker.ietf.org/doc/html/rfc3581#section-9
-	if rport, _ := via.Params.Get("rport"); rport != "" {
+	// WebSocket client keeps .invalid contact as it is reachable only over connection
+	tp, _ := contact.Address.UriParams.Get("transport")
+	if rport, _ := via.Params.Get("rport"); rport != "" && !isWebSocket(tp) {
 		if p, err := strconv.Atoi(rport); err == nil {
 			contact.Address.Port = p
 		}
@@ -102,6 +212,7 @@ func (p *RegisterTransaction) Register(ctx context.Context) error {
 		tx.Terminate() //Terminate previous
 
 		log.Info().Msg("Unauthorized. Doing digest auth")
+		username, password := p.opts.credentials().get(res.StatusCode)
 		tx, err = client.DoDigestAuth(ctx, req, res, sipgo.DigestAuth{
 			Username: username,
 			Password: password,
@@ -125,6 +236,7 @@ func (p *RegisterTransaction) Register(ctx context.Context) error {
 			Msg:         res.StartLine(),
 		}
 	}
+	p.updateRegistration(res)
 
 	return nil
 }
@@ -171,7 +283,16 @@ func (t *RegisterTransaction) Unregister(ctx context.Context) error {
 	req.AppendHeader(&expires)
 
 	log.Info().Str("uri", req.Recipient.String()).Msg("UNREGISTER")
-	return t.reregister(ctx, req)
+	if err := t.reregister(ctx, req); err != nil {
+		return err
+	}
+	// Route set and flow are no longer valid
+	t.mu.Lock()
+	t.serviceRoute = nil
+	t.outbound = false
+	t.pubGRUU, t.tempGRUU = nil, nil
+	t.mu.Unlock()
+	return nil
 }
 
 func (t *RegisterTransaction) qualify(ctx context.Context) error {
@@ -183,7 +304,6 @@ func (t *RegisterTransaction) reregister(ctx context.Context, req *sip.Request)
 	// log := p.getLoggerCtx(ctx, "Register")
 	log := t.log
 	client := t.client
-	username, password := t.opts.Username, t.opts.Password
 	// Send request and parse response
 	// req.SetDestination(*dst)
 	req.RemoveHeader("Via")
@@ -202,6 +322,7 @@ func (t *RegisterTransaction) reregister(ctx context.Context, req *sip.Request)
 	if res.StatusCode == sip.StatusUnauthorized || res.StatusCode == sip.StatusProxyAuthRequired {
 		tx.Terminate() //Terminate previous
 		log.Info().Msg("Unauthorized. Doing digest auth")
+		username, password := t.opts.credentials().get(res.StatusCode)
 		tx, err = client.DoDigestAuth(ctx, req, res, sipgo.DigestAuth{
 			Username: username,
 			Password: password,
@@ -225,6 +346,7 @@ func (t *RegisterTransaction) reregister(ctx context.Context, req *sip.Request)
 			Msg:         res.StartLine(),
 		}
 	}
+	t.updateRegistration(res)
 
 	return nil
 }
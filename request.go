@@ -0,0 +1,90 @@
+package sipgox
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+type RequestOptions struct {
+	// Authentication via digest challenge
+	Username string
+	Password string
+	// ProxyUsername and ProxyPassword answer 407 of proxy. Default are Username and Password
+	ProxyUsername string
+	ProxyPassword string
+
+	// OutboundProxy overrides phone outbound proxy. Format is sip uri or host[:port]
+	OutboundProxy string
+	// Routes are pre-loaded Route headers after outbound proxy
+	Routes []sip.Uri
+}
+
+func (o RequestOptions) credentials() digestCredentials {
+	return digestCredentials{o.Username, o.Password, o.ProxyUsername, o.ProxyPassword}
+}
+
+// Request sends out of dialog request like MESSAGE, SUBSCRIBE or OPTIONS and returns final response.
+// Digest challenges are answered with credentials and request is resent with increased CSeq.
+// Missing From, To, Call-ID and CSeq are added
+func (p *Phone) Request(ctx context.Context, req *sip.Request, opts RequestOptions) (*sip.Response, error) {
+	if p.optErr != nil {
+		return nil, p.optErr
+	}
+	if req.IsInvite() || req.IsAck() {
+		return nil, fmt.Errorf("%s must be sent with Dial", req.Method)
+	}
+	log := p.getLoggerCtx(ctx, "Request")
+	proxy, err := p.outboundProxy(opts.OutboundProxy)
+	if err != nil {
+		return nil, err
+	}
+	preloadRoutes(req, proxy, opts.Routes)
+
+	hop := nextHop(req.Recipient, proxy, opts.Routes)
+	targets, err := p.lookupTargets(ctx, hop)
+	if err != nil {
+		return nil, err
+	}
+	network, target := uriTransport(hop), hop.HostPort()
+	if len(targets) > 0 {
+		network, target = targets[0].network, targets[0].addr
+		req.SetDestination(target)
+	}
+	req.SetTransport(network)
+
+	lhost, lport, _ := p.clientLocalHostPort(network, target)
+	lhost, lport, err = p.clientHostPort(network, lhost, lport)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sipgo.NewClient(p.UA,
+		sipgo.WithClientHostname(lhost),
+		sipgo.WithClientPort(lport),
+		sipgo.WithClientNAT(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	chals := newDigestChallenges(opts.credentials())
+	for i := 0; ; i++ {
+		res, err := client.Do(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		p.logSipRequest(&log, req)
+		if !isDigestChallenge(res) || i == maxDigestRetries {
+			return res, nil
+		}
+		if err := chals.authorize(req, res); err != nil {
+			// Caller gets challenge as response
+			return res, nil
+		}
+		// Client adds new Via and increases CSeq
+		req.RemoveHeader("Via")
+	}
+}
@@ -0,0 +1,684 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Locating SIP servers
+// https://datatracker.ietf.org/doc/html/rfc3263
+
+// NAPTR is DNS naming authority pointer record
+// https://datatracker.ietf.org/doc/html/rfc3403#section-4.1
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Service     string
+	Regexp      string
+	Replacement string
+}
+
+// Resolver is used for locating SIP servers. Except NAPTR it matches *net.Resolver,
+// so it is easy to replace, ex. with fake DNS in tests
+type Resolver interface {
+	LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// ResolverTTL is optionally implemented by Resolver to return TTL of SRV and A/AAAA records.
+// Resolved targets are cached for lowest TTL, otherwise for 5 minutes
+type ResolverTTL interface {
+	LookupSRVTTL(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+// NAPTR services we support and their transport
+// https://datatracker.ietf.org/doc/html/rfc3263#section-4.1
+// https://datatracker.ietf.org/doc/html/rfc7118#section-7
+var naptrServices = map[string]string{
+	"SIP+D2U":  "udp",
+	"SIP+D2T":  "tcp",
+	"SIPS+D2T": "tls",
+	"SIP+D2W":  "ws",
+	"SIPS+D2W": "wss",
+}
+
+// sipTarget is resolved server address with transport
+type sipTarget struct {
+	network string
+	addr    string
+	// ttl is lowest TTL of records target is resolved from. Zero if unknown
+	ttl time.Duration
+}
+
+// resolveTargets returns ordered list of targets for uri. It returns nil if uri host is IP,
+// as then there is nothing to fail over.
+// Transport is only used if set on uri, otherwise it is selected by NAPTR
+func resolveTargets(ctx context.Context, r Resolver, uri sip.Uri) ([]sipTarget, error) {
+	if net.ParseIP(uri.Host) != nil {
+		return nil, nil
+	}
+
+	network := ""
+	if hasTransportParam(uri) {
+		network = uriTransport(uri)
+	}
+	if uri.IsEncrypted() && (network == "" || network == "tcp") {
+		network = "tls"
+	}
+
+	// Port set means no NAPTR and SRV
+	if uri.Port > 0 {
+		if network == "" {
+			network = "udp"
+		}
+		return resolveHostTargets(ctx, r, network, uri.Host, uri.Port, 0)
+	}
+
+	type srvQuery struct {
+		network string
+		name    string
+	}
+	var queries []srvQuery
+	if network == "" {
+		naptrs, err := r.LookupNAPTR(ctx, uri.Host)
+		if err != nil && !isNotFound(err) {
+			return nil, fmt.Errorf("NAPTR lookup %s: %w", uri.Host, err)
+		}
+
+		sort.SliceStable(naptrs, func(i, j int) bool {
+			if naptrs[i].Order != naptrs[j].Order {
+				return naptrs[i].Order < naptrs[j].Order
+			}
+			return naptrs[i].Preference < naptrs[j].Preference
+		})
+		for _, n := range naptrs {
+			tp, ok := naptrServices[strings.ToUpper(n.Service)]
+			if !ok || !strings.EqualFold(n.Flags, "s") {
+				continue
+			}
+			if uri.IsEncrypted() && tp != "tls" && tp != "wss" {
+				continue
+			}
+			queries = append(queries, srvQuery{network: tp, name: n.Replacement})
+		}
+
+		if len(queries) == 0 {
+			// No NAPTR, so try SRV for transports we support
+			// https://datatracker.ietf.org/doc/html/rfc3263#section-4.1
+			if uri.IsEncrypted() {
+				queries = []srvQuery{{"tls", srvName("tls", uri.Host)}}
+			} else {
+				queries = []srvQuery{{"udp", srvName("udp", uri.Host)}, {"tcp", srvName("tcp", uri.Host)}, {"tls", srvName("tls", uri.Host)}}
+			}
+		}
+	} else {
+		queries = []srvQuery{{network, srvName(network, uri.Host)}}
+	}
+
+	var targets []sipTarget
+	for _, q := range queries {
+		srvs, ttl, err := lookupSRV(ctx, r, q.name)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("SRV lookup %s: %w", q.name, err)
+		}
+
+		for _, srv := range orderSRV(srvs) {
+			t, err := resolveHostTargets(ctx, r, q.network, strings.TrimSuffix(srv.Target, "."), int(srv.Port), ttl)
+			if err != nil {
+				continue
+			}
+			targets = append(targets, t...)
+		}
+	}
+	if len(targets) > 0 {
+		return targets, nil
+	}
+
+	// No SRV. Use A/AAAA with default port
+	if network == "" {
+		network = "udp"
+		if len(queries) > 0 {
+			network = queries[0].network
+		}
+	}
+	return resolveHostTargets(ctx, r, network, uri.Host, sip.DefaultPort(network), 0)
+}
+
+// resolveHostTargets resolves host of SRV record with ttl, which is zero if host is not from SRV
+func resolveHostTargets(ctx context.Context, r Resolver, network string, host string, port int, ttl time.Duration) ([]sipTarget, error) {
+	if port == 0 {
+		port = sip.DefaultPort(network)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []sipTarget{{network: network, addr: net.JoinHostPort(host, strconv.Itoa(port)), ttl: ttl}}, nil
+	}
+
+	ips, ipTTL, err := lookupIPAddr(ctx, r, host)
+	if err != nil {
+		return nil, fmt.Errorf("A/AAAA lookup %s: %w", host, err)
+	}
+	ttl = minTTL(ttl, ipTTL)
+	targets := make([]sipTarget, 0, len(ips))
+	for _, ip := range ips {
+		targets = append(targets, sipTarget{network: network, addr: net.JoinHostPort(ip.IP.String(), strconv.Itoa(port)), ttl: ttl})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no address for %s", host)
+	}
+	return targets, nil
+}
+
+func lookupSRV(ctx context.Context, r Resolver, name string) ([]*net.SRV, time.Duration, error) {
+	if rt, ok := r.(ResolverTTL); ok {
+		return rt.LookupSRVTTL(ctx, name)
+	}
+	_, srvs, err := r.LookupSRV(ctx, "", "", name)
+	return srvs, 0, err
+}
+
+func lookupIPAddr(ctx context.Context, r Resolver, host string) ([]net.IPAddr, time.Duration, error) {
+	if rt, ok := r.(ResolverTTL); ok {
+		return rt.LookupIPAddrTTL(ctx, host)
+	}
+	ips, err := r.LookupIPAddr(ctx, host)
+	return ips, 0, err
+}
+
+// minTTL returns lower of known TTLs. Zero is unknown
+func minTTL(a, b time.Duration) time.Duration {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 {
+		return a
+	}
+	return min(a, b)
+}
+
+func hasTransportParam(uri sip.Uri) bool {
+	if _, ok := uri.UriParams.Get("transport"); ok {
+		return true
+	}
+	_, ok := uri.Headers.Get("transport")
+	return ok
+}
+
+func srvName(network string, host string) string {
+	switch network {
+	case "tls":
+		return "_sips._tcp." + host
+	case "ws":
+		return "_sip._ws." + host
+	case "wss":
+		return "_sips._ws." + host
+	}
+	return "_sip._" + network + "." + host
+}
+
+// orderSRV orders by priority and within same priority by weighted random selection
+// https://datatracker.ietf.org/doc/html/rfc2782
+func orderSRV(srvs []*net.SRV) []*net.SRV {
+	sorted := make([]*net.SRV, len(srvs))
+	copy(sorted, srvs)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+
+	res := make([]*net.SRV, 0, len(sorted))
+	for i := 0; i < len(sorted); {
+		j := i
+		for j < len(sorted) && sorted[j].Priority == sorted[i].Priority {
+			j++
+		}
+
+		group := sorted[i:j]
+		for len(group) > 0 {
+			total := 0
+			for _, s := range group {
+				total += int(s.Weight)
+			}
+			ind := 0
+			if total > 0 {
+				n := rand.Intn(total + 1)
+				for sum := 0; ind < len(group); ind++ {
+					sum += int(group[ind].Weight)
+					if sum >= n {
+						break
+					}
+				}
+				if ind == len(group) {
+					ind = len(group) - 1
+				}
+			}
+			res = append(res, group[ind])
+			group = append(group[:ind:ind], group[ind+1:]...)
+		}
+		i = j
+	}
+	return res
+}
+
+func isNotFound(err error) bool {
+	var derr *net.DNSError
+	return errors.As(err, &derr) && derr.IsNotFound
+}
+
+// isFailoverError tells should request be retried on next target. This is on
+// transaction timeout, transport error, refused, unreachable or timed out connection and 503
+// https://datatracker.ietf.org/doc/html/rfc3263#section-4.3
+func isFailoverError(err error) bool {
+	if errors.Is(err, sip.ErrTransactionTimeout) || errors.Is(err, sip.ErrTransactionTransport) || errors.Is(err, errTransactionDied) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return true
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+
+	var derr *DialResponseError
+	if errors.As(err, &derr) {
+		return derr.InviteResp.StatusCode == sip.StatusServiceUnavailable
+	}
+	var rerr *RegisterResponseError
+	if errors.As(err, &rerr) {
+		return rerr.RegisterRes.StatusCode == sip.StatusServiceUnavailable
+	}
+	return false
+}
+
+// targetCache keeps last successful target list per uri so that next request goes
+// directly to chosen target. Entry expires with lowest TTL of targets or ttl if unknown
+type targetCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]targetCacheEntry
+}
+
+type targetCacheEntry struct {
+	targets []sipTarget
+	expires time.Time
+}
+
+func newTargetCache(ttl time.Duration) *targetCache {
+	return &targetCache{
+		ttl:     ttl,
+		entries: make(map[string]targetCacheEntry),
+	}
+}
+
+func targetCacheKey(uri sip.Uri) string {
+	key := uri.Host + ":" + strconv.Itoa(uri.Port)
+	if hasTransportParam(uri) {
+		key += ";" + uriTransport(uri)
+	}
+	if uri.IsEncrypted() {
+		key = "sips:" + key
+	}
+	return key
+}
+
+func (c *targetCache) get(key string) []sipTarget {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, exists := c.entries[key]
+	if !exists {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e.targets
+}
+
+// chosen moves target at index to front
+func (c *targetCache) chosen(key string, targets []sipTarget, ind int) {
+	ordered := make([]sipTarget, 0, len(targets))
+	ordered = append(ordered, targets[ind])
+	ordered = append(ordered, targets[:ind]...)
+	ordered = append(ordered, targets[ind+1:]...)
+
+	var ttl time.Duration
+	for _, t := range targets {
+		ttl = minTTL(ttl, t.ttl)
+	}
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+
+	c.mu.Lock()
+	c.entries[key] = targetCacheEntry{targets: ordered, expires: time.Now().Add(ttl)}
+	c.mu.Unlock()
+}
+
+// dnsResolver is system resolver with NAPTR lookup done directly against nameserver
+type dnsResolver struct {
+	*net.Resolver
+}
+
+func (r *dnsResolver) LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error) {
+	answers, err := lookupDNS(ctx, name, dnsTypeNAPTR)
+	if err != nil {
+		return nil, err
+	}
+
+	naptrs := make([]*NAPTR, 0, len(answers))
+	for _, a := range answers {
+		res, ok := a.Body.(*dnsmessage.UnknownResource)
+		if !ok {
+			continue
+		}
+		naptr, err := parseNAPTR(res.Data)
+		if err != nil {
+			return nil, err
+		}
+		naptrs = append(naptrs, naptr)
+	}
+	return naptrs, nil
+}
+
+// LookupSRVTTL queries nameserver directly to get TTL. On failure it falls back to system resolver
+func (r *dnsResolver) LookupSRVTTL(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	answers, err := lookupDNS(ctx, name, dnsmessage.TypeSRV)
+	if err != nil {
+		_, srvs, err := r.LookupSRV(ctx, "", "", name)
+		return srvs, 0, err
+	}
+
+	var srvs []*net.SRV
+	var ttl time.Duration
+	for _, a := range answers {
+		ttl = minTTL(ttl, time.Duration(a.Header.TTL)*time.Second)
+		if res, ok := a.Body.(*dnsmessage.SRVResource); ok {
+			srvs = append(srvs, &net.SRV{Target: res.Target.String(), Port: res.Port, Priority: res.Priority, Weight: res.Weight})
+		}
+	}
+	return srvs, ttl, nil
+}
+
+// LookupIPAddrTTL queries nameserver directly to get TTL. On failure it falls back to system
+// resolver, which also handles hosts file and search domains
+func (r *dnsResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	var ips []net.IPAddr
+	var ttl time.Duration
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, err := lookupDNS(ctx, host, qtype)
+		if err != nil {
+			continue
+		}
+		for _, a := range answers {
+			ttl = minTTL(ttl, time.Duration(a.Header.TTL)*time.Second)
+			switch res := a.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IPAddr{IP: net.IP(res.A[:])})
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IPAddr{IP: net.IP(res.AAAA[:])})
+			}
+		}
+	}
+	if len(ips) == 0 {
+		ips, err := r.LookupIPAddr(ctx, host)
+		return ips, 0, err
+	}
+	return ips, ttl, nil
+}
+
+const dnsTypeNAPTR dnsmessage.Type = 35
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// lookupDNS queries system nameservers in order until one answers
+func lookupDNS(ctx context.Context, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ns := range systemNameservers() {
+		answers, err := queryDNS(ctx, ns, name, qtype, query)
+		if err == nil || isNotFound(err) {
+			return answers, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// queryDNS returns answers of qtype. CNAME answers are kept as their TTL limits ours
+func queryDNS(ctx context.Context, ns string, name string, qtype dnsmessage.Type, query []byte) ([]dnsmessage.Resource, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", ns)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode == dnsmessage.RCodeNameError {
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: ns, IsNotFound: true}
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return nil, &net.DNSError{Err: h.RCode.String(), Name: name, Server: ns}
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+
+	all, err := p.AllAnswers()
+	if err != nil {
+		return nil, err
+	}
+	var answers []dnsmessage.Resource
+	found := false
+	for _, a := range all {
+		switch a.Header.Type {
+		case qtype:
+			found = true
+		case dnsmessage.TypeCNAME:
+		default:
+			continue
+		}
+		answers = append(answers, a)
+	}
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: ns, IsNotFound: true}
+	}
+	return answers, nil
+}
+
+// parseNAPTR parses record data. Replacement is never compressed
+// https://datatracker.ietf.org/doc/html/rfc3403#section-4.1
+func parseNAPTR(data []byte) (*NAPTR, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("NAPTR record too short")
+	}
+	n := &NAPTR{
+		Order:      uint16(data[0])<<8 | uint16(data[1]),
+		Preference: uint16(data[2])<<8 | uint16(data[3]),
+	}
+	off := 4
+
+	fields := []*string{&n.Flags, &n.Service, &n.Regexp}
+	for _, f := range fields {
+		if off >= len(data) || off+1+int(data[off]) > len(data) {
+			return nil, fmt.Errorf("NAPTR record malformed")
+		}
+		l := int(data[off])
+		*f = string(data[off+1 : off+1+l])
+		off += 1 + l
+	}
+
+	var labels []string
+	for {
+		if off >= len(data) {
+			return nil, fmt.Errorf("NAPTR replacement malformed")
+		}
+		l := int(data[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if off+l > len(data) {
+			return nil, fmt.Errorf("NAPTR replacement malformed")
+		}
+		labels = append(labels, string(data[off:off+l]))
+		off += l
+	}
+	n.Replacement = strings.Join(labels, ".")
+	return n, nil
+}
+
+// systemNameservers reads nameservers from resolv.conf
+func systemNameservers() []string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return []string{"127.0.0.1:53"}
+	}
+
+	var servers []string
+	for _, l := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(fields[1], "53"))
+	}
+	if len(servers) == 0 {
+		return []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// lookupTargets resolves uri or returns cached targets. Targets are filtered to single transport
+// as our Via and Contact are built per transport
+func (p *Phone) lookupTargets(ctx context.Context, uri sip.Uri) ([]sipTarget, error) {
+	key := targetCacheKey(uri)
+	if targets := p.targets.get(key); targets != nil {
+		return targets, nil
+	}
+
+	targets, err := resolveTargets(ctx, p.resolver, uri)
+	if err != nil || len(targets) == 0 {
+		return nil, err
+	}
+
+	network := targets[0].network
+	filtered := targets[:0:0]
+	for _, t := range targets {
+		if t.network == network {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered, nil
+}
+
+// dialTargets sends INVITE to targets in order until one answers. Next target is tried on
+// transaction timeout, transport error or 503
+func (p *Phone) dialTargets(ctx context.Context, client *sipgo.Client, dc *sipgo.DialogClientCache, invite *sip.Request, dm *dialogMedia, o DialOptions, hop sip.Uri, targets []sipTarget) (*DialogClientSession, error) {
+	if len(targets) == 0 {
+		return p.dial(ctx, client, dc, invite, dm, o)
+	}
+
+	log := p.getLoggerCtx(ctx, "Dial")
+	var err error
+	for i, t := range targets {
+		req := invite.Clone()
+		req.SetBody(invite.Body())
+		req.SetDestination(t.addr)
+
+		var dialog *DialogClientSession
+		dialog, err = p.dial(ctx, client, dc, req, dm, o)
+		if err == nil {
+			p.targets.chosen(targetCacheKey(hop), targets, i)
+			return dialog, nil
+		}
+		if !isFailoverError(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warn().Err(err).Str("target", t.addr).Msg("Target failed. Trying next one")
+	}
+	return nil, err
+}
+
+// registerTargets registers on targets in order until one accepts. Failover is same as for Dial
+func (p *Phone) registerTargets(ctx context.Context, client *sipgo.Client, recipient sip.Uri, contact sip.ContactHeader, opts RegisterOptions, hop sip.Uri, targets []sipTarget) (*RegisterTransaction, error) {
+	if len(targets) == 0 {
+		return p.register(ctx, client, recipient, contact, opts, "")
+	}
+
+	log := p.getLoggerCtx(ctx, "Register")
+	var err error
+	for i, t := range targets {
+		var tr *RegisterTransaction
+		tr, err = p.register(ctx, client, recipient, contact, opts, t.addr)
+		if err == nil {
+			p.targets.chosen(targetCacheKey(hop), targets, i)
+			return tr, nil
+		}
+		if !isFailoverError(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warn().Err(err).Str("target", t.addr).Msg("Target failed. Trying next one")
+	}
+	return nil, err
+}
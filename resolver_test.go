@@ -0,0 +1,283 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// fakeResolver answers from static records. Missing names are not found
+type fakeResolver struct {
+	naptr map[string][]*NAPTR
+	srv   map[string][]*net.SRV
+	ips   map[string][]net.IPAddr
+	ttl   time.Duration
+}
+
+func fakeNotFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupNAPTR(ctx context.Context, name string) ([]*NAPTR, error) {
+	if n, ok := r.naptr[name]; ok {
+		return n, nil
+	}
+	return nil, fakeNotFound(name)
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if s, ok := r.srv[name]; ok {
+		return name, s, nil
+	}
+	return "", nil, fakeNotFound(name)
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, fakeNotFound(host)
+}
+
+// fakeTTLResolver is fakeResolver returning TTL of records
+type fakeTTLResolver struct {
+	*fakeResolver
+}
+
+func (r fakeTTLResolver) LookupSRVTTL(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	_, srvs, err := r.LookupSRV(ctx, "", "", name)
+	return srvs, r.ttl, err
+}
+
+func (r fakeTTLResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	ips, err := r.LookupIPAddr(ctx, host)
+	return ips, r.ttl, err
+}
+
+func fakeIP(ip string) []net.IPAddr {
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}
+}
+
+func TestResolveTargets(t *testing.T) {
+	r := &fakeResolver{
+		naptr: map[string][]*NAPTR{
+			"naptr.test": {
+				{Order: 20, Preference: 10, Flags: "s", Service: "SIP+D2U", Replacement: "_sip._udp.naptr.test"},
+				{Order: 10, Preference: 20, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.naptr.test"},
+				{Order: 10, Preference: 10, Flags: "s", Service: "SIPS+D2T", Replacement: "_sips._tcp.naptr.test"},
+				{Order: 5, Preference: 10, Flags: "s", Service: "SIP+D2X", Replacement: "_sip._x.naptr.test"},
+			},
+		},
+		srv: map[string][]*net.SRV{
+			"_sip._udp.naptr.test":  {{Target: "udp.naptr.test.", Port: 5060}},
+			"_sip._tcp.naptr.test":  {{Target: "tcp.naptr.test.", Port: 5062}},
+			"_sips._tcp.naptr.test": {{Target: "tls.naptr.test.", Port: 5061}},
+			"_sip._udp.srv.test": {
+				{Target: "b.srv.test.", Port: 5080, Priority: 20},
+				{Target: "a.srv.test.", Port: 5070, Priority: 10},
+			},
+			"_sip._tcp.srv.test": {{Target: "c.srv.test.", Port: 5090}},
+		},
+		ips: map[string][]net.IPAddr{
+			"udp.naptr.test": fakeIP("10.0.0.1"),
+			"tcp.naptr.test": fakeIP("10.0.0.2"),
+			"tls.naptr.test": fakeIP("10.0.0.3"),
+			"a.srv.test":     fakeIP("10.0.1.1"),
+			"b.srv.test":     fakeIP("10.0.1.2"),
+			"c.srv.test":     fakeIP("10.0.1.3"),
+			"host.test":      append(fakeIP("10.0.2.1"), fakeIP("10.0.2.2")...),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		uri     string
+		targets []sipTarget
+	}{
+		{
+			name: "NAPTR order and preference",
+			uri:  "sip:naptr.test",
+			targets: []sipTarget{
+				{network: "tls", addr: "10.0.0.3:5061"},
+				{network: "tcp", addr: "10.0.0.2:5062"},
+				{network: "udp", addr: "10.0.0.1:5060"},
+			},
+		},
+		{
+			name:    "NAPTR sips",
+			uri:     "sips:naptr.test",
+			targets: []sipTarget{{network: "tls", addr: "10.0.0.3:5061"}},
+		},
+		{
+			name: "SRV priority without NAPTR",
+			uri:  "sip:srv.test",
+			targets: []sipTarget{
+				{network: "udp", addr: "10.0.1.1:5070"},
+				{network: "udp", addr: "10.0.1.2:5080"},
+				{network: "tcp", addr: "10.0.1.3:5090"},
+			},
+		},
+		{
+			name:    "SRV of transport param",
+			uri:     "sip:srv.test;transport=tcp",
+			targets: []sipTarget{{network: "tcp", addr: "10.0.1.3:5090"}},
+		},
+		{
+			name: "A records without SRV",
+			uri:  "sip:host.test",
+			targets: []sipTarget{
+				{network: "udp", addr: "10.0.2.1:5060"},
+				{network: "udp", addr: "10.0.2.2:5060"},
+			},
+		},
+		{
+			name: "port skips SRV",
+			uri:  "sip:host.test:5555",
+			targets: []sipTarget{
+				{network: "udp", addr: "10.0.2.1:5555"},
+				{network: "udp", addr: "10.0.2.2:5555"},
+			},
+		},
+		{
+			name:    "IP",
+			uri:     "sip:10.1.1.1",
+			targets: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var uri sip.Uri
+			if err := sip.ParseUri(tc.uri, &uri); err != nil {
+				t.Fatal(err)
+			}
+			targets, err := resolveTargets(context.Background(), r, uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(targets) != len(tc.targets) {
+				t.Fatalf("expected %v, got %v", tc.targets, targets)
+			}
+			for i := range targets {
+				if targets[i] != tc.targets[i] {
+					t.Errorf("target %d: expected %v, got %v", i, tc.targets[i], targets[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIsFailoverError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		exp  bool
+	}{
+		{"transaction timeout", sip.ErrTransactionTimeout, true},
+		{"connection refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"host unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, true},
+		{"dial timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, true},
+		{"address in use", &net.OpError{Op: "listen", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, false},
+		{"other dial error", &net.OpError{Op: "dial", Err: errors.New("unknown network")}, false},
+		{"503", &DialResponseError{InviteResp: sip.NewResponse(sip.StatusServiceUnavailable, "")}, true},
+		{"486", &DialResponseError{InviteResp: sip.NewResponse(sip.StatusBusyHere, "")}, false},
+		{"register 503", &RegisterResponseError{RegisterRes: sip.NewResponse(sip.StatusServiceUnavailable, "")}, true},
+	}
+	for _, tc := range tests {
+		if got := isFailoverError(tc.err); got != tc.exp {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.exp, got)
+		}
+	}
+}
+
+func TestTargetCacheTTL(t *testing.T) {
+	c := newTargetCache(time.Hour)
+	targets := []sipTarget{
+		{network: "udp", addr: "10.0.0.1:5060", ttl: time.Minute},
+		{network: "udp", addr: "10.0.0.2:5060", ttl: 50 * time.Millisecond},
+	}
+	c.chosen("key", targets, 1)
+	if got := c.get("key"); len(got) != 2 || got[0].addr != "10.0.0.2:5060" {
+		t.Fatalf("expected chosen target first, got %v", got)
+	}
+
+	// Lowest TTL of records expires entry
+	time.Sleep(100 * time.Millisecond)
+	if got := c.get("key"); got != nil {
+		t.Errorf("expected expired entry, got %v", got)
+	}
+}
+
+// newTestRegistrar responds on REGISTER with status code
+func newTestRegistrar(t *testing.T, code sip.StatusCode) int {
+	ua, _ := sipgo.NewUA()
+	t.Cleanup(func() { ua.Close() })
+	srv, _ := sipgo.NewServer(ua)
+	srv.OnRegister(func(req *sip.Request, tx sip.ServerTransaction) {
+		tx.Respond(sip.NewResponseFromRequest(req, code, "", nil))
+	})
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeUDP(conn)
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestRegisterFailover(t *testing.T) {
+	failing := newTestRegistrar(t, sip.StatusServiceUnavailable)
+	working := newTestRegistrar(t, sip.StatusOK)
+
+	r := fakeTTLResolver{&fakeResolver{
+		srv: map[string][]*net.SRV{
+			"_sip._udp.registrar.test": {
+				{Target: "a.registrar.test.", Port: uint16(failing), Priority: 10},
+				{Target: "b.registrar.test.", Port: uint16(working), Priority: 20},
+			},
+		},
+		ips: map[string][]net.IPAddr{
+			"a.registrar.test": fakeIP("127.0.0.1"),
+			"b.registrar.test": fakeIP("127.0.0.1"),
+		},
+		ttl: time.Minute,
+	}}
+
+	ua, _ := sipgo.NewUA(sipgo.WithUserAgent("alice"))
+	defer ua.Close()
+	p := NewPhone(ua, WithPhoneResolver(r))
+	client, err := sipgo.NewClient(ua, sipgo.WithClientHostname("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	recipient := sip.Uri{Scheme: "sip", User: "alice", Host: "registrar.test", UriParams: sip.HeaderParams{"transport": "udp"}, Headers: sip.NewParams()}
+	targets, err := p.lookupTargets(ctx, recipient)
+	if err != nil || len(targets) != 2 {
+		t.Fatalf("unexpected targets %v %v", targets, err)
+	}
+
+	contact := p.contactHeader("127.0.0.1", 5060, "udp")
+	if _, err := p.registerTargets(ctx, client, recipient, contact, RegisterOptions{Expiry: 30}, recipient, targets); err != nil {
+		t.Fatal(err)
+	}
+
+	// Next request goes directly to working target
+	cached := p.targets.get(targetCacheKey(recipient))
+	if len(cached) != 2 || cached[0].addr != "127.0.0.1:"+strconv.Itoa(working) {
+		t.Errorf("expected working target first, got %v", cached)
+	}
+	if cached[0].ttl != time.Minute {
+		t.Errorf("expected TTL of records, got %s", cached[0].ttl)
+	}
+}
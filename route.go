@@ -0,0 +1,207 @@
+package sipgox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+// parseProxyUri parses outbound proxy given as sip uri or host[:port]
+func parseProxyUri(proxy string) (sip.Uri, error) {
+	var uri sip.Uri
+	if !strings.HasPrefix(proxy, "sip:") && !strings.HasPrefix(proxy, "sips:") {
+		proxy = "sip:" + proxy
+	}
+	if err := sip.ParseUri(proxy, &uri); err != nil {
+		return uri, fmt.Errorf("fail to parse proxy %q: %w", proxy, err)
+	}
+	if uri.Host == "" {
+		return uri, fmt.Errorf("proxy %q has no host", proxy)
+	}
+	if uri.UriParams == nil {
+		uri.UriParams = sip.NewParams()
+	}
+	// We only do loose routing
+	uri.UriParams.Add("lr", "")
+	return uri, nil
+}
+
+// outboundProxy returns per call proxy if set or phone proxy
+func (p *Phone) outboundProxy(override string) (*sip.Uri, error) {
+	if override == "" {
+		return p.proxy, nil
+	}
+	uri, err := parseProxyUri(override)
+	if err != nil {
+		return nil, err
+	}
+	return &uri, nil
+}
+
+// preloadRoutes adds outbound proxy and pre-loaded routes as Route headers of initial request
+// https://datatracker.ietf.org/doc/html/rfc3261#section-8.1.2
+func preloadRoutes(req *sip.Request, proxy *sip.Uri, routes []sip.Uri) {
+	if proxy != nil {
+		req.AppendHeader(&sip.RouteHeader{Address: *proxy.Clone()})
+	}
+	for _, r := range routes {
+		req.AppendHeader(&sip.RouteHeader{Address: *r.Clone()})
+	}
+}
+
+// nextHop is uri where request is sent first. This is first route or recipient
+func nextHop(recipient sip.Uri, proxy *sip.Uri, routes []sip.Uri) sip.Uri {
+	if proxy != nil {
+		return *proxy
+	}
+	if len(routes) > 0 {
+		return routes[0]
+	}
+	return recipient
+}
+
+// registrationHop is first hop of REGISTER as loose route. Requests using Service-Route
+// must go through same hop
+func registrationHop(recipient sip.Uri, proxy *sip.Uri, routes []sip.Uri) *sip.Uri {
+	hop := nextHop(recipient, proxy, routes)
+	hop = *hop.Clone()
+	hop.User, hop.Password = "", ""
+	if hop.UriParams == nil {
+		hop.UriParams = sip.NewParams()
+	}
+	if !hop.UriParams.Has("lr") {
+		hop.UriParams.Add("lr", "")
+	}
+	return &hop
+}
+
+// dialRegistration returns phone registration if dial goes through its registrar. That is when
+// outbound proxy is hop of REGISTER, or without proxy recipient is in domain of registrar
+// https://datatracker.ietf.org/doc/html/rfc3608#section-6.1
+func (p *Phone) dialRegistration(recipient sip.Uri, proxy *sip.Uri) *RegisterTransaction {
+	p.mu.Lock()
+	t := p.registration
+	p.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	if proxy != nil {
+		if sameHop(*proxy, *t.hop) {
+			return t
+		}
+		return nil
+	}
+	if strings.EqualFold(recipient.Host, t.Origin.Recipient.Host) || sameHop(recipient, *t.hop) {
+		return t
+	}
+	return nil
+}
+
+// sameHop compares host and port of uris. Missing port is default of transport
+func sameHop(a sip.Uri, b sip.Uri) bool {
+	if !strings.EqualFold(a.Host, b.Host) {
+		return false
+	}
+	pa, pb := a.Port, b.Port
+	if pa == 0 {
+		pa = sip.DefaultPort(uriTransport(a))
+	}
+	if pb == 0 {
+		pb = sip.DefaultPort(uriTransport(b))
+	}
+	return pa == pb
+}
+
+// routeUris returns addresses of Record-Route, Route or Service-Route headers in message order.
+// Header values not parsed by sipgo can hold comma separated list
+func routeUris(hdrs []sip.Header) []sip.Uri {
+	uris := make([]sip.Uri, 0, len(hdrs))
+	for _, h := range hdrs {
+		switch rr := h.(type) {
+		case *sip.RecordRouteHeader:
+			uris = append(uris, rr.Address)
+			continue
+		case *sip.RouteHeader:
+			uris = append(uris, rr.Address)
+			continue
+		}
+
+		for _, v := range splitAddressList(h.Value()) {
+			var uri sip.Uri
+			if _, err := sip.ParseAddressValue(v, &uri, sip.NewParams()); err != nil {
+				continue
+			}
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// splitAddressList splits header value on commas outside of <> and quotes
+func splitAddressList(v string) []string {
+	var list []string
+	var inAngle, inQuote bool
+	start := 0
+	for i, c := range v {
+		switch c {
+		case '"':
+			inQuote = !inQuote
+		case '<':
+			inAngle = !inQuote
+		case '>':
+			inAngle = false
+		case ',':
+			if inAngle || inQuote {
+				continue
+			}
+			if s := strings.TrimSpace(v[start:i]); s != "" {
+				list = append(list, s)
+			}
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(v[start:]); s != "" {
+		list = append(list, s)
+	}
+	return list
+}
+
+// applyRouteSet adds Route headers to in dialog request. If first route is strict router
+// it becomes Request-URI and remote target is added as last route
+// https://datatracker.ietf.org/doc/html/rfc3261#section-12.2.1.1
+func applyRouteSet(req *sip.Request, routes []sip.Uri) {
+	if len(routes) == 0 {
+		return
+	}
+
+	if routes[0].UriParams == nil || !routes[0].UriParams.Has("lr") {
+		remoteTarget := req.Recipient
+		req.Recipient = *routes[0].Clone()
+		routes = append(routes[1:len(routes):len(routes)], remoteTarget)
+	}
+
+	for _, r := range routes {
+		req.AppendHeader(&sip.RouteHeader{Address: *r.Clone()})
+	}
+}
+
+// uasRouteSet gives server dialog clone of INVITE with Record-Route reversed. sipgo builds route set
+// of server dialog by reversing Record-Route as for UAC, but UAS route set is Record-Route in order.
+// Received INVITE is still held by transaction and responses, so it is not changed
+// https://datatracker.ietf.org/doc/html/rfc3261#section-12.1.1
+func uasRouteSet(dialog *sipgo.DialogServerSession) {
+	invite := dialog.InviteRequest
+	routes := routeUris(invite.GetHeaders("Record-Route"))
+	if len(routes) < 2 {
+		return
+	}
+	dinvite := invite.Clone()
+	dinvite.SetBody(invite.Body())
+	removeHeaders(dinvite, "Record-Route")
+	for i := len(routes) - 1; i >= 0; i-- {
+		dinvite.AppendHeader(&sip.RecordRouteHeader{Address: routes[i]})
+	}
+	dialog.InviteRequest = dinvite
+}
@@ -0,0 +1,106 @@
+package sipgox
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+)
+
+func parseTestRequest(t *testing.T, lines ...string) *sip.Request {
+	t.Helper()
+	msg, err := sip.ParseMessage([]byte(strings.Join(lines, "\r\n") + "\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.(*sip.Request)
+}
+
+// routeHosts returns hosts of route headers joined with comma
+func routeHosts(req *sip.Request, name string) string {
+	var hosts []string
+	for _, u := range routeUris(req.GetHeaders(name)) {
+		hosts = append(hosts, u.Host)
+	}
+	return strings.Join(hosts, ",")
+}
+
+func testRecordRouteInvite(t *testing.T) *sip.Request {
+	return parseTestRequest(t,
+		"INVITE sip:bob@127.0.0.1:5060 SIP/2.0",
+		"Via: SIP/2.0/UDP 127.0.0.3:5060;branch=z9hG4bK.p2",
+		"Via: SIP/2.0/UDP 127.0.0.2:5060;branch=z9hG4bK.p1",
+		"Via: SIP/2.0/UDP 127.0.0.10:5060;branch=z9hG4bK.uac",
+		"Record-Route: <sip:p2.test;lr>",
+		"Record-Route: <sip:p1.test;lr>",
+		"From: <sip:alice@127.0.0.10>;tag=a1",
+		"To: <sip:bob@127.0.0.1>",
+		"Call-ID: route-test",
+		"CSeq: 1 INVITE",
+		"Contact: <sip:alice@127.0.0.10:5060>",
+		"Content-Length: 0",
+	)
+}
+
+func TestUASRouteSet(t *testing.T) {
+	invite := testRecordRouteInvite(t)
+	dialog := &sipgo.DialogServerSession{Dialog: sipgo.Dialog{InviteRequest: invite}}
+
+	uasRouteSet(dialog)
+	if dialog.InviteRequest == invite {
+		t.Fatal("expected dialog INVITE to be clone")
+	}
+	if got := routeHosts(invite, "Record-Route"); got != "p2.test,p1.test" {
+		t.Errorf("received INVITE changed: %s", got)
+	}
+	// sipgo reverses these again, so route set is p2, p1
+	if got := routeHosts(dialog.InviteRequest, "Record-Route"); got != "p1.test,p2.test" {
+		t.Errorf("expected reversed Record-Route on dialog INVITE, got %s", got)
+	}
+	if dialog.InviteRequest.CallID().Value() != "route-test" || dialog.InviteRequest.Source() != invite.Source() {
+		t.Error("dialog INVITE lost headers or source")
+	}
+}
+
+func TestRequestBuild(t *testing.T) {
+	invite := testRecordRouteInvite(t)
+	res := sip.NewResponseFromRequest(invite, sip.StatusOK, "OK", nil)
+	res.To().Params.Add("tag", "b1")
+
+	// UAC route set is reversed Record-Route of response
+	req := sip.NewRequest(sip.BYE, invite.Recipient)
+	UACRequestBuild(req, invite, res)
+	if got := routeHosts(req, "Route"); got != "p1.test,p2.test" {
+		t.Errorf("expected UAC route set p1,p2, got %s", got)
+	}
+	if tag, _ := req.To().Params.Get("tag"); tag != "b1" {
+		t.Errorf("expected To tag of response, got %q", tag)
+	}
+
+	// UAS route set is Record-Route in order
+	req = sip.NewRequest(sip.BYE, invite.Contact().Address)
+	UASRequestBuild(req, res)
+	if got := routeHosts(req, "Route"); got != "p2.test,p1.test" {
+		t.Errorf("expected UAS route set p2,p1, got %s", got)
+	}
+	if tag, _ := req.From().Params.Get("tag"); tag != "b1" {
+		t.Errorf("expected swapped From with tag b1, got %q", tag)
+	}
+}
+
+func TestApplyRouteSetStrictRouter(t *testing.T) {
+	target := sip.Uri{Scheme: "sip", User: "bob", Host: "127.0.0.1", Port: 5060}
+	req := sip.NewRequest(sip.BYE, target)
+	applyRouteSet(req, []sip.Uri{
+		{Scheme: "sip", Host: "strict.test"},
+		{Scheme: "sip", Host: "p2.test", UriParams: sip.NewParams().Add("lr", "")},
+	})
+
+	if req.Recipient.Host != "strict.test" {
+		t.Errorf("expected strict router as Request-URI, got %s", req.Recipient.String())
+	}
+	if got := routeHosts(req, "Route"); got != "p2.test,127.0.0.1" {
+		t.Errorf("expected remote target as last route, got %s", got)
+	}
+}
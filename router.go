@@ -0,0 +1,195 @@
+package sipgox
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// Incoming call routing. Several virtual extensions can be answered on one host where
+// each gets own answer options
+
+// CallRoute matches INVITE and answers it with Options. Patterns are shell patterns
+// as in path.Match, for example "1*" or "sales". Empty pattern matches anything.
+// Registration options (RegisterAddr, InstanceID...) of route are ignored as they
+// belong to Answer
+type CallRoute struct {
+	// Name is used in logs and can be read with dialog Route
+	Name string
+
+	// ToUser matches user of To uri
+	ToUser string
+	// RequestURI matches user@host of Request-URI or host if uri has no user
+	RequestURI string
+	// From matches user@host of From uri
+	From string
+	// Headers match values of headers by name. All must match
+	Headers map[string]string
+
+	Options AnswerOptions
+}
+
+// CallRouter dispatches incoming calls of Answer by first matching route
+type CallRouter struct {
+	Routes []CallRoute
+	// Default answers calls not matching any route. If nil they are rejected
+	Default *AnswerOptions
+	// RejectCode is response to not matched call. Default is 404
+	RejectCode   sip.StatusCode
+	RejectReason string
+}
+
+// WithPhoneCallRouter dispatches calls received by Answer with router. Answer options
+// are then only used for listening and registration. Invalid pattern is option error
+func WithPhoneCallRouter(r CallRouter) PhoneOption {
+	return func(p *Phone) {
+		for _, route := range r.Routes {
+			for _, pattern := range route.patterns() {
+				if _, err := path.Match(pattern, ""); err != nil {
+					p.optionError(fmt.Errorf("bad pattern %q of route %q: %w", pattern, route.Name, err))
+					return
+				}
+			}
+		}
+		p.router = &r
+	}
+}
+
+func (r *CallRoute) patterns() []string {
+	patterns := []string{r.ToUser, r.RequestURI, r.From}
+	for _, v := range r.Headers {
+		patterns = append(patterns, v)
+	}
+	return patterns
+}
+
+// Match checks does request match route
+func (r *CallRoute) Match(req *sip.Request) bool {
+	if r.ToUser != "" {
+		to := req.To()
+		if to == nil || !matchPattern(r.ToUser, to.Address.User) {
+			return false
+		}
+	}
+	if !matchPattern(r.RequestURI, uriUserHost(req.Recipient)) {
+		return false
+	}
+	if r.From != "" {
+		from := req.From()
+		if from == nil || !matchPattern(r.From, uriUserHost(from.Address)) {
+			return false
+		}
+	}
+	for name, pattern := range r.Headers {
+		if !matchHeader(req.GetHeaders(name), pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchHeader(hdrs []sip.Header, pattern string) bool {
+	for _, h := range hdrs {
+		if matchPattern(pattern, h.Value()) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern string, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+func uriUserHost(u sip.Uri) string {
+	if u.User == "" {
+		return u.Host
+	}
+	return u.User + "@" + u.Host
+}
+
+// answerRoute is route prepared by Answer with own authorizer, as authorizer keeps nonces
+// between challenge and authorized INVITE
+type answerRoute struct {
+	name string
+	opts AnswerOptions
+	auth *DigestAuthorizer
+}
+
+func newAnswerRoute(name string, opts AnswerOptions) *answerRoute {
+	auth := opts.Authorizer
+	if auth == nil && opts.Password != "" && opts.RegisterAddr == "" {
+		realm := opts.Realm
+		if realm == "" {
+			realm = "sipgo"
+		}
+		auth = NewDigestAuthorizer(realm, PasswordCredentials{opts.Username: opts.Password})
+	}
+	return &answerRoute{name: name, opts: opts, auth: auth}
+}
+
+// callRoutes selects answer route of incoming calls. Without router every call is
+// answered with options of Answer
+type callRoutes struct {
+	router *CallRouter
+	routes []*answerRoute
+	def    *answerRoute
+}
+
+func newCallRoutes(router *CallRouter, opts AnswerOptions) *callRoutes {
+	if router == nil {
+		return &callRoutes{def: newAnswerRoute("", opts)}
+	}
+
+	c := &callRoutes{router: router}
+	for _, r := range router.Routes {
+		ropts := r.Options
+		// Registration belongs to Answer so credentials are not our account in route
+		ropts.RegisterAddr = ""
+		c.routes = append(c.routes, newAnswerRoute(r.Name, ropts))
+	}
+	if router.Default != nil {
+		ropts := *router.Default
+		ropts.RegisterAddr = ""
+		c.def = newAnswerRoute("default", ropts)
+	}
+	return c
+}
+
+// route returns route of request or nil if call must be rejected
+func (c *callRoutes) route(req *sip.Request) *answerRoute {
+	if c.router != nil {
+		for i := range c.router.Routes {
+			if c.router.Routes[i].Match(req) {
+				return c.routes[i]
+			}
+		}
+	}
+	return c.def
+}
+
+// mayReject checks can calls be rejected before dialog is answered. ACK of rejected call
+// reaches ACK handler as invite transaction is terminated after handler
+func (c *callRoutes) mayReject() bool {
+	if c.router != nil {
+		return true
+	}
+	opts := c.def.opts
+	return c.def.auth != nil || opts.OnCall != nil || opts.OnCallDecision != nil
+}
+
+func (c *callRoutes) reject() (sip.StatusCode, string) {
+	code, reason := c.router.RejectCode, c.router.RejectReason
+	if code == 0 {
+		code = sip.StatusNotFound
+	}
+	if reason == "" && code == sip.StatusNotFound {
+		reason = "Not Found"
+	}
+	return code, reason
+}
@@ -0,0 +1,31 @@
+package sipgox
+
+import (
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/emiago/sipgo"
+)
+
+func TestWithPhoneCallRouterBadPattern(t *testing.T) {
+	ua, err := sipgo.NewUA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ua.Close()
+
+	_, err = NewPhoneChecked(ua, WithPhoneCallRouter(CallRouter{
+		Routes: []CallRoute{{Name: "sales", ToUser: "[1-"}},
+	}))
+	if err == nil || !errors.Is(err, path.ErrBadPattern) {
+		t.Fatalf("expected bad pattern error, got %v", err)
+	}
+
+	p, err := NewPhoneChecked(ua, WithPhoneCallRouter(CallRouter{
+		Routes: []CallRoute{{Name: "sales", ToUser: "1*"}},
+	}))
+	if err != nil || p.router == nil {
+		t.Fatalf("expected router, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package sipgox
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/emiago/media"
+	"github.com/emiago/media/sdp"
+	"github.com/emiago/sipgo/sip"
+	"github.com/rs/zerolog"
+)
+
+// rtpPortRange allocates RTP/RTCP port pairs from range. RTP is always on even port
+// and RTCP on next odd one. It is safe for concurrent use, and port that is taken
+// by someone else is just skipped
+type rtpPortRange struct {
+	start int
+	end   int
+
+	mu   sync.Mutex
+	next int
+}
+
+func newRTPPortRange(start int, end int) (*rtpPortRange, error) {
+	if start%2 != 0 {
+		start++
+	}
+	if start <= 0 || end > 65535 || end < start+1 {
+		return nil, fmt.Errorf("bad RTP port range %d-%d", start, end)
+	}
+	return &rtpPortRange{start: start, end: end, next: start}, nil
+}
+
+func (r *rtpPortRange) nextPort() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	port := r.next
+	r.next += 2
+	if r.next+1 > r.end {
+		r.next = r.start
+	}
+	return port
+}
+
+// listen opens RTP and RTCP sockets on next free pair in range
+func (r *rtpPortRange) listen(ip net.IP) (*net.UDPConn, *net.UDPConn, error) {
+	var err error
+	// Give each pair in range a chance
+	for i := 0; i < (r.end-r.start+1)/2; i++ {
+		port := r.nextPort()
+		var rtpConn, rtcpConn *net.UDPConn
+		rtpConn, rtcpConn, err = listenMedia(ip, port)
+		if err == nil {
+			return rtpConn, rtcpConn, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no available RTP ports in range %d-%d: %w", r.start, r.end, err)
+}
+
+// listenMedia opens RTP socket on port and RTCP socket on next one. Port 0 takes ephemeral port
+func listenMedia(ip net.IP, port int) (*net.UDPConn, *net.UDPConn, error) {
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		return nil, nil, err
+	}
+	laddr := rtpConn.LocalAddr().(*net.UDPAddr)
+	rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP, Port: laddr.Port + 1})
+	if err != nil {
+		rtpConn.Close()
+		return nil, nil, err
+	}
+	return rtpConn, rtcpConn, nil
+}
+
+// newDialogMedia creates media session on phone media IP and port range.
+// If media IP is not set, it is taken from signaling host.
+// Sockets are owned by dialog media, media session is only used for SDP negotiation
+func (p *Phone) newDialogMedia(host string, log zerolog.Logger) (*dialogMedia, error) {
+	ip := p.mediaIP
+	if ip == nil {
+		if lip := net.ParseIP(host); lip != nil && !lip.IsUnspecified() {
+			ip = lip
+		} else {
+			var err error
+			ip, _, err = sip.ResolveInterfacesIP("ip4", nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var rtpConn, rtcpConn *net.UDPConn
+	var err error
+	if p.rtpPorts != nil {
+		rtpConn, rtcpConn, err = p.rtpPorts.listen(ip)
+	} else {
+		// Ephemeral port can be last one or next one can be taken, so retry
+		for i := 0; i < 10; i++ {
+			rtpConn, rtcpConn, err = listenMedia(ip, 0)
+			if err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &media.MediaSession{
+		Laddr:   rtpConn.LocalAddr().(*net.UDPAddr),
+		Formats: sdp.Formats{sdp.FORMAT_TYPE_ULAW, sdp.FORMAT_TYPE_ALAW},
+		Mode:    sdp.ModeSendrecv,
+	}
+	sess.SetLogger(log)
+	cname := p.UA.Name() + "@" + sess.Laddr.IP.String()
+	rtpMConn, rtcpMConn := &mediaConn{PacketConn: rtpConn}, &mediaConn{PacketConn: rtcpConn}
+	dm := newDialogMedia(sess, rtpMConn, rtcpMConn, cname, log)
+	if p.stun != nil && p.externalMediaIP == nil {
+		dm.stun = p.stun.discover(sess.Laddr, rtpMConn, rtcpMConn)
+	}
+	return dm, nil
+}
@@ -0,0 +1,304 @@
+package sipgox
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// CallStats are media quality statistics of dialog session.
+// Remote values and RTT are only present when RTCP reporting is enabled
+type CallStats struct {
+	PacketsSent     uint64
+	OctetsSent      uint64
+	PacketsReceived uint64
+	OctetsReceived  uint64
+
+	// PacketsLost is cumulative number of lost inbound packets
+	PacketsLost int64
+	// FractionLost of inbound packets in last report interval (0-1)
+	FractionLost float64
+	// Jitter is inbound interarrival jitter
+	Jitter time.Duration
+
+	// Values received in remote reception reports
+	RemotePacketsLost  int64
+	RemoteFractionLost float64
+	RemoteJitter       time.Duration
+
+	// RTT is round trip time calculated from LSR and DLSR of remote reports
+	RTT time.Duration
+
+	// RFactor and MOS are estimated with simplified E-model (ITU-T G.107)
+	RFactor float64
+	MOS     float64
+}
+
+// rtpStats tracks RTP stream statistics and builds RTCP reports
+// https://datatracker.ietf.org/doc/html/rfc3550#section-6.4
+type rtpStats struct {
+	mu sync.Mutex
+
+	// Receiving side
+	recvSSRC      uint32
+	recvStarted   bool
+	recvSeq       media.RTPExtendedSequenceNumber
+	recvBaseSeq   uint64
+	recvPackets   uint64
+	recvOctets    uint64
+	recvClockRate uint32
+	transit       float64
+	jitter        float64 // in timestamp units
+	expectedPrior uint64
+	receivedPrior uint64
+	fractionLost  uint8
+
+	// Last sender report received
+	lastSRNTP  uint32
+	lastSRRecv time.Time
+
+	// Sending side
+	sendSSRC      uint32
+	sendPackets   uint64
+	sendOctets    uint64
+	sendClockRate uint32
+	lastSendTS    uint32
+	lastSendTime  time.Time
+
+	// Remote reports about our stream
+	remoteLost         int64
+	remoteFractionLost uint8
+	remoteJitter       uint32
+	rtt                time.Duration
+}
+
+func newRTPStats() *rtpStats {
+	return &rtpStats{
+		sendSSRC:      rand.Uint32(),
+		recvClockRate: 8000,
+		sendClockRate: 8000,
+	}
+}
+
+// payloadClockRate returns RTP clock rate for static payload types
+// https://datatracker.ietf.org/doc/html/rfc3551#section-6
+func payloadClockRate(pt uint8) uint32 {
+	switch pt {
+	case 10, 11:
+		return 44100
+	case 6:
+		return 16000
+	case 16:
+		return 11025
+	case 17:
+		return 22050
+	}
+	return 8000
+}
+
+func (s *rtpStats) onRecv(pkt *rtp.Packet, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.recvStarted || s.recvSSRC != pkt.SSRC {
+		// New source resets our receiving stats
+		s.recvStarted = true
+		s.recvSSRC = pkt.SSRC
+		s.recvSeq.InitSeq(pkt.SequenceNumber)
+		s.recvBaseSeq = uint64(pkt.SequenceNumber)
+		s.recvPackets, s.recvOctets = 0, 0
+		s.expectedPrior, s.receivedPrior = 0, 0
+		s.jitter, s.transit = 0, 0
+		s.recvClockRate = payloadClockRate(pkt.PayloadType)
+	} else {
+		s.recvSeq.UpdateSeq(pkt.SequenceNumber)
+	}
+
+	s.recvPackets++
+	s.recvOctets += uint64(len(pkt.Payload))
+
+	// https://datatracker.ietf.org/doc/html/rfc3550#appendix-A.8
+	arrival := float64(now.UnixNano()) / 1e9 * float64(s.recvClockRate)
+	transit := arrival - float64(pkt.Timestamp)
+	if s.recvPackets > 1 {
+		d := math.Abs(transit - s.transit)
+		if d < float64(s.recvClockRate)*10 {
+			// Ignore huge jumps like timestamp wrap or source restart
+			s.jitter += (d - s.jitter) / 16
+		}
+	}
+	s.transit = transit
+}
+
+func (s *rtpStats) onSend(pkt *rtp.Packet, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sendPackets == 0 {
+		s.sendSSRC = pkt.SSRC
+		s.sendClockRate = payloadClockRate(pkt.PayloadType)
+	}
+	s.sendPackets++
+	s.sendOctets += uint64(len(pkt.Payload))
+	s.lastSendTS = pkt.Timestamp
+	s.lastSendTime = now
+}
+
+func (s *rtpStats) lost() int64 {
+	expected := s.recvSeq.ReadExtendedSeq() - s.recvBaseSeq + 1
+	return int64(expected) - int64(s.recvPackets)
+}
+
+// receptionReport must be called under lock. It updates interval counters
+// https://datatracker.ietf.org/doc/html/rfc3550#appendix-A.3
+func (s *rtpStats) receptionReport(now time.Time) rtcp.ReceptionReport {
+	extMax := s.recvSeq.ReadExtendedSeq()
+	expected := extMax - s.recvBaseSeq + 1
+	expectedInterval := expected - s.expectedPrior
+	receivedInterval := s.recvPackets - s.receivedPrior
+	s.expectedPrior, s.receivedPrior = expected, s.recvPackets
+
+	lostInterval := int64(expectedInterval) - int64(receivedInterval)
+	s.fractionLost = 0
+	if expectedInterval > 0 && lostInterval > 0 {
+		s.fractionLost = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+
+	// Total lost is 24 bit signed
+	lost := min(max(s.lost(), -0x800000), 0x7FFFFF)
+
+	rr := rtcp.ReceptionReport{
+		SSRC:               s.recvSSRC,
+		FractionLost:       s.fractionLost,
+		TotalLost:          uint32(lost) & 0xFFFFFF,
+		LastSequenceNumber: uint32(extMax),
+		Jitter:             uint32(s.jitter),
+		LastSenderReport:   s.lastSRNTP,
+	}
+	if !s.lastSRRecv.IsZero() {
+		// DLSR is in 1/65536 seconds
+		rr.Delay = uint32(now.Sub(s.lastSRRecv).Seconds() * 65536)
+	}
+	return rr
+}
+
+// report builds SR if we are sending otherwise RR
+func (s *rtpStats) report(now time.Time) rtcp.Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []rtcp.ReceptionReport
+	if s.recvStarted {
+		reports = append(reports, s.receptionReport(now))
+	}
+
+	if s.sendPackets == 0 {
+		return &rtcp.ReceiverReport{
+			SSRC:    s.sendSSRC,
+			Reports: reports,
+		}
+	}
+
+	// Extrapolate RTP timestamp to current time
+	rtpTime := s.lastSendTS + uint32(now.Sub(s.lastSendTime).Seconds()*float64(s.sendClockRate))
+	return &rtcp.SenderReport{
+		SSRC:        s.sendSSRC,
+		NTPTime:     media.NTPTimestamp(now),
+		RTPTime:     rtpTime,
+		PacketCount: uint32(s.sendPackets),
+		OctetCount:  uint32(s.sendOctets),
+		Reports:     reports,
+	}
+}
+
+func (s *rtpStats) onRTCP(pkt rtcp.Packet, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []rtcp.ReceptionReport
+	switch p := pkt.(type) {
+	case *rtcp.SenderReport:
+		// Middle 32 bits of NTP timestamp is used as LSR
+		s.lastSRNTP = uint32(p.NTPTime >> 16)
+		s.lastSRRecv = now
+		reports = p.Reports
+	case *rtcp.ReceiverReport:
+		reports = p.Reports
+	}
+
+	for _, rr := range reports {
+		if rr.SSRC != s.sendSSRC {
+			continue
+		}
+
+		// 24 bit signed value
+		lost := int64(rr.TotalLost & 0xFFFFFF)
+		if lost&0x800000 != 0 {
+			lost -= 0x1000000
+		}
+		s.remoteLost = lost
+		s.remoteFractionLost = rr.FractionLost
+		s.remoteJitter = rr.Jitter
+
+		if rr.LastSenderReport != 0 {
+			// Modular arithmetic as middle 32 bits of NTP wrap every 18h
+			// https://datatracker.ietf.org/doc/html/rfc3550#section-6.4.1
+			nowMiddle := uint32(media.NTPTimestamp(now) >> 16)
+			rtt := nowMiddle - rr.LastSenderReport - rr.Delay
+			// Negative is clock skew or bad report
+			if int32(rtt) >= 0 {
+				s.rtt = time.Duration(float64(rtt) / 65536 * float64(time.Second))
+			}
+		}
+	}
+}
+
+func (s *rtpStats) stats() CallStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs := CallStats{
+		PacketsSent:        s.sendPackets,
+		OctetsSent:         s.sendOctets,
+		PacketsReceived:    s.recvPackets,
+		OctetsReceived:     s.recvOctets,
+		FractionLost:       float64(s.fractionLost) / 256,
+		Jitter:             time.Duration(s.jitter / float64(s.recvClockRate) * float64(time.Second)),
+		RemotePacketsLost:  s.remoteLost,
+		RemoteFractionLost: float64(s.remoteFractionLost) / 256,
+		RemoteJitter:       time.Duration(float64(s.remoteJitter) / float64(s.sendClockRate) * float64(time.Second)),
+		RTT:                s.rtt,
+	}
+	if s.recvStarted {
+		cs.PacketsLost = max(s.lost(), 0)
+	}
+
+	loss := max(cs.FractionLost, cs.RemoteFractionLost)
+	if cs.FractionLost == 0 && cs.PacketsReceived > 0 {
+		// Before first report use cumulative loss
+		loss = max(loss, float64(cs.PacketsLost)/float64(cs.PacketsLost+int64(cs.PacketsReceived)))
+	}
+	cs.RFactor, cs.MOS = estimateMOS(cs.RTT/2, max(cs.Jitter, cs.RemoteJitter), loss)
+	return cs
+}
+
+// estimateMOS uses simplified E-model for narrowband G.711 calls
+func estimateMOS(latency time.Duration, jitter time.Duration, loss float64) (rfactor float64, mos float64) {
+	// Effective latency accounts jitter buffer and codec delay
+	eff := float64(latency.Milliseconds()) + 2*float64(jitter.Milliseconds()) + 10
+	if eff < 160 {
+		rfactor = 93.2 - eff/40
+	} else {
+		rfactor = 93.2 - (eff-120)/10
+	}
+	rfactor -= 2.5 * loss * 100
+	rfactor = min(max(rfactor, 0), 100)
+
+	mos = 1 + 0.035*rfactor + 0.000007*rfactor*(rfactor-60)*(100-rfactor)
+	return rfactor, min(max(mos, 1), 4.5)
+}
@@ -0,0 +1,194 @@
+package sipgox
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emiago/media"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+func testStatsPacket(seq uint16, ts uint32) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, SSRC: 1, SequenceNumber: seq, Timestamp: ts},
+		Payload: make([]byte, 160),
+	}
+}
+
+func TestRTPStatsJitter(t *testing.T) {
+	s := newRTPStats()
+	start := time.Unix(1000, 0)
+	// Packets of 20ms arriving on time have no jitter
+	for i := 0; i < 10; i++ {
+		s.onRecv(testStatsPacket(uint16(i), uint32(i*160)), start.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	if j := s.stats().Jitter; j != 0 {
+		t.Fatalf("expected no jitter, got %s", j)
+	}
+
+	// 10ms late is 80 timestamp units, which moves jitter by 1/16
+	s.onRecv(testStatsPacket(10, 1600), start.Add(210*time.Millisecond))
+	if j := s.stats().Jitter; j != 625*time.Microsecond {
+		t.Errorf("expected jitter 625us, got %s", j)
+	}
+}
+
+func TestRTPStatsLoss(t *testing.T) {
+	s := newRTPStats()
+	now := time.Unix(1000, 0)
+	for _, seq := range []uint16{65534, 65535, 1, 2} {
+		s.onRecv(testStatsPacket(seq, 0), now)
+	}
+	// Sequence 0 is lost across wrap
+	if lost := s.stats().PacketsLost; lost != 1 {
+		t.Fatalf("expected 1 lost, got %d", lost)
+	}
+
+	rr := s.report(now).(*rtcp.ReceiverReport).Reports[0]
+	if rr.TotalLost != 1 || rr.FractionLost != 256/5 {
+		t.Errorf("unexpected report %+v", rr)
+	}
+	if rr.LastSequenceNumber != 1<<16+2 {
+		t.Errorf("expected extended sequence, got %d", rr.LastSequenceNumber)
+	}
+
+	// Next interval without loss
+	s.onRecv(testStatsPacket(3, 0), now)
+	if rr := s.report(now).(*rtcp.ReceiverReport).Reports[0]; rr.FractionLost != 0 || rr.TotalLost != 1 {
+		t.Errorf("unexpected report %+v", rr)
+	}
+}
+
+func TestRTPStatsRemoteReport(t *testing.T) {
+	s := newRTPStats()
+	now := time.Unix(1000, 0)
+	// Total lost is 24 bit signed, duplicates make it negative
+	s.onRTCP(&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{
+		SSRC:         s.sendSSRC,
+		FractionLost: 64,
+		TotalLost:    0xFFFFFF,
+		Jitter:       80,
+	}}}, now)
+	// Report of other source is ignored
+	s.onRTCP(&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{SSRC: s.sendSSRC + 1, TotalLost: 5}}}, now)
+
+	cs := s.stats()
+	if cs.RemotePacketsLost != -1 || cs.RemoteFractionLost != 0.25 || cs.RemoteJitter != 10*time.Millisecond {
+		t.Errorf("unexpected remote stats %+v", cs)
+	}
+}
+
+func TestRTPStatsRTT(t *testing.T) {
+	// NTP seconds are multiple of 65536 at start, so middle 32 bits wrap just before it
+	ntpUnixOffset := int64(2208988800)
+	wrap := time.Unix(65536*40000-ntpUnixOffset, 0)
+
+	tests := []struct {
+		name string
+		now  time.Time
+	}{
+		{"no wrap", time.Unix(1000, 0)},
+		{"wrap", wrap.Add(50 * time.Millisecond)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newRTPStats()
+			// Remote held our SR for 1s and RTT is 100ms, in 1/65536 seconds
+			delay, rtt := uint32(65536), uint32(6554)
+			nowMiddle := uint32(media.NTPTimestamp(tc.now) >> 16)
+			s.onRTCP(&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{
+				SSRC:             s.sendSSRC,
+				LastSenderReport: nowMiddle - delay - rtt,
+				Delay:            delay,
+			}}}, tc.now)
+
+			if d := s.stats().RTT - 100*time.Millisecond; d < -time.Millisecond || d > time.Millisecond {
+				t.Errorf("expected RTT 100ms, got %s", s.stats().RTT)
+			}
+		})
+	}
+
+	// DLSR larger than elapsed time is ignored
+	s := newRTPStats()
+	now := time.Unix(1000, 0)
+	s.onRTCP(&rtcp.ReceiverReport{Reports: []rtcp.ReceptionReport{{
+		SSRC:             s.sendSSRC,
+		LastSenderReport: uint32(media.NTPTimestamp(now) >> 16),
+		Delay:            65536,
+	}}}, now)
+	if rtt := s.stats().RTT; rtt != 0 {
+		t.Errorf("expected no RTT, got %s", rtt)
+	}
+}
+
+func TestEstimateMOS(t *testing.T) {
+	tests := []struct {
+		latency time.Duration
+		jitter  time.Duration
+		loss    float64
+		rfactor float64
+		mos     float64
+	}{
+		{0, 0, 0, 92.95, 4.404},
+		{0, 0, 0.1, 67.95, 3.499},
+		{300 * time.Millisecond, 0, 0, 74.2, 3.787},
+		{100 * time.Millisecond, 20 * time.Millisecond, 0, 89.45, 4.325},
+		{0, 0, 1, 0, 1},
+	}
+	for _, tc := range tests {
+		r, mos := estimateMOS(tc.latency, tc.jitter, tc.loss)
+		if math.Abs(r-tc.rfactor) > 0.01 || math.Abs(mos-tc.mos) > 0.001 {
+			t.Errorf("latency=%s jitter=%s loss=%v: expected R %v MOS %v, got %v %v", tc.latency, tc.jitter, tc.loss, tc.rfactor, tc.mos, r, mos)
+		}
+	}
+}
+
+func TestDialogMediaMonitorRTCP(t *testing.T) {
+	dm := newTestDialogMedia(t)
+	peer := newTestPeer(t)
+	dm.setRemote(peer.LocalAddr().(*net.UDPAddr))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dm.monitorRTCP(ctx, time.Hour)
+	sess := newMediaSession(dm)
+
+	rr := &rtcp.ReceiverReport{SSRC: 2, Reports: []rtcp.ReceptionReport{{SSRC: dm.stats.sendSSRC, TotalLost: 3}}}
+	data, _ := rr.Marshal()
+	rtcpAddr := dm.rtcpConn.LocalAddr()
+	peer.WriteTo(data, rtcpAddr)
+
+	// Caller and stats both get report
+	pkts := make([]rtcp.Packet, 5)
+	n, err := sess.ReadRTCP(pkts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := pkts[0].(*rtcp.ReceiverReport); n != 1 || !ok || r.SSRC != 2 {
+		t.Fatalf("unexpected packets %v", pkts[:n])
+	}
+	if lost := dm.Stats().RemotePacketsLost; lost != 3 {
+		t.Errorf("expected report in stats, got lost %d", lost)
+	}
+
+	peer.WriteTo(data, rtcpAddr)
+	buf := make([]byte, 1500)
+	n, err = sess.ReadRTCPRaw(buf)
+	if err != nil || string(buf[:n]) != string(data) {
+		t.Fatalf("expected raw report, got %v", err)
+	}
+
+	if _, err := sess.ReadRTCPRawDeadline(buf, time.Now().Add(10*time.Millisecond)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+
+	dm.Close()
+	if _, err := sess.ReadRTCP(pkts); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected closed error, got %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package sipgox
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Helpers for manipulating SDP generated by media session.
+// media package generates only minimal audio SDP so we patch it line by line
+
+func sdpLines(body []byte) []string {
+	body = bytes.TrimRight(body, "\r\n")
+	if len(body) == 0 {
+		return nil
+	}
+	lines := strings.Split(string(body), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSuffix(l, "\r")
+	}
+	return lines
+}
+
+func sdpJoin(lines []string) []byte {
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// sdpSetMediaProto changes proto of audio media line. Ex RTP/AVP -> RTP/SAVP
+func sdpSetMediaProto(body []byte, proto string) []byte {
+	lines := sdpLines(body)
+	for i, l := range lines {
+		if !strings.HasPrefix(l, "m=audio ") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) < 3 {
+			continue
+		}
+		fields[2] = proto
+		lines[i] = strings.Join(fields, " ")
+	}
+	return sdpJoin(lines)
+}
+
+// sdpAppendAttributes adds attributes at the end of SDP. As we deal only with single
+// audio media, they end up as media level attributes
+func sdpAppendAttributes(body []byte, attrs ...string) []byte {
+	lines := sdpLines(body)
+	for _, a := range attrs {
+		lines = append(lines, "a="+a)
+	}
+	return sdpJoin(lines)
+}
+
+// sdpInsertSessionAttributes adds attributes before first media description
+func sdpInsertSessionAttributes(body []byte, attrs ...string) []byte {
+	lines := sdpLines(body)
+	ind := len(lines)
+	for i, l := range lines {
+		if strings.HasPrefix(l, "m=") {
+			ind = i
+			break
+		}
+	}
+
+	res := make([]string, 0, len(lines)+len(attrs))
+	res = append(res, lines[:ind]...)
+	for _, a := range attrs {
+		res = append(res, "a="+a)
+	}
+	res = append(res, lines[ind:]...)
+	return sdpJoin(res)
+}
+
+// sdpAttributes returns all values of attribute with name. Ex name "crypto" for a=crypto:...
+func sdpAttributes(body []byte, name string) []string {
+	var vals []string
+	prefix := "a=" + name + ":"
+	for _, l := range sdpLines(body) {
+		if strings.HasPrefix(l, prefix) {
+			vals = append(vals, l[len(prefix):])
+		}
+	}
+	return vals
+}
+
+// sdpMediaProto returns proto of audio media line
+func sdpMediaProto(body []byte) string {
+	for _, l := range sdpLines(body) {
+		if !strings.HasPrefix(l, "m=audio ") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) < 3 {
+			return ""
+		}
+		return fields[2]
+	}
+	return ""
+}
+
+// sdpSetConnectionIP changes connection and origin address. Ex for public IP behind NAT
+func sdpSetConnectionIP(body []byte, ip net.IP) []byte {
+	addrType := sdpAddrType(ip)
+
+	lines := sdpLines(body)
+	for i, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "c="):
+			lines[i] = "c=IN " + addrType + " " + ip.String()
+		case strings.HasPrefix(l, "o="):
+			// o=<username> <sess-id> <sess-version> <nettype> <addrtype> <unicast-address>
+			fields := strings.Fields(l)
+			if len(fields) == 6 {
+				fields[4], fields[5] = addrType, ip.String()
+				lines[i] = strings.Join(fields, " ")
+			}
+		}
+	}
+	return sdpJoin(lines)
+}
+
+// sdpSetMediaPort changes port of audio media line
+func sdpSetMediaPort(body []byte, port int) []byte {
+	lines := sdpLines(body)
+	for i, l := range lines {
+		if !strings.HasPrefix(l, "m=audio ") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) < 3 {
+			continue
+		}
+		fields[1] = strconv.Itoa(port)
+		lines[i] = strings.Join(fields, " ")
+	}
+	return sdpJoin(lines)
+}
+
+func sdpAddrType(ip net.IP) string {
+	if ip.To4() == nil {
+		return "IP6"
+	}
+	return "IP4"
+}
+
+// https://datatracker.ietf.org/doc/html/rfc3264#section-5.1
+var sdpDirections = []string{"sendrecv", "sendonly", "recvonly", "inactive"}
+
+// sdpDirection returns media direction attribute. Connection address 0.0.0.0 is old style
+// hold (RFC 2543) and means sendonly
+func sdpDirection(body []byte) string {
+	dir := "sendrecv"
+	for _, l := range sdpLines(body) {
+		switch {
+		case strings.HasPrefix(l, "a=") && slices.Contains(sdpDirections, l[2:]):
+			dir = l[2:]
+		case l == "c=IN IP4 0.0.0.0" && dir == "sendrecv":
+			dir = "sendonly"
+		}
+	}
+	return dir
+}
+
+// sdpSetDirection replaces direction attributes with dir
+func sdpSetDirection(body []byte, dir string) []byte {
+	lines := sdpLines(body)
+	filtered := lines[:0]
+	for _, l := range lines {
+		if strings.HasPrefix(l, "a=") && slices.Contains(sdpDirections, l[2:]) {
+			continue
+		}
+		filtered = append(filtered, l)
+	}
+	return sdpAppendAttributes(sdpJoin(filtered), dir)
+}
+
+// sdpReverseDirection is direction of answer to offered direction
+func sdpReverseDirection(dir string) string {
+	switch dir {
+	case "sendonly":
+		return "recvonly"
+	case "recvonly":
+		return "sendonly"
+	}
+	return dir
+}
+
+// sdpNextVersion increases session version of origin as needed for every new offer or answer
+// in session
+func sdpNextVersion(body []byte) []byte {
+	lines := sdpLines(body)
+	for i, l := range lines {
+		if !strings.HasPrefix(l, "o=") {
+			continue
+		}
+		fields := strings.Fields(l)
+		if len(fields) != 6 {
+			break
+		}
+		if v, err := strconv.ParseUint(fields[2], 10, 64); err == nil {
+			fields[2] = strconv.FormatUint(v+1, 10)
+			lines[i] = strings.Join(fields, " ")
+		}
+		break
+	}
+	return sdpJoin(lines)
+}
+
+// Static payload types which may come without rtpmap
+// https://datatracker.ietf.org/doc/html/rfc3551#section-6
+var sdpStaticPayloadTypes = map[uint8]string{
+	0:  "pcmu/8000",
+	3:  "gsm/8000",
+	4:  "g723/8000",
+	8:  "pcma/8000",
+	9:  "g722/8000",
+	18: "g729/8000",
+}
+
+// sdpPacketTime returns a=ptime of SDP. Default is 20ms
+// https://datatracker.ietf.org/doc/html/rfc4566#section-6
+func sdpPacketTime(body []byte) time.Duration {
+	for _, l := range sdpLines(body) {
+		if v, ok := strings.CutPrefix(l, "a=ptime:"); ok {
+			if ms, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && ms > 0 {
+				return time.Duration(ms * float64(time.Millisecond))
+			}
+		}
+	}
+	return 20 * time.Millisecond
+}
+
+// sdpPayloadTypes returns encodings of audio payload types as lower case name/rate
+func sdpPayloadTypes(body []byte) map[uint8]string {
+	pts := make(map[uint8]string)
+	for _, l := range sdpLines(body) {
+		switch {
+		case strings.HasPrefix(l, "m=audio "):
+			fields := strings.Fields(l)
+			if len(fields) < 4 {
+				continue
+			}
+			for _, f := range fields[3:] {
+				pt, err := strconv.ParseUint(f, 10, 7)
+				if err != nil {
+					continue
+				}
+				if enc, exists := sdpStaticPayloadTypes[uint8(pt)]; exists {
+					pts[uint8(pt)] = enc
+				}
+			}
+
+		case strings.HasPrefix(l, "a=rtpmap:"):
+			// a=rtpmap:<payload type> <encoding name>/<clock rate>[/<encoding parameters>]
+			pt, enc, ok := strings.Cut(l[len("a=rtpmap:"):], " ")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(pt, 10, 7)
+			if err != nil {
+				continue
+			}
+			name, rate, _ := strings.Cut(enc, "/")
+			rate, _, _ = strings.Cut(rate, "/")
+			pts[uint8(n)] = strings.ToLower(name) + "/" + rate
+		}
+	}
+	return pts
+}
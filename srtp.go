@@ -0,0 +1,240 @@
+package sipgox
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v3"
+)
+
+// SRTPMode controls SDES-SRTP negotiation of media
+type SRTPMode int
+
+const (
+	// SRTPDisabled uses plain RTP/AVP
+	SRTPDisabled SRTPMode = iota
+	// SRTPOptional offers crypto with RTP/AVP and falls back to plain RTP if remote does not accept it
+	SRTPOptional
+	// SRTPRequired offers RTP/SAVP and fails call if keys are not negotiated
+	SRTPRequired
+)
+
+const (
+	sdpProtoSAVP = "RTP/SAVP"
+
+	// Only suite we support for now
+	srtpSuiteAES128SHA80 = "AES_CM_128_HMAC_SHA1_80"
+	srtpKeyLen           = 16
+	srtpSaltLen          = 14
+)
+
+var (
+	ErrSRTPNotNegotiated = fmt.Errorf("srtp not negotiated")
+)
+
+// sdesCrypto is SDP crypto attribute
+// a=crypto:<tag> <crypto-suite> inline:<key||salt>[|lifetime][|MKI:length]
+// https://datatracker.ietf.org/doc/html/rfc4568#section-9.1
+type sdesCrypto struct {
+	Tag   int
+	Suite string
+	// Key is master key concatenated with master salt
+	Key []byte
+}
+
+func newSDESCrypto(tag int) (sdesCrypto, error) {
+	key := make([]byte, srtpKeyLen+srtpSaltLen)
+	if _, err := rand.Read(key); err != nil {
+		return sdesCrypto{}, err
+	}
+	return sdesCrypto{Tag: tag, Suite: srtpSuiteAES128SHA80, Key: key}, nil
+}
+
+func (c sdesCrypto) String() string {
+	return fmt.Sprintf("%d %s inline:%s", c.Tag, c.Suite, base64.StdEncoding.EncodeToString(c.Key))
+}
+
+func parseSDESCrypto(val string) (c sdesCrypto, err error) {
+	fields := strings.Fields(val)
+	if len(fields) < 3 {
+		return c, fmt.Errorf("bad crypto attribute %q", val)
+	}
+
+	c.Tag, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return c, fmt.Errorf("bad crypto tag %q: %w", fields[0], err)
+	}
+	c.Suite = fields[1]
+
+	keyParams, found := strings.CutPrefix(fields[2], "inline:")
+	if !found {
+		return c, fmt.Errorf("unsupported crypto key method %q", fields[2])
+	}
+	// Lifetime and MKI are ignored
+	keySalt, _, _ := strings.Cut(keyParams, "|")
+	c.Key, err = base64.StdEncoding.DecodeString(keySalt)
+	if err != nil {
+		// Some implementations strip padding
+		c.Key, err = base64.RawStdEncoding.DecodeString(keySalt)
+		if err != nil {
+			return c, fmt.Errorf("bad crypto key: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// sdpCryptos returns supported crypto attributes from SDP
+func sdpCryptos(body []byte) []sdesCrypto {
+	var cryptos []sdesCrypto
+	for _, v := range sdpAttributes(body, "crypto") {
+		c, err := parseSDESCrypto(v)
+		if err != nil {
+			continue
+		}
+		if c.Suite != srtpSuiteAES128SHA80 || len(c.Key) != srtpKeyLen+srtpSaltLen {
+			continue
+		}
+		cryptos = append(cryptos, c)
+	}
+	return cryptos
+}
+
+// srtpOffer adds our crypto to SDP offer based on mode
+func srtpOffer(body []byte, mode SRTPMode) ([]byte, error) {
+	if mode == SRTPDisabled {
+		return body, nil
+	}
+
+	c, err := newSDESCrypto(1)
+	if err != nil {
+		return nil, err
+	}
+	if mode == SRTPRequired {
+		body = sdpSetMediaProto(body, sdpProtoSAVP)
+	}
+	return sdpAppendAttributes(body, "crypto:"+c.String()), nil
+}
+
+// srtpAnswer picks crypto from remote offer and adds ours to SDP answer.
+// It returns nil session in case SRTP is not used. RTP/SAVP offer can not be answered
+// with plain RTP, so it fails unless SRTP is negotiated
+// https://datatracker.ietf.org/doc/html/rfc3264#section-6
+func srtpAnswer(offer []byte, answer []byte, mode SRTPMode) ([]byte, *srtpSession, error) {
+	savp := strings.EqualFold(sdpMediaProto(offer), sdpProtoSAVP)
+	if mode == SRTPDisabled {
+		if savp {
+			return nil, nil, fmt.Errorf("%s offered but SRTP is disabled: %w", sdpProtoSAVP, ErrSRTPNotNegotiated)
+		}
+		return answer, nil, nil
+	}
+
+	remotes := sdpCryptos(offer)
+	if len(remotes) == 0 {
+		if mode == SRTPRequired || savp {
+			return nil, nil, fmt.Errorf("no supported crypto offered: %w", ErrSRTPNotNegotiated)
+		}
+		return answer, nil, nil
+	}
+
+	remote := remotes[0]
+	local, err := newSDESCrypto(remote.Tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sess, err := newSRTPSession(local, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Answer must match offered proto
+	if proto := sdpMediaProto(offer); proto != "" {
+		answer = sdpSetMediaProto(answer, proto)
+	}
+	return sdpAppendAttributes(answer, "crypto:"+local.String()), sess, nil
+}
+
+// srtpNegotiated matches our offer with remote answer.
+// It returns nil session in case SRTP is not used
+func srtpNegotiated(offer []byte, answer []byte, mode SRTPMode) (*srtpSession, error) {
+	if mode == SRTPDisabled {
+		return nil, nil
+	}
+
+	locals := sdpCryptos(offer)
+	for _, remote := range sdpCryptos(answer) {
+		for _, local := range locals {
+			if local.Tag == remote.Tag {
+				return newSRTPSession(local, remote)
+			}
+		}
+	}
+
+	if mode == SRTPRequired {
+		return nil, fmt.Errorf("no crypto in answer: %w", ErrSRTPNotNegotiated)
+	}
+	return nil, nil
+}
+
+// srtpSession encrypts our outgoing and decrypts remote incoming RTP/RTCP
+type srtpSession struct {
+	localMu sync.Mutex
+	local   *srtp.Context
+
+	remoteMu sync.Mutex
+	remote   *srtp.Context
+}
+
+func newSRTPSession(local sdesCrypto, remote sdesCrypto) (*srtpSession, error) {
+	lctx, err := srtp.CreateContext(local.Key[:srtpKeyLen], local.Key[srtpKeyLen:], srtp.ProtectionProfileAes128CmHmacSha1_80)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local srtp context: %w", err)
+	}
+
+	rctx, err := srtp.CreateContext(remote.Key[:srtpKeyLen], remote.Key[srtpKeyLen:], srtp.ProtectionProfileAes128CmHmacSha1_80,
+		srtp.SRTPReplayProtection(64), srtp.SRTCPReplayProtection(64),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote srtp context: %w", err)
+	}
+
+	return &srtpSession{local: lctx, remote: rctx}, nil
+}
+
+func (s *srtpSession) encryptRTP(pkt *rtp.Packet) ([]byte, error) {
+	data, err := pkt.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	s.localMu.Lock()
+	defer s.localMu.Unlock()
+	return s.local.EncryptRTP(nil, data, nil)
+}
+
+// decryptRTP decrypts data in place and parses it to pkt
+func (s *srtpSession) decryptRTP(data []byte, pkt *rtp.Packet) error {
+	s.remoteMu.Lock()
+	dec, err := s.remote.DecryptRTP(data, data, nil)
+	s.remoteMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return pkt.Unmarshal(dec)
+}
+
+func (s *srtpSession) encryptRTCP(data []byte) ([]byte, error) {
+	s.localMu.Lock()
+	defer s.localMu.Unlock()
+	return s.local.EncryptRTCP(nil, data, nil)
+}
+
+func (s *srtpSession) decryptRTCP(data []byte) ([]byte, error) {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+	return s.remote.DecryptRTCP(data, data, nil)
+}
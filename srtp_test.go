@@ -0,0 +1,189 @@
+package sipgox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+const testSRTPSDP = "v=0\r\n" +
+	"o=- 1 1 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 40000 RTP/AVP 0\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n"
+
+// testSRTPKey is key and salt of 30 bytes
+var testSRTPKey = bytes.Repeat([]byte{7}, srtpKeyLen+srtpSaltLen)
+
+func testSRTPOffer(proto string, cryptos ...string) []byte {
+	body := sdpSetMediaProto([]byte(testSRTPSDP), proto)
+	for _, c := range cryptos {
+		body = sdpAppendAttributes(body, "crypto:"+c)
+	}
+	return body
+}
+
+func TestParseSDESCrypto(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testSRTPKey)
+	tests := []struct {
+		val string
+		tag int
+		err bool
+	}{
+		{val: "1 AES_CM_128_HMAC_SHA1_80 inline:" + key, tag: 1},
+		// Lifetime and MKI are ignored
+		{val: "2 AES_CM_128_HMAC_SHA1_80 inline:" + key + "|2^20|1:4", tag: 2},
+		// Padding stripped
+		{val: "3 AES_CM_128_HMAC_SHA1_80 inline:" + strings.TrimRight(key, "="), tag: 3},
+		// Session params are ignored
+		{val: "4 AES_CM_128_HMAC_SHA1_80 inline:" + key + " UNENCRYPTED_SRTCP", tag: 4},
+		{val: "1 AES_CM_128_HMAC_SHA1_80", err: true},
+		{val: "x AES_CM_128_HMAC_SHA1_80 inline:" + key, err: true},
+		{val: "1 AES_CM_128_HMAC_SHA1_80 key:" + key, err: true},
+		{val: "1 AES_CM_128_HMAC_SHA1_80 inline:!!!", err: true},
+	}
+	for _, tc := range tests {
+		c, err := parseSDESCrypto(tc.val)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.val, err)
+			continue
+		}
+		if c.Tag != tc.tag || c.Suite != srtpSuiteAES128SHA80 || !bytes.Equal(c.Key, testSRTPKey) {
+			t.Errorf("%q: unexpected crypto %+v", tc.val, c)
+		}
+	}
+}
+
+func TestSDPCryptos(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testSRTPKey)
+	shortKey := base64.StdEncoding.EncodeToString(testSRTPKey[:20])
+	body := testSRTPOffer("RTP/SAVP",
+		"1 AES_256_CM_HMAC_SHA1_80 inline:"+key,
+		"2 AES_CM_128_HMAC_SHA1_80 inline:"+shortKey,
+		"3 AES_CM_128_HMAC_SHA1_80 inline:"+key,
+		"bad",
+	)
+
+	// Only supported suite with right key length is used
+	cryptos := sdpCryptos(body)
+	if len(cryptos) != 1 || cryptos[0].Tag != 3 {
+		t.Fatalf("unexpected cryptos %+v", cryptos)
+	}
+	if c, err := parseSDESCrypto(cryptos[0].String()); err != nil || c.Tag != 3 || !bytes.Equal(c.Key, testSRTPKey) {
+		t.Errorf("crypto does not survive formatting: %+v %v", c, err)
+	}
+}
+
+func TestSRTPAnswer(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testSRTPKey)
+	crypto := "5 AES_CM_128_HMAC_SHA1_80 inline:" + key
+	tests := []struct {
+		name  string
+		offer []byte
+		mode  SRTPMode
+		srtp  bool
+		err   bool
+	}{
+		{name: "disabled plain", offer: testSRTPOffer("RTP/AVP"), mode: SRTPDisabled},
+		{name: "disabled optional offer", offer: testSRTPOffer("RTP/AVP", crypto), mode: SRTPDisabled},
+		{name: "disabled SAVP offer", offer: testSRTPOffer("RTP/SAVP", crypto), mode: SRTPDisabled, err: true},
+		{name: "optional plain", offer: testSRTPOffer("RTP/AVP"), mode: SRTPOptional},
+		{name: "optional crypto", offer: testSRTPOffer("RTP/AVP", crypto), mode: SRTPOptional, srtp: true},
+		{name: "optional SAVP without crypto", offer: testSRTPOffer("RTP/SAVP"), mode: SRTPOptional, err: true},
+		{name: "required plain", offer: testSRTPOffer("RTP/AVP"), mode: SRTPRequired, err: true},
+		{name: "required SAVP", offer: testSRTPOffer("RTP/SAVP", crypto), mode: SRTPRequired, srtp: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			answer, sess, err := srtpAnswer(tc.offer, []byte(testSRTPSDP), tc.mode)
+			if tc.err {
+				if !errors.Is(err, ErrSRTPNotNegotiated) {
+					t.Fatalf("expected not negotiated error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (sess != nil) != tc.srtp {
+				t.Fatalf("expected srtp %v", tc.srtp)
+			}
+
+			cryptos := sdpCryptos(answer)
+			if !tc.srtp {
+				if len(cryptos) > 0 {
+					t.Errorf("unexpected crypto in answer %+v", cryptos)
+				}
+				return
+			}
+
+			// Answer matches offered proto and has our crypto with offered tag
+			if proto := sdpMediaProto(answer); proto != sdpMediaProto(tc.offer) {
+				t.Errorf("expected proto %s, got %s", sdpMediaProto(tc.offer), proto)
+			}
+			if len(cryptos) != 1 || cryptos[0].Tag != 5 || bytes.Equal(cryptos[0].Key, testSRTPKey) {
+				t.Errorf("expected own crypto with tag 5, got %+v", cryptos)
+			}
+		})
+	}
+}
+
+func TestSRTPNegotiated(t *testing.T) {
+	offer, err := srtpOffer([]byte(testSRTPSDP), SRTPRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proto := sdpMediaProto(offer); proto != sdpProtoSAVP {
+		t.Fatalf("expected required offer with %s, got %s", sdpProtoSAVP, proto)
+	}
+	if plain, _ := srtpOffer([]byte(testSRTPSDP), SRTPOptional); sdpMediaProto(plain) != "RTP/AVP" || len(sdpCryptos(plain)) != 1 {
+		t.Fatalf("expected optional offer with RTP/AVP and crypto")
+	}
+
+	answer, answerSess, err := srtpAnswer(offer, []byte(testSRTPSDP), SRTPRequired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offerSess, err := srtpNegotiated(offer, answer, SRTPRequired)
+	if err != nil || offerSess == nil {
+		t.Fatalf("expected negotiated session, got %v", err)
+	}
+
+	// Keys of each side decrypt other side
+	pkt := &rtp.Packet{Header: rtp.Header{Version: 2, SSRC: 1, SequenceNumber: 1}, Payload: []byte("hello")}
+	data, err := offerSess.encryptRTP(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := rtp.Packet{}
+	if err := answerSess.decryptRTP(data, &dec); err != nil || string(dec.Payload) != "hello" {
+		t.Fatalf("failed to decrypt, %v", err)
+	}
+	// Replay is rejected
+	data, _ = offerSess.encryptRTP(pkt)
+	if err := answerSess.decryptRTP(data, &dec); err == nil {
+		t.Error("expected replayed packet to be rejected")
+	}
+
+	// Answer with other tag is not negotiated
+	key := base64.StdEncoding.EncodeToString(testSRTPKey)
+	otherTag := testSRTPOffer("RTP/SAVP", "9 AES_CM_128_HMAC_SHA1_80 inline:"+key)
+	if _, err := srtpNegotiated(offer, otherTag, SRTPRequired); !errors.Is(err, ErrSRTPNotNegotiated) {
+		t.Errorf("expected not negotiated error, got %v", err)
+	}
+	if sess, err := srtpNegotiated(offer, otherTag, SRTPOptional); sess != nil || err != nil {
+		t.Errorf("expected optional fallback to plain RTP, got %v %v", sess, err)
+	}
+}
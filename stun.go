@@ -0,0 +1,257 @@
+package sipgox
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+var (
+	ErrSTUNTimeout = fmt.Errorf("stun binding timeout")
+)
+
+// stunMapping is public mapping of media sockets
+type stunMapping struct {
+	rtp     *net.UDPAddr
+	rtcp    *net.UDPAddr
+	expires time.Time
+}
+
+// stunDiscovery discovers public mapping of RTP/RTCP ports with STUN binding request
+// https://datatracker.ietf.org/doc/html/rfc5389#section-7
+type stunDiscovery struct {
+	server string
+	ttl    time.Duration
+	// timeout of single binding request including retransmissions
+	timeout time.Duration
+	// retryAfter is time discovery is not tried after failure, so calls are not
+	// delayed while server is not reachable
+	retryAfter time.Duration
+
+	mu          sync.Mutex
+	cache       map[string]stunMapping
+	failedUntil time.Time
+}
+
+func newSTUNDiscovery(server string, ttl time.Duration) *stunDiscovery {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &stunDiscovery{
+		server:     server,
+		ttl:        ttl,
+		timeout:    2 * time.Second,
+		retryAfter: 30 * time.Second,
+		cache:      make(map[string]stunMapping),
+	}
+}
+
+// stunResult is discovery running in background
+type stunResult struct {
+	done    chan struct{}
+	mapping stunMapping
+	err     error
+}
+
+// wait blocks until discovery is done
+func (r *stunResult) wait() (stunMapping, error) {
+	<-r.done
+	return r.mapping, r.err
+}
+
+// discover starts discovery of mapping of media sockets. It is started once sockets
+// are created, so it runs while call is setup, and result is needed only for SDP
+func (s *stunDiscovery) discover(laddr *net.UDPAddr, rtpConn *mediaConn, rtcpConn *mediaConn) *stunResult {
+	r := &stunResult{done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		r.mapping, r.err = s.mapping(laddr, rtpConn, rtcpConn)
+	}()
+	return r
+}
+
+// mapping returns cached mapping for media local address or does discovery
+func (s *stunDiscovery) mapping(laddr *net.UDPAddr, rtpConn *mediaConn, rtcpConn *mediaConn) (stunMapping, error) {
+	key := laddr.String()
+	now := time.Now()
+
+	s.mu.Lock()
+	m, exists := s.cache[key]
+	failedUntil := s.failedUntil
+	s.mu.Unlock()
+	if exists && now.Before(m.expires) {
+		return m, nil
+	}
+	if now.Before(failedUntil) {
+		return m, fmt.Errorf("stun discovery failed recently, next try in %s", failedUntil.Sub(now).Round(time.Second))
+	}
+
+	m, err := s.bind(laddr, rtpConn, rtcpConn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.failedUntil = time.Now().Add(s.retryAfter)
+		return m, err
+	}
+
+	// Cleanup expired ones, as ports are normally changing
+	for k, v := range s.cache {
+		if now.After(v.expires) {
+			delete(s.cache, k)
+		}
+	}
+	m.expires = now.Add(s.ttl)
+	s.cache[key] = m
+	return m, nil
+}
+
+// bind does RTP and RTCP binding in parallel
+func (s *stunDiscovery) bind(laddr *net.UDPAddr, rtpConn *mediaConn, rtcpConn *mediaConn) (stunMapping, error) {
+	// Server must be of same family as our socket
+	network := "udp4"
+	if laddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	server, err := net.ResolveUDPAddr(network, s.server)
+	if err != nil {
+		return stunMapping{}, fmt.Errorf("fail to resolve stun server: %w", err)
+	}
+
+	var m stunMapping
+	var rtcpErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		m.rtcp, rtcpErr = stunBinding(rtcpConn, server, s.timeout)
+	}()
+	m.rtp, err = stunBinding(rtpConn, server, s.timeout)
+	wg.Wait()
+	if err != nil {
+		return m, fmt.Errorf("rtp binding: %w", err)
+	}
+	if rtcpErr != nil {
+		return m, fmt.Errorf("rtcp binding: %w", rtcpErr)
+	}
+	return m, nil
+}
+
+// stunBinding sends binding request on conn and waits for response with mapped address.
+// Request is retransmitted starting with 500ms interval. Other packets received meanwhile
+// are queued on conn for media reading
+func stunBinding(conn *mediaConn, server *net.UDPAddr, timeout time.Duration) (*net.UDPAddr, error) {
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	deadline := time.Now().Add(timeout)
+	rto := 500 * time.Millisecond
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(req.Raw, server); err != nil {
+			return nil, err
+		}
+
+		readDeadline := time.Now().Add(rto)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		conn.SetReadDeadline(readDeadline)
+		rto *= 2
+		for {
+			n, src, err := conn.PacketConn.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					break
+				}
+				return nil, err
+			}
+
+			if !stun.IsMessage(buf[:n]) {
+				conn.queue(buf[:n], src)
+				continue
+			}
+			res := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+			if err := res.Decode(); err != nil || res.TransactionID != req.TransactionID {
+				// ICE checks can come as well
+				conn.queue(buf[:n], src)
+				continue
+			}
+			return stunMappedAddress(res)
+		}
+	}
+	return nil, ErrSTUNTimeout
+}
+
+// stunMappedAddress returns mapped address of binding response
+func stunMappedAddress(res *stun.Message) (*net.UDPAddr, error) {
+	if res.Type != stun.BindingSuccess {
+		return nil, fmt.Errorf("stun binding failed: %s", res.Type)
+	}
+
+	var xaddr stun.XORMappedAddress
+	if err := xaddr.GetFrom(res); err == nil {
+		return &net.UDPAddr{IP: xaddr.IP, Port: xaddr.Port}, nil
+	}
+	var addr stun.MappedAddress
+	if err := addr.GetFrom(res); err != nil {
+		return nil, fmt.Errorf("no mapped address in stun response: %w", err)
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+}
+
+// mediaConn is media socket. Packets which are read while STUN binding waits response
+// are queued and returned on next read, so that no media is lost
+type mediaConn struct {
+	net.PacketConn
+
+	mu     sync.Mutex
+	queued []queuedPacket
+}
+
+type queuedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// mediaConnQueueSize limits queued packets, which is about 1s of 20ms RTP
+const mediaConnQueueSize = 50
+
+func (c *mediaConn) queue(data []byte, addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queued) < mediaConnQueueSize {
+		c.queued = append(c.queued, queuedPacket{data: append([]byte(nil), data...), addr: addr})
+	}
+}
+
+func (c *mediaConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	if len(c.queued) > 0 {
+		p := c.queued[0]
+		c.queued = c.queued[1:]
+		c.mu.Unlock()
+		return copy(b, p.data), p.addr, nil
+	}
+	c.mu.Unlock()
+	return c.PacketConn.ReadFrom(b)
+}
+
+// stunBindingResponse builds success response for binding request. Setters can add
+// integrity for ICE connectivity checks
+func stunBindingResponse(req *stun.Message, src *net.UDPAddr, setters ...stun.Setter) (*stun.Message, error) {
+	setters = append([]stun.Setter{
+		req,
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: src.IP, Port: src.Port},
+	}, setters...)
+	setters = append(setters, stun.Fingerprint)
+	return stun.Build(setters...)
+}
@@ -0,0 +1,203 @@
+package sipgox
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/stun/v3"
+)
+
+// stunTestServer answers binding requests with source address of request.
+// Before response it sends RTP packet to client, as it could arrive while binding
+type stunTestServer struct {
+	conn     *net.UDPConn
+	requests atomic.Int32
+	sendRTP  bool
+	silent   bool
+}
+
+func newSTUNTestServer(t *testing.T, sendRTP bool, silent bool) *stunTestServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stunTestServer{conn: conn, sendRTP: sendRTP, silent: silent}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *stunTestServer) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stunTestServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := &stun.Message{Raw: append([]byte{}, buf[:n]...)}
+		if err := req.Decode(); err != nil || req.Type != stun.BindingRequest {
+			continue
+		}
+		s.requests.Add(1)
+		if s.silent {
+			continue
+		}
+
+		if s.sendRTP {
+			pkt := rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 1, SSRC: 1234}, Payload: []byte{1, 2, 3}}
+			data, _ := pkt.Marshal()
+			s.conn.WriteToUDP(data, src)
+		}
+		res, err := stunBindingResponse(req, src)
+		if err != nil {
+			continue
+		}
+		s.conn.WriteToUDP(res.Raw, src)
+	}
+}
+
+func newTestMediaConn(t *testing.T) *mediaConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &mediaConn{PacketConn: conn}
+}
+
+func TestSTUNBinding(t *testing.T) {
+	server := newSTUNTestServer(t, true, false)
+	conn := newTestMediaConn(t)
+
+	saddr, _ := net.ResolveUDPAddr("udp4", server.addr())
+	mapped, err := stunBinding(conn, saddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	if !mapped.IP.Equal(laddr.IP) || mapped.Port != laddr.Port {
+		t.Errorf("expected mapped address %s, got %s", laddr, mapped)
+	}
+
+	// RTP received during binding must be read by media
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, src, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected queued RTP: %v", err)
+	}
+	pkt := rtp.Packet{}
+	if err := pkt.Unmarshal(buf[:n]); err != nil || pkt.SSRC != 1234 {
+		t.Errorf("unexpected queued packet %v %v", pkt, err)
+	}
+	if src.String() != server.addr() {
+		t.Errorf("expected source %s, got %s", server.addr(), src)
+	}
+}
+
+func TestSTUNBindingTimeout(t *testing.T) {
+	server := newSTUNTestServer(t, false, true)
+	conn := newTestMediaConn(t)
+
+	saddr, _ := net.ResolveUDPAddr("udp4", server.addr())
+	_, err := stunBinding(conn, saddr, 700*time.Millisecond)
+	if !errors.Is(err, ErrSTUNTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	// Retransmitted after 500ms
+	if r := server.requests.Load(); r != 2 {
+		t.Errorf("expected 2 requests, got %d", r)
+	}
+}
+
+func TestSTUNDiscovery(t *testing.T) {
+	server := newSTUNTestServer(t, false, false)
+	s := newSTUNDiscovery(server.addr(), time.Minute)
+	rtpConn, rtcpConn := newTestMediaConn(t), newTestMediaConn(t)
+	laddr := rtpConn.LocalAddr().(*net.UDPAddr)
+
+	m, err := s.discover(laddr, rtpConn, rtcpConn).wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.rtp.Port != laddr.Port || m.rtcp.Port != rtcpConn.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("unexpected mapping rtp=%s rtcp=%s", m.rtp, m.rtcp)
+	}
+
+	// Same sockets are served from cache
+	if _, err := s.discover(laddr, rtpConn, rtcpConn).wait(); err != nil {
+		t.Fatal(err)
+	}
+	if r := server.requests.Load(); r != 2 {
+		t.Errorf("expected only RTP and RTCP binding, got %d requests", r)
+	}
+}
+
+func TestSTUNDiscoveryFailure(t *testing.T) {
+	server := newSTUNTestServer(t, false, true)
+	s := newSTUNDiscovery(server.addr(), time.Minute)
+	s.timeout = 100 * time.Millisecond
+	rtpConn, rtcpConn := newTestMediaConn(t), newTestMediaConn(t)
+	laddr := rtpConn.LocalAddr().(*net.UDPAddr)
+
+	if _, err := s.discover(laddr, rtpConn, rtcpConn).wait(); !errors.Is(err, ErrSTUNTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	requests := server.requests.Load()
+
+	// Next call is not delayed while server is failing
+	start := time.Now()
+	if _, err := s.discover(laddr, rtpConn, rtcpConn).wait(); err == nil {
+		t.Fatal("expected error")
+	}
+	if time.Since(start) > 50*time.Millisecond || server.requests.Load() != requests {
+		t.Error("expected discovery to be skipped after failure")
+	}
+}
+
+func TestFlowConnBinding(t *testing.T) {
+	server := newSTUNTestServer(t, true, false)
+	conn := newTestMediaConn(t)
+	flow := newFlowConn(conn.PacketConn)
+
+	// Transport reads flow. STUN responses must not reach it
+	read := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, _, err := flow.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			read <- append([]byte{}, buf[:n]...)
+		}
+	}()
+	<-flow.reading
+
+	saddr, _ := net.ResolveUDPAddr("udp4", server.addr())
+	mapped, err := flow.binding(saddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	if !mapped.IP.Equal(laddr.IP) || mapped.Port != laddr.Port {
+		t.Errorf("expected mapped address %s, got %s", laddr, mapped)
+	}
+
+	select {
+	case data := <-read:
+		if stun.IsMessage(data) {
+			t.Error("STUN response passed to transport")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected other packet passed to transport")
+	}
+}
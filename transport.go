@@ -0,0 +1,148 @@
+package sipgox
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// uriTransport returns transport from uri param. Uri header transport is still
+// checked as Register was reading it from there. Default is udp
+func uriTransport(uri sip.Uri) string {
+	if uri.UriParams != nil {
+		if t, _ := uri.UriParams.Get("transport"); t != "" {
+			return strings.ToLower(t)
+		}
+	}
+	if uri.Headers != nil {
+		if t, _ := uri.Headers.Get("transport"); t != "" {
+			return strings.ToLower(t)
+		}
+	}
+	return "udp"
+}
+
+// isStreamTransport is connection oriented transport where we keep connection alive with CRLF
+func isStreamTransport(network string) bool {
+	return network == "tcp" || network == "tls"
+}
+
+// contactHeader builds our Contact with transport as uri param.
+// WebSocket client Contact has .invalid host without port
+// https://datatracker.ietf.org/doc/html/rfc7118#section-5
+func (p *Phone) contactHeader(host string, port int, network string) sip.ContactHeader {
+	if isWebSocket(network) {
+		port = 0
+	}
+	return sip.ContactHeader{
+		Address: sip.Uri{
+			User:      p.UA.Name(),
+			Host:      host,
+			Port:      port,
+			UriParams: sip.HeaderParams{"transport": network},
+			Headers:   sip.NewParams(),
+		},
+		Params: sip.NewParams(),
+	}
+}
+
+// clientContactHeader builds Contact for client with local address host and port.
+// External address is used if set, except for WebSocket which is never reached on its address
+func (p *Phone) clientContactHeader(host string, port int, network string) sip.ContactHeader {
+	if !isWebSocket(network) {
+		host, port = p.externalHostPort(host, port)
+	}
+	return p.contactHeader(host, port, network)
+}
+
+// clientLocalHostPort returns local address for client connection to target.
+// For TCP/TLS address of existing connection is returned so that connection is reused for new dialogs
+// and in dialog requests. WebSocket client uses .invalid host
+func (p *Phone) clientLocalHostPort(network string, target string) (string, int, error) {
+	if isWebSocket(network) {
+		return wsInvalidHost(), 0, nil
+	}
+	if !isStreamTransport(network) {
+		return p.getInterfaceHostPort(network, target)
+	}
+
+	key := network + ":" + target
+	p.mu.Lock()
+	addr, exists := p.streamAddrs[key]
+	p.mu.Unlock()
+	if exists {
+		if c, _ := p.UA.TransportLayer().GetConnection(network, addr); c != nil {
+			return sip.ParseAddr(addr)
+		}
+	}
+
+	host, port, err := p.getInterfaceHostPort(network, target)
+	if err != nil {
+		return host, port, err
+	}
+
+	p.mu.Lock()
+	if p.streamAddrs == nil {
+		p.streamAddrs = make(map[string]string)
+	}
+	p.streamAddrs[key] = net.JoinHostPort(host, strconv.Itoa(port))
+	p.mu.Unlock()
+	return host, port, nil
+}
+
+var keepAliveCRLF = []byte("\r\n\r\n")
+
+// keepAlive sends double CRLF ping on connection with local address laddr until context is done.
+// https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.1
+func (p *Phone) keepAlive(ctx context.Context, network string, laddr string) {
+	if p.keepAliveInterval <= 0 || !isStreamTransport(network) {
+		return
+	}
+	p.sendKeepAlive(ctx, network, laddr, p.keepAliveInterval, writeKeepAlive)
+}
+
+func writeKeepAlive(c sip.Connection) error {
+	w, ok := c.(io.Writer)
+	if !ok {
+		return nil
+	}
+	_, err := w.Write(keepAliveCRLF)
+	return err
+}
+
+// keepAliveWait randomizes interval between 80% and 100% of it
+// https://datatracker.ietf.org/doc/html/rfc5626#section-4.4.1
+func keepAliveWait(interval time.Duration) time.Duration {
+	return interval - time.Duration(rand.Int63n(int64(interval)/5+1))
+}
+
+// sendKeepAlive calls write on connection with local address laddr until context is done
+func (p *Phone) sendKeepAlive(ctx context.Context, network string, laddr string, interval time.Duration, write func(c sip.Connection) error) {
+	log := p.log.With().Str("network", network).Str("laddr", laddr).Logger()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(keepAliveWait(interval)):
+			}
+
+			c, err := p.UA.TransportLayer().GetConnection(network, laddr)
+			if err != nil || c == nil {
+				log.Info().Err(err).Msg("Keep alive stopped. Connection is closed")
+				return
+			}
+			if err := write(c); err != nil {
+				log.Error().Err(err).Msg("Keep alive failed")
+				return
+			}
+			log.Debug().Msg("Keep alive CRLF sent")
+		}
+	}()
+}
@@ -0,0 +1,22 @@
+package sipgox
+
+import (
+	"strings"
+
+	"github.com/emiago/sipgo/sip"
+)
+
+// SIP over WebSocket client
+// https://datatracker.ietf.org/doc/html/rfc7118
+
+func isWebSocket(network string) bool {
+	return network == "ws" || network == "wss"
+}
+
+// wsInvalidHost generates random host in .invalid domain. WebSocket client can not be reached
+// on its address, so this is used for Via sent-by and Contact and all requests are received
+// over same connection
+// https://datatracker.ietf.org/doc/html/rfc7118#section-5.2
+func wsInvalidHost() string {
+	return strings.ToLower(sip.RandString(12)) + ".invalid"
+}